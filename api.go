@@ -0,0 +1,309 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// apiAlbumsPermissions and apiAlbumPermissions say which permission each API method needs
+var (
+	apiAlbumsPermissions = map[string]Permission{
+		http.MethodGet:  PermAlbumRead,
+		http.MethodPost: PermAlbumAdd,
+	}
+	apiAlbumPermissions = map[string]Permission{
+		http.MethodGet:    PermAlbumRead,
+		http.MethodPost:   PermAlbumEdit, // adds a track at /api/albums/{id}/tracks or a stock movement at .../stock
+		http.MethodPut:    PermAlbumEdit,
+		http.MethodDelete: PermAlbumDelete,
+	}
+	// editors may replace and remove covers, which apiAlbumPermissions would keep DELETE from
+	apiAlbumCoverPermissions = map[string]Permission{
+		http.MethodPut:    PermAlbumEdit,
+		http.MethodDelete: PermAlbumEdit,
+	}
+	apiTrackPermissions = map[string]Permission{
+		http.MethodGet:    PermAlbumRead,
+		http.MethodPut:    PermAlbumEdit,
+		http.MethodDelete: PermAlbumEdit,
+	}
+)
+
+// apiAlbumsHandler serves /api/albums: GET lists albums (filtered by title, artist, price or track title,
+// narrowed by genre, tag, label, format, year, price range and lowest rating, sorted by ?sort=, priced in
+// ?currency= too), POST adds one
+func apiAlbumsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	switch r.Method {
+	case http.MethodGet:
+		q := r.URL.Query()
+		price, err := parsePrice("apiAlbumsHandler", q.Get("price"))
+		if err != nil {
+			renderError(w, r, err)
+			return
+		}
+		cur := displayCurrency(r)
+		filter, err := albumFilter("apiAlbumsHandler", q.Get, cur)
+		if err != nil {
+			renderError(w, r, err)
+			return
+		}
+		var albums []AlbumMap
+		filtered := false
+		switch {
+		case !price.IsZero():
+			albums, err = albumsByPrice(ctx, price)
+		case q.Get("title") != "":
+			albums, err = albumsByTitle(ctx, q.Get("title"))
+		case q.Get("artist") != "":
+			albums, err = albumsByArtist(ctx, q.Get("artist"))
+		case q.Get("track") != "":
+			albums, err = albumsByTrack(ctx, q.Get("track"))
+		case filter.active() || filter.Sort != "":
+			albums, err = albumsByFilter(ctx, filter, 0)
+			filtered = true
+		default:
+			albums, err = dataDump(ctx)
+		}
+		if err == nil && !filtered {
+			albums, err = filterAlbums(ctx, albums, filter)
+		}
+		if err != nil {
+			renderError(w, r, err)
+			return
+		}
+		if albums == nil {
+			albums = []AlbumMap{}
+		}
+		if err := attachCredits(ctx, albums); err != nil {
+			renderError(w, r, err)
+			return
+		}
+		if err := attachTrackStats(ctx, albums); err != nil {
+			renderError(w, r, err)
+			return
+		}
+		if err := attachGenresAndTags(ctx, albums); err != nil {
+			renderError(w, r, err)
+			return
+		}
+		if err := attachStock(ctx, albums); err != nil {
+			renderError(w, r, err)
+			return
+		}
+		if err := attachDisplayPrices(ctx, albums, cur); err != nil {
+			renderError(w, r, err)
+			return
+		}
+		if err := attachRatings(ctx, albums); err != nil {
+			renderError(w, r, err)
+			return
+		}
+		sortAlbums(albums, filter.Sort)
+		writeJSON(w, http.StatusOK, albums)
+	case http.MethodPost:
+		var in AlbumMap
+		if err := decodeJSON(r, &in); err != nil {
+			renderError(w, r, err)
+			return
+		}
+		id, err := addAlbum(ctx, albumFromMap(in))
+		if err != nil {
+			renderError(w, r, err)
+			return
+		}
+		alb, err := albumByID(withPrimary(ctx), id)
+		if err != nil {
+			renderError(w, r, err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, albumMap(alb))
+	default:
+		methodNotAllowed(w, "GET, POST")
+	}
+}
+
+// apiAlbumRoutes checks the permission for /api/albums/{id} and below, /cover and /reviews having their own
+func apiAlbumRoutes(w http.ResponseWriter, r *http.Request) {
+	perms := apiAlbumPermissions
+	switch {
+	case strings.HasSuffix(r.URL.Path, "/cover"):
+		perms = apiAlbumCoverPermissions
+	case strings.HasSuffix(r.URL.Path, "/reviews"):
+		perms = apiAlbumReviewsPermissions
+	}
+	requireMethodPermission(perms, apiAlbumHandler)(w, r)
+}
+
+// apiAlbumHandler serves /api/albums/{id}: GET, PUT and DELETE, and /api/albums/{id}/tracks, /stock, /cover and /reviews
+func apiAlbumHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	idStr, sub, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/api/albums/"), "/")
+	id, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil || id <= 0 || (sub != "" && sub != "tracks" && sub != "stock" && sub != "cover" && sub != "reviews") {
+		renderError(w, r, notFound("apiAlbumHandler", "There is no album at %s.", r.URL.Path))
+		return
+	}
+	switch sub {
+	case "tracks":
+		apiAlbumTracksHandler(w, r, id)
+		return
+	case "stock":
+		apiAlbumStockHandler(w, r, id)
+		return
+	case "cover":
+		apiAlbumCoverHandler(w, r, id)
+		return
+	case "reviews":
+		apiAlbumReviewsHandler(w, r, id)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		alb, err := albumByID(ctx, id)
+		if err != nil {
+			renderError(w, r, err)
+			return
+		}
+		one := []AlbumMap{albumMap(alb)}
+		if err := attachDisplayPrices(ctx, one, displayCurrency(r)); err != nil {
+			renderError(w, r, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, one[0])
+	case http.MethodPut:
+		var in AlbumMap
+		if err := decodeJSON(r, &in); err != nil {
+			renderError(w, r, err)
+			return
+		}
+		// genres or tags left out of the body stay as they are, an empty list clears them
+		alb := albumFromMap(in)
+		alb.ID = id
+		if _, _, err := updateAlbum(ctx, alb); err != nil {
+			renderError(w, r, err)
+			return
+		}
+		alb, err := albumByID(withPrimary(ctx), id)
+		if err != nil {
+			renderError(w, r, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, albumMap(alb))
+	case http.MethodDelete:
+		if err := deleteAlbumByID(ctx, id); err != nil {
+			renderError(w, r, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		methodNotAllowed(w, "GET, PUT, DELETE")
+	}
+}
+
+// apiAlbumTracksHandler serves /api/albums/{id}/tracks: GET lists the album's tracks, POST adds one
+func apiAlbumTracksHandler(w http.ResponseWriter, r *http.Request, albumID int64) {
+	ctx := r.Context()
+	switch r.Method {
+	case http.MethodGet:
+		// the album must exist, an empty list means it has no tracks yet
+		alb, err := albumByID(ctx, albumID)
+		if err != nil {
+			renderError(w, r, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, alb.Tracks)
+	case http.MethodPost:
+		var in Track
+		if err := decodeJSON(r, &in); err != nil {
+			renderError(w, r, err)
+			return
+		}
+		in.ID, in.AlbumID = 0, albumID
+		t, err := saveTrack(ctx, in)
+		if err != nil {
+			renderError(w, r, err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, t)
+	default:
+		methodNotAllowed(w, "GET, POST")
+	}
+}
+
+// apiTrackHandler serves /api/tracks/{id}: GET, PUT and DELETE
+func apiTrackHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	id, err := strconv.ParseInt(strings.TrimPrefix(r.URL.Path, "/api/tracks/"), 10, 64)
+	if err != nil || id <= 0 {
+		renderError(w, r, notFound("apiTrackHandler", "There is no track at %s.", r.URL.Path))
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		t, err := trackByID(ctx, id)
+		if err != nil {
+			renderError(w, r, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, t)
+	case http.MethodPut:
+		var in Track
+		if err := decodeJSON(r, &in); err != nil {
+			renderError(w, r, err)
+			return
+		}
+		in.ID = id
+		t, err := saveTrack(ctx, in)
+		if err != nil {
+			renderError(w, r, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, t)
+	case http.MethodDelete:
+		if _, err := deleteTrack(ctx, id); err != nil {
+			renderError(w, r, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		methodNotAllowed(w, "GET, PUT, DELETE")
+	}
+}
+
+// albumMap converts an Album to its JSON shape, with its tracks and their count and running time
+func albumMap(alb Album) AlbumMap {
+	stats := statsOf(alb.Tracks)
+	return AlbumMap{ID: alb.ID, Title: alb.Title, Artist: alb.Artist, Price: alb.Price, Released: alb.Released, Label: alb.Label,
+		Format: alb.Format, CatalogNumber: alb.CatalogNumber, Notes: alb.Notes, Artists: alb.Credits,
+		TrackCount: stats.Count, RunningTime: stats.Seconds, Tracks: alb.Tracks, Genres: alb.Genres, Tags: alb.Tags, Stock: alb.Stock, Cover: alb.Cover,
+		Rating: alb.Rating}
+}
+
+// albumFromMap is the album to write from a JSON body or import; the id, tracks, stats, stock, cover and rating are ignored
+func albumFromMap(in AlbumMap) Album {
+	return Album{Title: in.Title, Artist: in.Artist, Price: in.Price, Released: in.Released, Label: in.Label, Format: in.Format,
+		CatalogNumber: in.CatalogNumber, Notes: in.Notes, Credits: in.Artists, Genres: in.Genres, Tags: in.Tags}
+}
+
+// decodeJSON reads a JSON request body into v, rejecting unknown fields and oversized bodies
+func decodeJSON(r *http.Request, v interface{}) error {
+	dec := json.NewDecoder(http.MaxBytesReader(nil, r.Body, 1<<20))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return invalid("decodeJSON", "The request body is not valid JSON: %v", err)
+	}
+	return nil
+}
+
+// methodNotAllowed writes a 405 JSON error listing the allowed methods
+func methodNotAllowed(w http.ResponseWriter, allow string) {
+	w.Header().Set("Allow", allow)
+	writeJSON(w, http.StatusMethodNotAllowed, map[string]interface{}{
+		"error": map[string]string{"code": "method_not_allowed", "message": "Use one of: " + allow},
+	})
+}
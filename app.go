@@ -1,553 +1,1024 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"fmt"
-	"math"
 	"net/http"
+	"net/url"
 	"os"
-	"reflect"
 	"sort"
 	"strconv"
 	"strings"
-	"text/template"
 
-	"github.com/go-sql-driver/mysql"
 	log "github.com/sirupsen/logrus"
 )
 
 var db *sql.DB
 
-// validate templates
-var tmpl = template.Must(template.ParseFiles("templates/search.html", "templates/add.html", "templates/delete.html", "templates/dump.html", "templates/test.html"))
-
-// Album struct
+// Album struct. Artist is the display credit made from Credits. Genres and Tags are
+// names; nil ones are left as they are by updateAlbum. Released is YYYY-MM-DD or empty.
+// Stock is read only, it changes through recordMovement, and so is Cover, which changes through setCover,
+// and Rating, which comes from the album's reviews.
 type Album struct {
-	ID     int64
-	Title  string
-	Artist string
-	Price  float32
+	ID            int64
+	Title         string
+	Artist        string
+	Price         Money
+	Released      string
+	Label         string
+	Format        AlbumFormat
+	CatalogNumber string
+	Notes         string
+	Credits       []Credit
+	Tracks        []Track
+	Genres        []string
+	Tags          []string
+	Stock         StockLevel
+	Cover         Cover
+	Rating        RatingSummary
 }
 
-// AlbumMap struct with keys that are json tag names
+// AlbumMap struct with keys that are json tag names. The track count and running
+// time (in seconds) and the stock are filled in for listings, the tracks themselves for single albums.
+// DisplayPrice is the price in the currency the API client asked for with ?currency=.
 type AlbumMap struct {
-	ID     int64   `json:"id"`
-	Title  string  `json:"title"`
-	Artist string  `json:"artist"`
-	Price  float32 `json:"price"`
+	ID            int64         `json:"id"`
+	Title         string        `json:"title"`
+	Artist        string        `json:"artist"`
+	Price         Money         `json:"price"`
+	DisplayPrice  *Money        `json:"display_price,omitempty"`
+	Released      string        `json:"released,omitempty"`
+	Label         string        `json:"label,omitempty"`
+	Format        AlbumFormat   `json:"format,omitempty"`
+	CatalogNumber string        `json:"catalog_number,omitempty"`
+	Notes         string        `json:"notes,omitempty"`
+	Artists       []Credit      `json:"artists,omitempty"`
+	TrackCount    int           `json:"track_count"`
+	RunningTime   int           `json:"running_time"`
+	Tracks        []Track       `json:"tracks,omitempty"`
+	Genres        []string      `json:"genres,omitempty"`
+	Tags          []string      `json:"tags,omitempty"`
+	Stock         StockLevel    `json:"stock"`
+	Cover         Cover         `json:"cover"`
+	Rating        RatingSummary `json:"rating"`
 }
 
-// Page structure
+// Page structure. Genres, Tags and Labels fill the filter dropdowns, Filter is the one applied.
 type Page struct {
 	Titles []string
 	Body   []AlbumMap
-	Price  []float32
+	Price  []Money
 	Names  []string
+	Track  string
+	Genres []Genre
+	Tags   []TagCount
+	Labels []string
+	Filter AlbumFilter
 }
 
 func main() {
-	l := log.WithField("Alpha", "starting up...")
-	// Capture connection properties.
-	cfg := mysql.Config{
-		User:   os.Getenv("DBUSER"),
-		Passwd: os.Getenv("DBPASS"),
-		Net:    "tcp",
-		Addr:   "127.0.0.1:3306",
-		DBName: "recordings",
-	}
-	// Get a database handle.
-	var err error
-	db, err = sql.Open("mysql", cfg.FormatDSN())
-	if err != nil {
-		l.Fatal(err)
-	}
-
-	pingErr := db.Ping()
-	if pingErr != nil {
-		l.Fatal(pingErr)
+	if err := run(os.Args[1:]); err != nil {
+		log.WithField("func", "main").Fatal(err)
 	}
+}
 
-	l = log.WithFields(log.Fields{
-		"In":      "main()",
-		"Action":  "Connect db",
-		"DB Name": cfg.DBName,
-	})
-	l.Info("Connected!\n")
-
-	// TEST in MAIN
-	/*cmd := "SELECT * FROM album;"
-	res, err := genericQuery(cmd)
-
-	for _, r := range res {
-		fmt.Println(r)
-	}
-	 check := func(err error, at string) {
-		if err != nil {
-			log.Fatalf("\nERROR: %v; \nHAPPENED AT: %v", err, at)
-		}
-	}
-	a, err := albumsByArtist("John Coltrane")
-	check(err, "--> main albumsByArtist search")
-	fmt.Println("albumsByArtist John Coltrane:", a)
-
-	d, err := albumByID(1)
-	check(err, "main albumByID")
-	fmt.Println("albumByID 1: ", d)
-
-	b, err := albumsByPrice(1.99)
-	check(err, "main albumsByPrice test")
-	fmt.Println("test in main, albumsByPrice $1.99: ", b)
-
-	c, err := albumsByTitle("Giant Steps")
-	check(err, "main albumsByTitle")
-	fmt.Println("albumsByTitle ': ", c) */
-
-	//END TEST
-
-	//http call handler:
-	http.HandleFunc("/", searchHandler)
-	http.HandleFunc("/add", addHandler)
-	http.HandleFunc("/delete", deleteHandler)
-	http.HandleFunc("/dump", dumpHandler)
-	http.HandleFunc("/test", testHandler)
-	http.HandleFunc("/edit", editHandler)
-	http.HandleFunc("/styles/", func(w http.ResponseWriter, r *http.Request) {
+// routes registers the http handlers and wraps them in the middleware chain
+func routes() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", searchHandler)
+	mux.HandleFunc("/add", requirePermission(PermAlbumAdd, addHandler))
+	mux.HandleFunc("/delete", requirePermission(PermAlbumDelete, deleteHandler))
+	mux.HandleFunc("/dump", dumpHandler)
+	mux.HandleFunc("/test", testHandler)
+	mux.HandleFunc("/edit", requirePermission(PermAlbumEdit, editHandler))
+	mux.HandleFunc("/album", requireMethodPermission(albumPagePermissions, albumHandler))
+	mux.HandleFunc("/review", requirePermission(PermReviewsWrite, reviewHandler))
+	mux.HandleFunc("/profile", requirePermission(PermAlbumRead, profileHandler))
+	mux.HandleFunc("/lists", requirePermission(PermListsOwn, listsHandler))
+	mux.HandleFunc("/lists/export", requirePermission(PermAlbumRead, listExportHandler))
+	mux.HandleFunc("/login", loginHandler)
+	mux.HandleFunc("/logout", logoutHandler)
+	mux.HandleFunc("/healthz", healthHandler)
+	mux.HandleFunc("/api/albums", requireMethodPermission(apiAlbumsPermissions, apiAlbumsHandler))
+	mux.HandleFunc("/api/albums/", apiAlbumRoutes)
+	mux.HandleFunc("/api/tracks/", requireMethodPermission(apiTrackPermissions, apiTrackHandler))
+	mux.HandleFunc("/api/reviews/", requireMethodPermission(apiReviewPermissions, apiReviewHandler))
+	mux.HandleFunc("/api/lists", requireMethodPermission(apiListsPermissions, apiListsHandler))
+	mux.HandleFunc("/api/lists/", requireMethodPermission(apiListPermissions, apiListHandler))
+	mux.HandleFunc("/tags", requirePermission(PermAlbumRead, tagsHandler))
+	mux.HandleFunc("/api/tags", requirePermission(PermAlbumRead, apiTagsHandler))
+	mux.HandleFunc("/api/genres", requirePermission(PermAlbumRead, apiGenresHandler))
+	mux.HandleFunc("/stock", requirePermission(PermAlbumRead, stockHandler))
+	mux.HandleFunc("/api/stock/low", requirePermission(PermAlbumRead, apiLowStockHandler))
+	mux.HandleFunc("/currency", currencyHandler)
+	mux.HandleFunc("/api/rates", requireMethodPermission(apiRatesPermissions, apiRatesHandler))
+	mux.HandleFunc("/covers/", coverHandler)
+	mux.HandleFunc("/users", requirePermission(PermUsersManage, usersHandler))
+	mux.HandleFunc("/tokens", requirePermission(PermTokensOwn, tokensHandler))
+	mux.HandleFunc("/console", requirePermission(PermSQLConsole, consoleHandler))
+	mux.HandleFunc("/api/sql", requirePermission(PermSQLConsole, apiSQLHandler))
+	mux.HandleFunc("/api/sql/history", requirePermission(PermSQLConsole, apiSQLHistoryHandler))
+	mux.HandleFunc("/styles/", func(w http.ResponseWriter, r *http.Request) {
 		http.ServeFile(w, r, "styles/style.css")
 	})
-	l.Info("Serving http://localhost:8080")
-	l.Fatal(http.ListenAndServe(":8080", nil))
-
+	mux.Handle("/static/", staticHandler())
+	reads := newLimiter(appCfg.RateLimitRead, appCfg.RateLimitReadBurst)
+	writes := newLimiter(appCfg.RateLimitWrite, appCfg.RateLimitWriteBurst)
+	writers := newRecentWriters(appCfg.DBReadYourWrites)
+	return requestLogger(securityHeaders(recoverPanics(requireDB(rateLimit(reads, writes, loadSession(limitUsers(reads, writes, pinWrites(writers, limitUploads(csrfProtect(mux))))))))))
 }
 
 // albumsByArtist queries for albums that have the specified artist name.
-func albumsByArtist(name string) ([]AlbumMap, error) {
+func albumsByArtist(ctx context.Context, name string) ([]AlbumMap, error) {
 	// An albums slice to hold data from returned rows.
 	var album = []AlbumMap{}
-	l := log.WithFields(log.Fields{"in": "albumsByArtist()", "Action": "Fetched albums by artist"})
+	l := logFrom(ctx).WithFields(log.Fields{"func": "albumsByArtist", "artist": name})
 
-	rows, err := db.Query("SELECT * FROM album WHERE artist = ?", name)
+	// any credit counts, so featured artists, composers and artists of single tracks find their albums too
+	rows, err := readDB(ctx).QueryContext(ctx, `SELECT `+albumColumns+` FROM album a
+		WHERE a.id IN (SELECT aa.album_id FROM album_artists aa JOIN artists ar ON ar.id = aa.artist_id WHERE ar.name = ?)
+		OR a.id IN (SELECT t.album_id FROM tracks t JOIN artists ar ON ar.id = t.artist_id WHERE ar.name = ?)
+		ORDER BY a.title, a.id;`, name, name)
 	if err != nil {
-		return album, fmt.Errorf("albumsByArtist %q: %v", name, err)
+		return album, dbError("albumsByArtist", err)
 	}
 	defer rows.Close()
 	// Loop through rows, using Scan to assign column data to struct fields.
 	for rows.Next() {
 		var alb AlbumMap
-		if err := rows.Scan(&alb.ID, &alb.Title, &alb.Artist, &alb.Price); err != nil {
-			return album, fmt.Errorf("albumsByArtist %q, has this error: %v", name, err)
+		if err := rows.Scan(alb.scanFields()...); err != nil {
+			return album, dbError("albumsByArtist", err)
 		}
 		album = append(album, alb)
 
 	}
 	if err := rows.Err(); err != nil {
-		return []AlbumMap{}, fmt.Errorf("albumsByArtist %q: %v", name, err)
+		return []AlbumMap{}, dbError("albumsByArtist", err)
 	}
-	l = l.WithFields(log.Fields{"data": album})
-	l.Info()
+	l.WithField("count", len(album)).Debug("fetched albums by artist")
 	return album, nil
 }
 
 // album search by title of album
-func albumsByTitle(title string) ([]AlbumMap, error) {
+func albumsByTitle(ctx context.Context, title string) ([]AlbumMap, error) {
 	// An albums slice to hold data from returned rows.
 	var album []AlbumMap
-	l := log.WithFields(log.Fields{"in func": "albumsByTitle()", "title": title})
+	l := logFrom(ctx).WithFields(log.Fields{"func": "albumsByTitle", "title": title})
 
-	rows, err := db.Query("SELECT * FROM album WHERE title = ?", title)
+	rows, err := readDB(ctx).QueryContext(ctx, "SELECT "+albumColumns+" FROM album a WHERE a.title = ?", title)
 	if err != nil {
-		return nil, fmt.Errorf("albumsByTitle %q: %v", title, err)
+		return nil, dbError("albumsByTitle", err)
 	}
 	defer rows.Close()
 	// Loop through rows, using Scan to assign column data to struct fields.
 	for rows.Next() {
 		var alb AlbumMap //keep track of current album and add it to album map
-		if err := rows.Scan(&alb.ID, &alb.Title, &alb.Artist, &alb.Price); err != nil {
-			return nil, fmt.Errorf("albumsByTitle %q: %v", title, err)
+		if err := rows.Scan(alb.scanFields()...); err != nil {
+			return nil, dbError("albumsByTitle", err)
 		}
 		album = append(album, alb)
 	}
 	if err := rows.Err(); err != nil {
-		return nil, fmt.Errorf("albumsByTitle %q: %v", title, err)
+		return nil, dbError("albumsByTitle", err)
 	}
-	l = l.WithFields(log.Fields{"Result": album})
-	l.Info("album: ", album)
+	l.WithField("count", len(album)).Debug("fetched albums by title")
 	return album, nil
 }
 
 // albumsByPrice queries for the album by price.
-func albumsByPrice(price float32) ([]AlbumMap, error) {
+func albumsByPrice(ctx context.Context, price Money) ([]AlbumMap, error) {
 	// An albums slice to hold data from returned rows.
 	var album []AlbumMap
-	l := log.WithFields(log.Fields{"func": "albumsByprice()", "price": price, "price data type": reflect.TypeOf(price)})
+	l := logFrom(ctx).WithFields(log.Fields{"func": "albumsByPrice", "price": price})
 
-	price64 := float64(price)
-	_ = price64 //pretend to do something
-	rows, err := db.Query(fmt.Sprintf("SELECT * FROM album WHERE price = %v;", price))
+	// the amount goes in as text, cast so MySQL compares decimals rather than doubles
+	rows, err := readDB(ctx).QueryContext(ctx, "SELECT "+albumColumns+" FROM album a WHERE a.price = CAST(? AS DECIMAL(10,2)) AND a.currency = ?;",
+		price, price.Currency)
 	if err != nil {
-		return nil, fmt.Errorf("albumsByprice %v: %v", price, err)
+		return nil, dbError("albumsByPrice", err)
 	}
 	defer rows.Close()
 
 	// Loop through rows, using Scan to assign column data to struct fields.
 	for rows.Next() {
 		var alb AlbumMap //keep track of current album and add it to album map
-		if err := rows.Scan(&alb.ID, &alb.Title, &alb.Artist, &alb.Price); err != nil {
-			return nil, fmt.Errorf("albumsByprice %v: %v", price, err)
+		if err := rows.Scan(alb.scanFields()...); err != nil {
+			return nil, dbError("albumsByPrice", err)
 		}
 		album = append(album, alb)
 	}
 	if err := rows.Err(); err != nil {
-		return nil, fmt.Errorf("albumsByprice %v: %v", price, err)
+		return nil, dbError("albumsByPrice", err)
 	}
-	l = l.WithFields(log.Fields{"Result": album})
-	l.Info("album: ", album)
+	l.WithField("count", len(album)).Debug("fetched albums by price")
 	return album, nil
 }
 
 // albumByID queries for the album with the specified ID.
-func albumByID(id int64) (Album, error) {
+func albumByID(ctx context.Context, id int64) (Album, error) {
 	// An album to hold data from the returned row.
 	var alb Album
-	l := log.WithFields(log.Fields{"In": "albumByID()", "id": id})
+	l := logFrom(ctx).WithFields(log.Fields{"func": "albumByID", "album_id": id})
 
-	row := db.QueryRow("SELECT * FROM album WHERE id = ?", id)
-	if err := row.Scan(&alb.ID, &alb.Title, &alb.Artist, &alb.Price); err != nil {
+	conn := readDB(ctx)
+	row := conn.QueryRowContext(ctx, "SELECT "+albumColumns+" FROM album a WHERE a.id = ?", id)
+	if err := row.Scan(alb.scanFields()...); err != nil {
 		if err == sql.ErrNoRows {
-			return alb, fmt.Errorf("albumsById %d: no such album", id)
+			return alb, notFound("albumByID", "There is no album with id %d.", id)
 		}
-		l.Infof("error", err)
-		return alb, fmt.Errorf("albumsById %d: %v", id, err)
+		return alb, dbError("albumByID", err)
 	}
-	l.Info("Done")
+	credits, err := albumCredits(ctx, conn, []int64{id})
+	if err != nil {
+		return alb, err
+	}
+	alb.Credits = credits[id]
+	if alb.Tracks, err = albumTracks(ctx, conn, id); err != nil {
+		return alb, err
+	}
+	genres, tags, err := albumGenresAndTags(ctx, conn, []int64{id})
+	if err != nil {
+		return alb, err
+	}
+	alb.Genres, alb.Tags = genres[id], tags[id]
+	stock, err := stockLevels(ctx, conn, []int64{id})
+	if err != nil {
+		return alb, err
+	}
+	alb.Stock = stock[id]
+	ratings, err := ratingSummaries(ctx, conn, []int64{id})
+	if err != nil {
+		return alb, err
+	}
+	alb.Rating = ratings[id]
+	l.Debug("fetched album by id")
 	return alb, nil
 }
 
 // addAlbum adds specified album to the database, returns album ID of new entry
-func addAlbum(alb Album) (int64, error) {
-	result, err := db.Exec("INSERT INTO album (title, artist, price) VALUES (?, ?, ?)", alb.Title, alb.Artist, alb.Price)
+func addAlbum(ctx context.Context, alb Album) (int64, error) {
+	alb, err := validateAlbum("addAlbum", alb)
+	if err != nil {
+		return 0, err
+	}
+	tx, err := db.BeginTx(ctx, nil)
 	if err != nil {
-		return 0, fmt.Errorf("addAlbum: %v", err)
+		return 0, dbError("addAlbum", err)
+	}
+	defer tx.Rollback()
+
+	if alb.Credits, err = resolveArtists(ctx, tx, alb.Credits); err != nil {
+		return 0, err
+	}
+	alb.Artist = creditLine(alb.Credits)
+	result, err := tx.ExecContext(ctx, "INSERT INTO album (title, artist, price, currency, release_date, label, format, catalog_number, notes) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		append([]interface{}{alb.Title, alb.Artist, alb.Price, alb.Price.Currency}, detailArgs(alb)...)...)
+	if err != nil {
+		return 0, catalogConflict("addAlbum", alb, err)
 	}
 	id, err := result.LastInsertId()
 	if err != nil {
-		return 0, fmt.Errorf("addAlbum: %v", err)
+		return 0, dbError("addAlbum", err)
+	}
+	if err := saveCredits(ctx, tx, id, alb.Credits); err != nil {
+		return 0, err
+	}
+	if _, _, err := saveGenresAndTags(ctx, tx, id, alb.Genres, alb.Tags); err != nil {
+		return 0, err
+	}
+	if err := recordChange(ctx, tx, id, "add"); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, dbError("addAlbum", err)
 	}
+	logFrom(ctx).WithFields(log.Fields{"func": "addAlbum", "album_id": id}).Debug("inserted album")
 	return id, nil
 }
 
-// deleteAlbum does delete the album forever
-func deleteAlbum(alb Album) (int64, error) {
-	l := log.WithFields(log.Fields{"In": "deleteAlbum()", "Album to delete": alb})
+// deleteAlbum does delete the album forever, returns the number of albums deleted
+func deleteAlbum(ctx context.Context, alb Album) (int64, error) {
+	l := logFrom(ctx).WithFields(log.Fields{"func": "deleteAlbum", "title": alb.Title, "artist": alb.Artist})
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, dbError("deleteAlbum", err)
+	}
+	defer tx.Rollback()
+
+	// find the ids first so each deletion can be recorded
+	rows, err := tx.QueryContext(ctx, `SELECT DISTINCT a.id FROM album a
+		JOIN album_artists aa ON aa.album_id = a.id JOIN artists ar ON ar.id = aa.artist_id
+		WHERE a.title = ? AND ar.name = ? FOR UPDATE;`, alb.Title, alb.Artist)
+	if err != nil {
+		return 0, dbError("deleteAlbum", err)
+	}
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, dbError("deleteAlbum", err)
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, dbError("deleteAlbum", err)
+	}
+	if len(ids) == 0 {
+		return 0, notFound("deleteAlbum", "This album doesnt exist! %v by %v", alb.Title, alb.Artist)
+	}
+	covers, err := albumCovers(ctx, tx, ids)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, id := range ids {
+		if _, err := tx.ExecContext(ctx, "DELETE FROM album WHERE id = ?;", id); err != nil {
+			return 0, dbError("deleteAlbum", err)
+		}
+		if err := recordChange(ctx, tx, id, "delete"); err != nil {
+			return 0, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, dbError("deleteAlbum", err)
+	}
+	for _, c := range covers {
+		dropCover(ctx, c)
+	}
+	l.WithField("count", len(ids)).Debug("deleted album")
+	return int64(len(ids)), nil
+}
+
+// deleteAlbumByID deletes the album with the specified ID
+func deleteAlbumByID(ctx context.Context, id int64) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return dbError("deleteAlbumByID", err)
+	}
+	defer tx.Rollback()
 
-	result, err := db.Exec("DELETE FROM album WHERE title = ? AND artist = ?;", alb.Title, alb.Artist)
+	covers, err := albumCovers(ctx, tx, []int64{id})
+	if err != nil {
+		return err
+	}
+	result, err := tx.ExecContext(ctx, "DELETE FROM album WHERE id = ?;", id)
 	if err != nil {
-		return 0, fmt.Errorf("deleteAlbum: %v", err)
+		return dbError("deleteAlbumByID", err)
 	}
+	count, err := result.RowsAffected()
 	if err != nil {
-		return 0, fmt.Errorf("deleteAlbum: %v", err)
+		return dbError("deleteAlbumByID", err)
+	}
+	if count == 0 {
+		return notFound("deleteAlbumByID", "There is no album with id %d.", id)
+	}
+	if err := recordChange(ctx, tx, id, "delete"); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return dbError("deleteAlbumByID", err)
+	}
+	for _, c := range covers {
+		dropCover(ctx, c)
 	}
-	l.Infof("Deletion result: %v ", result)
-	return 1, nil
+	logFrom(ctx).WithFields(log.Fields{"func": "deleteAlbumByID", "album_id": id}).Debug("deleted album")
+	return nil
 }
 
+// recordChange notes who changed an album, inside the caller's transaction
+func recordChange(ctx context.Context, tx *sql.Tx, albumID int64, action string) error {
+	userID, actor := actorFrom(ctx)
+	_, err := tx.ExecContext(ctx, "INSERT INTO album_changes (album_id, action, user_id, actor) VALUES (?, ?, ?, ?);",
+		albumID, action, userID, actor)
+	return dbError("recordChange", err)
+}
+
+// parsePrice converts a price form value to Money; blank means no price
+func parsePrice(op, value string) (Money, error) {
+	if strings.TrimSpace(value) == "" {
+		return Money{}, nil
+	}
+	prc, ok := parseMoney(value, appCfg.BaseCurrency)
+	if !ok {
+		return Money{}, invalid(op, "%q is not a valid price.", value)
+	}
+	return prc, nil
+}
+
+// searchFields are the search form's fields, which the list buttons on the results send again
+var searchFields = []string{"title", "artist", "price", "track", "genre", "tag", "label", "format", "year",
+	"min_price", "max_price", "min_rating", "sort"}
+
 // searchhandler -> search page, results, edit btn
 func searchHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	l := logFrom(ctx).WithField("func", "searchHandler")
 
-	l := log.WithFields(log.Fields{"IN": "Search Handler"})
-
-	//anyonymous func to handle errors
-	check := func(err error, whereAt string) {
-		if err != nil {
-			l = l.WithField("At", whereAt)
-			l.Fatalf("Error at %v: %v", whereAt, err)
-		}
+	// "/" matches every path nobody else handles
+	if r.URL.Path != "/" {
+		renderError(w, r, notFound("searchHandler", "There is no page at %s.", r.URL.Path))
+		return
 	}
 	//handle NOT a POST request, render blank search template
 	if r.Method != http.MethodPost {
-		l = l.WithFields(log.Fields{"template": " blank */search.html"})
-
 		//fetch artists names
-		artistsList, err := allArtistNames()
-		check(err, "artistsList")
+		artistsList, err := allArtistNames(ctx)
+		if err != nil {
+			renderError(w, r, err)
+			return
+		}
 
 		//fetch dropdown for album titles
-		titlesList, err := allAlbumNames()
-		check(err, "titlesList")
+		titlesList, err := allAlbumNames(ctx)
+		if err != nil {
+			renderError(w, r, err)
+			return
+		}
 
 		//fetch pricelist //TODO
-		priceList, err := allAlbumPrices()
-		check(err, "priceList")
+		priceList, err := allAlbumPrices(ctx)
+		if err != nil {
+			renderError(w, r, err)
+			return
+		}
 
-		l.Info()
+		// genres and tags to narrow the search down with
+		genres, err := allGenres(ctx)
+		if err != nil {
+			renderError(w, r, err)
+			return
+		}
+		tags, err := tagCloud(ctx)
+		if err != nil {
+			renderError(w, r, err)
+			return
+		}
+		labels, err := allLabels(ctx)
+		if err != nil {
+			renderError(w, r, err)
+			return
+		}
 
 		// prepare page struct for form dropdowns ->title & artist
 		art := Page{
 			Titles: titlesList,
 			Names:  artistsList,
 			Price:  priceList,
+			Genres: genres,
+			Tags:   tags,
+			Labels: labels,
 		}
 
-		l = l.WithFields(log.Fields{"Action": "form data", "titles": len(art.Titles), "artists": len(art.Names)})
-		l.Info()
-
-		// parse blank search template
-		tmpl, err = template.ParseFiles("templates/search.html")
-		check(err, "parse search template")
-
 		//execute search template with dropdown data
-		tmpl.Execute(w, struct {
+		render(w, r, "search.html", struct {
 			Success bool
 			Body    Page
 		}{false, art})
 
-		l.Info()
+		l.WithFields(log.Fields{"titles": len(art.Titles), "artists": len(art.Names)}).Debug("rendered blank search form")
 		//return
 	} else {
 		// handle form with results
-		l = l.WithField("action", "search form results, search.html")
 
-		// get form input values
-		var price float32
-		var err error
-		priceValue := r.FormValue("price")
-		l.Info()
+		// the list buttons on each result post the search again, with list_action
+		var listMsg string
+		var listErr error
+		if action := r.FormValue("list_action"); action != "" {
+			switch {
+			case !can(ctx, PermListsOwn):
+				listErr = &Error{Kind: ErrForbidden, Op: "searchHandler", Msg: "Log in to keep lists."}
+			case action != "add" && action != "remove":
+				listErr = invalid("searchHandler", "Unknown list action %q.", action)
+			default:
+				listMsg, listErr = listChange(ctx, r, action)
+			}
+			if status, _ := errorStatus(listErr); listErr != nil && status >= http.StatusInternalServerError {
+				renderError(w, r, listErr)
+				return
+			}
+			if listErr != nil {
+				listMsg = errorMessage(listErr)
+				l.WithError(listErr).Warn("list change rejected")
+			}
+		}
 
-		// if priceValue input, format priceValue to float32
-		if priceValue != "" {
-			prc, err := strconv.ParseFloat(priceValue, 32)
-			check(err, "priceValue to float32")
-			price = float32(prc)
+		// get form input values
+		price, err := parsePrice("searchHandler", r.FormValue("price"))
+		if err != nil {
+			renderError(w, r, err)
+			return
 		}
-		l.Info()
 
 		// save all input form values in album struct
 		details := Album{
 			Title: r.FormValue("title"), Artist: r.FormValue("artist"), Price: price,
 		}
+		track := strings.TrimSpace(r.FormValue("track"))
+		filter, err := albumFilter("searchHandler", r.FormValue, displayCurrency(r))
+		if err != nil {
+			renderError(w, r, err)
+			return
+		}
+		l = l.WithFields(log.Fields{"title": details.Title, "artist": details.Artist, "price": details.Price, "track": track,
+			"genre": filter.Genre, "tag": filter.Tag, "label": filter.Label, "format": filter.Format, "year": filter.Year,
+			"min_rating": filter.MinRating, "sort": filter.Sort})
 
 		var albumResult []AlbumMap
-		//var albumResultMap []AlbumMap
-		// conditional data search results in albumResult slice: TODO: use switch statement
-		//if we have a price, we must have either artist or title data for search
-		if details.Price > 0.00 {
-			//else its price only search
-			l = l.WithFields(log.Fields{"where": "Price only search", "albumResult": albumResult})
-			albumResult, err = albumsByPrice(details.Price)
-			check(err, "in price only search")
-			l.Info()
-			//return
-
-		} else if details.Title != "" {
-			//TITLE ONLY
-			l = l.WithFields(log.Fields{"where": "Title only search", "albumResult": albumResult})
-			albumResult, err = albumsByTitle(details.Title)
-			check(err, "in title only search")
-			l.Info()
-			//return
-		} else if details.Artist != "" {
-			//ARTIST ONLY
-			l = l.WithFields(log.Fields{"where": "Artist only search", "albumResult": albumResult})
-			albumResult, err = albumsByArtist(details.Artist)
-			check(err, "in album only search")
-			l.Info()
-			//return
-		}
-
-		l.Info("albumResult: ", albumResult) //TODO: delete me
-
-		if len(albumResult) == 0 {
-			l.Warn("albumResult shouldnt be blank at this point. expect errors.")
+		filtered := false
+		// conditional data search results in albumResult slice
+		switch {
+		case !details.Price.IsZero():
+			albumResult, err = albumsByPrice(ctx, details.Price)
+		case details.Title != "":
+			albumResult, err = albumsByTitle(ctx, details.Title)
+		case details.Artist != "":
+			albumResult, err = albumsByArtist(ctx, details.Artist)
+		case track != "":
+			albumResult, err = albumsByTrack(ctx, track)
+		case filter.active():
+			albumResult, err = albumsByFilter(ctx, filter, 0)
+			filtered = true
+		default:
+			err = invalid("searchHandler", "Pick a title, an artist, a price, a genre, a tag, a label, a format or a year, give a price range or a lowest rating, or type part of a track title to search for.")
+		}
+		// a genre or tag narrows down any of the other searches
+		if err == nil && !filtered {
+			albumResult, err = filterAlbums(ctx, albumResult, filter)
+		}
+		if err == nil {
+			err = attachTrackStats(ctx, albumResult)
+		}
+		if err == nil {
+			err = attachGenresAndTags(ctx, albumResult)
+		}
+		if err == nil {
+			err = attachStock(ctx, albumResult)
+		}
+		if err == nil {
+			err = attachRatings(ctx, albumResult)
+		}
+		if err != nil {
+			renderError(w, r, err)
+			return
 		}
+
+		sortAlbums(albumResult, filter.Sort)
+
 		// put page data in page struct, in slices
 		pageInfo := Page{
 			Titles: []string{details.Title},
 			Names:  []string{details.Artist},
-			Price:  []float32{details.Price},
+			Price:  []Money{details.Price},
 			Body:   albumResult,
+			Track:  track,
+			Filter: filter,
 		}
 
-		tmpl, err := template.ParseFiles("templates/search.html")
+		lists, listed, err := searchLists(ctx, albumResult)
 		if err != nil {
-			l.Fatalf("tmpl Template parse error %v", err)
+			renderError(w, r, err)
+			return
+		}
+		query := url.Values{}
+		for _, name := range searchFields {
+			if v := r.PostFormValue(name); v != "" {
+				query.Set(name, v)
+			}
 		}
+
 		// execute template with search results
-		tmpl.Execute(w, struct {
+		render(w, r, "search.html", struct {
 			Success bool
 			Body    Page
 			AlbMap  []AlbumMap
-		}{true, pageInfo, albumResult})
+			Message string
+			ListOK  bool
+			Lists   []List
+			Listed  map[int64]map[int64]bool
+			Query   url.Values
+		}{true, pageInfo, albumResult, listMsg, listErr == nil, lists, listed, query})
 
-		l.Info("Parsed & exec search results. ")
+		l.WithField("count", len(albumResult)).Debug("rendered search results")
 	}
 
 }
 
-// editHandler
+// editHandler - GET ?id= shows the edit form for an album, POST saves it
 func editHandler(w http.ResponseWriter, r *http.Request) {
-	l := log.WithFields(log.Fields{"In": "editHandler()"})
-	l.Info()
+	ctx := r.Context()
+	l := logFrom(ctx).WithField("func", "editHandler")
 
 	// vars from search results/edit input
-	editid, _ := strconv.Atoi(r.FormValue("id"))
-	id := int64(editid)
-
-	editPrice, _ := strconv.ParseFloat(r.FormValue("price"), 32)
-	price := float32(editPrice)
-
-	details := Album{
-		id, r.FormValue("title"), r.FormValue("artist"), price,
+	var id int64
+	if idStr := r.FormValue("id"); idStr != "" {
+		editid, err := strconv.ParseInt(idStr, 10, 64)
+		if err != nil {
+			renderError(w, r, invalid("editHandler", "%q is not a valid album id.", idStr))
+			return
+		}
+		id = editid
 	}
 
-	l = l.WithFields(log.Fields{"title": details.Title, "id": id, "artist": details.Artist, "price": details.Price})
-	//parse template
-	tmpl, err := template.ParseFiles("templates/edit.html")
+	genres, err := allGenres(ctx)
 	if err != nil {
-		l.Fatalf("edit template errors %v", err)
+		renderError(w, r, err)
+		return
+	}
+	labels, err := allLabels(ctx)
+	if err != nil {
+		renderError(w, r, err)
+		return
 	}
-	l.Info("Template parsed")
 
-	// if details has data, exec template
-	if details.Title != "" || details.Artist != "" || details.Price > 0.0 {
-		l.Infof("Show details %v: ", details)
+	// GET: show the form, filled in when we know which album
+	if r.Method != http.MethodPost {
+		var alb Album
+		if id != 0 {
+			var err error
+			if alb, err = albumByID(ctx, id); err != nil {
+				renderError(w, r, err)
+				return
+			}
+		}
+		render(w, r, "edit.html", editPage{Message: editMessage(alb), Album: alb, Form: formFromAlbum(alb), Genres: genres, Labels: labels})
+		l.WithField("album_id", id).Debug("rendered edit form")
+		return
+	}
+
+	details, form, err := albumFromForm("editHandler", r)
+	details.ID = id
+	if err == nil {
+		l = l.WithFields(log.Fields{"album_id": id, "title": details.Title, "artist": details.Artist, "price": details.Price})
 		// run db process here to update table.
-		resp, count, err := updateAlbum(details)
-		if err != nil {
-			l.Fatalf("%v ", err)
+		var count int64
+		if details, count, err = updateAlbum(ctx, details); err == nil && (form.upload != nil || form.RemoveCover) {
+			_, err = setCover(ctx, id, form.upload)
 		}
-		res, _ := json.Marshal(resp)
-		l.Info("result marshalled to json %v")
-		// execute template
-		tmpl.Execute(w, struct {
-			Success bool
-			Message string
-			Count   int64
-		}{true, fmt.Sprintf("Success updating %v", string(res)), count})
-	} else {
-		l.Infof("when no details: %v", details)
-		// edit page when nothing to edit
-		tmpl.Execute(w, struct {
-			Success bool
-			Message string
-		}{false, "Nothing to edit. Try something else!"})
+		if err == nil {
+			res, _ := json.Marshal(details)
+			render(w, r, "edit.html", editPage{Success: true, Message: fmt.Sprintf("Success updating %v", string(res)), Count: count})
+			l.WithField("count", count).Info("updated album")
+			return
+		}
+	}
+	if fieldErrors(err) == nil {
+		renderError(w, r, err)
+		return
 	}
+	// show the form again with what was typed and what is wrong with it; an image has to be chosen again
+	form.Errors = fieldErrors(err)
+	if alb, err := albumByID(ctx, id); err == nil {
+		form.Cover = alb.Cover
+	}
+	renderStatus(w, r, http.StatusBadRequest, "edit.html", editPage{Message: fmt.Sprintf("album %d", id), Error: errorMessage(err), Album: Album{ID: id}, Form: form, Genres: genres, Labels: labels})
+	l.WithError(err).Debug("edit form rejected")
 }
 
-// addHandler - handler for add action
-func addHandler(w http.ResponseWriter, r *http.Request) {
-	var price float32
-	var err error
-	l := log.WithFields(log.Fields{"In": "Add Handler", "Action": "Parse Template"})
+// editPage is the data for edit.html
+type editPage struct {
+	Success bool
+	Message string
+	Error   string
+	Count   int64
+	Album   Album
+	Form    AlbumForm
+	Genres  []Genre
+	Labels  []string
+}
 
-	//parse template
-	tmpl, err := template.ParseFiles("templates/add.html")
-	if err != nil {
-		l.Fatalf("Add album Handler ParseFiles Error: %v", err)
+// editMessage describes what the edit form is editing
+func editMessage(alb Album) string {
+	if alb.ID == 0 {
+		return "Nothing to edit. Try something else!"
 	}
+	return fmt.Sprintf("%v by %v", alb.Title, alb.Artist)
+}
+
+// albumPagePermissions: anyone who can read albums sees the album page, changing its tracks needs album:edit
+var albumPagePermissions = map[string]Permission{
+	http.MethodGet:  PermAlbumRead,
+	http.MethodHead: PermAlbumRead,
+	http.MethodPost: PermAlbumEdit,
+}
+
+// albumPage is the data for album.html. OwnReview is the logged in user's review among Reviews, if they wrote one.
+type albumPage struct {
+	Album      Album
+	Stats      TrackStats
+	Movements  []StockMovement
+	Reviews    []Review
+	OwnReview  *Review
+	Success    bool
+	Message    string
+	Form       TrackForm
+	StockForm  StockForm
+	ReviewForm ReviewForm
+}
+
+// TrackForm is the add track form as the user typed it, with any error per field
+type TrackForm struct {
+	Disc     string
+	Number   string
+	Title    string
+	Duration string
+	Artist   string
+	Errors   map[string]string
+}
 
-	//fetch vars
-	priceStr := r.FormValue("price")
-	// if price is passed, round price 2 decimal places
-	if priceStr != "" {
-		// convert string to float64
-		priceValue, err := strconv.ParseFloat(priceStr, 32)
+// StockForm is the stock movement form as the user typed it, with any error per field
+type StockForm struct {
+	Kind     string
+	Quantity string
+	Note     string
+	Errors   map[string]string
+}
+
+// albumHandler - GET ?id= shows an album with its credits, tracks and stock; POST adds, updates or deletes
+// one of its tracks, records a stock movement or sets its low-stock threshold
+func albumHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	l := logFrom(ctx).WithField("func", "albumHandler")
+	id, err := strconv.ParseInt(r.FormValue("id"), 10, 64)
+	if err != nil {
+		renderError(w, r, notFound("albumHandler", "There is no album %q.", r.FormValue("id")))
+		return
+	}
+	page := albumPage{}
+
+	if r.Method == http.MethodPost {
+		action := r.FormValue("action")
+		l = l.WithFields(log.Fields{"album_id": id, "action": action})
+		var t Track
+		var m StockMovement
+		switch action {
+		case "add_track":
+			t, err = trackFromForm(r)
+			page.Form = TrackForm{Disc: r.FormValue("disc"), Number: r.FormValue("number"), Title: r.FormValue("title"),
+				Duration: r.FormValue("duration"), Artist: r.FormValue("artist")}
+		case "update_track", "delete_track":
+			// updates and deletes name a track, which has to be on this album
+			var trackID int64
+			if trackID, err = strconv.ParseInt(r.FormValue("track_id"), 10, 64); err == nil {
+				if t, err = trackByID(ctx, trackID); err == nil && t.AlbumID != id {
+					err = notFound("albumHandler", "Album %d has no track %d.", id, trackID)
+				}
+			} else {
+				err = notFound("albumHandler", "There is no track %q.", r.FormValue("track_id"))
+			}
+			if err == nil && action == "update_track" {
+				t, err = trackFromForm(r)
+				t.ID = trackID
+			}
+		case "stock_move":
+			page.StockForm = StockForm{Kind: r.FormValue("kind"), Quantity: strings.TrimSpace(r.FormValue("quantity")), Note: r.FormValue("note")}
+			m = StockMovement{AlbumID: id, Kind: MovementKind(page.StockForm.Kind), Note: page.StockForm.Note}
+			if m.Quantity, err = strconv.Atoi(page.StockForm.Quantity); err != nil {
+				err = invalidFields("albumHandler", map[string]string{"quantity": fmt.Sprintf("%q is not a number.", page.StockForm.Quantity)})
+			}
+		}
+		if err == nil {
+			switch action {
+			case "add_track":
+				t.AlbumID = id
+				if t, err = saveTrack(ctx, t); err == nil {
+					page.Message = fmt.Sprintf("Added track %d, %s.", t.Number, t.Title)
+					page.Form = TrackForm{}
+				}
+			case "update_track":
+				if t, err = saveTrack(ctx, t); err == nil {
+					page.Message = fmt.Sprintf("Saved track %d, %s.", t.Number, t.Title)
+				}
+			case "delete_track":
+				if _, err = deleteTrack(ctx, t.ID); err == nil {
+					page.Message = fmt.Sprintf("Deleted track %d, %s.", t.Number, t.Title)
+				}
+			case "stock_move":
+				if m, err = recordMovement(ctx, m); err == nil {
+					page.Message = fmt.Sprintf("Recorded %s %+d, %d in stock now.", m.Kind, m.Quantity, m.Balance)
+					page.StockForm = StockForm{}
+				}
+			case "stock_threshold":
+				var threshold sql.NullInt64
+				if threshold, err = parseThreshold("albumHandler", r.FormValue("threshold")); err == nil {
+					if err = setStockThreshold(ctx, id, threshold); err == nil {
+						page.Message = fmt.Sprintf("Low stock is now at or below %d.", appCfg.LowStockThreshold)
+						if threshold.Valid {
+							page.Message = fmt.Sprintf("Low stock is now at or below %d.", threshold.Int64)
+						}
+					}
+				}
+			default:
+				err = invalid("albumHandler", "Unknown action %q.", action)
+			}
+		}
+		if status, _ := errorStatus(err); err != nil && status >= http.StatusInternalServerError {
+			renderError(w, r, err)
+			return
+		}
+		page.Success = err == nil
 		if err != nil {
-			l.WithFields(log.Fields{"value": priceValue, "error": err})
-			l.Warnf("In strconv.ParseFloat error %v: ", err)
-			l.Fatal(err)
+			page.Message = errorMessage(err)
+			switch fields := fieldErrors(err); {
+			case action == "add_track":
+				page.Form.Errors = fields
+			case action == "stock_move":
+				page.StockForm.Errors = fields
+			case len(fields) > 0:
+				page.Message = fieldMessages(fields)
+			}
+			l.WithError(err).Warn("album page change rejected")
+		} else {
+			l.WithFields(log.Fields{"track_id": t.ID, "movement_id": m.ID}).Info("changed album")
 		}
-		// format 2 Decimal places
-		priceValue = math.Round(100*priceValue) / 100
-		// format to float32
-		price = float32(priceValue)
-		l = l.WithFields(log.Fields{"price": price})
-		l.Info()
 	}
 
-	//put artist, title and price values in struct
-	details := Album{
-		Title:  r.FormValue("title"),
-		Artist: r.FormValue("artist"),
-		Price:  price,
-	}
+	renderAlbumPage(w, r, id, page)
+}
 
-	//execute conditions 1: if inputs blank(fresh start), render blank template
-	if details.Title == "" && details.Artist == "" && details.Price == 0.00 {
-		l = l.WithFields(log.Fields{"Action": "Render Add Album Template"})
-		l.Info("Render new add album template.")
-		tmpl.Execute(w, nil)
-	} else {
-		//execute condition 2. execute sql and return success msg to client
-		id, err := addAlbum(details)
-		if err != nil {
-			l.Fatalf("Sorry, can't let you add this album because of some error: %v", err)
+// renderAlbumPage shows album id with its tracks, recent stock movements and reviews, under
+// the outcome and forms already in page
+func renderAlbumPage(w http.ResponseWriter, r *http.Request, id int64, page albumPage) {
+	ctx := r.Context()
+	alb, err := albumByID(ctx, id)
+	if err != nil {
+		renderError(w, r, err)
+		return
+	}
+	page.Album, page.Stats = alb, statsOf(alb.Tracks)
+	if page.Movements, err = stockMovements(ctx, id, 20); err != nil {
+		renderError(w, r, err)
+		return
+	}
+	if page.Reviews, err = albumReviews(ctx, id); err != nil {
+		renderError(w, r, err)
+		return
+	}
+	for _, rv := range page.Reviews {
+		if ownReview(ctx, rv) {
+			own := rv
+			page.OwnReview = &own
 		}
-		l = l.WithFields(log.Fields{"Current Action": "Add Album"})
-		l.Infof("Successfully added new album %v by %v $%v (id# %v)", details.Title, details.Artist, details.Price, id)
-		tmpl.Execute(w, struct {
-			Success bool
-			Body    string
-		}{true, fmt.Sprintf("%v by %v $%v", details.Title, details.Artist, details.Price)})
 	}
+	// the form starts out with the user's review, unless it is coming back with errors
+	if page.ReviewForm.Errors == nil && page.OwnReview != nil {
+		page.ReviewForm = ReviewForm{Rating: strconv.Itoa(page.OwnReview.Rating), Text: page.OwnReview.Text}
+	}
+	render(w, r, "album.html", page)
 }
 
-// deleteHandler - handler for delete action
-func deleteHandler(w http.ResponseWriter, r *http.Request) {
-	// var price float32
-	var err error
-	l := log.WithFields(log.Fields{"In": "Delete Handler", "Action": "Parse Template"})
+// fieldMessages joins per-field messages into one line, in field name order
+func fieldMessages(fields map[string]string) string {
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	msgs := make([]string, len(names))
+	for i, name := range names {
+		msgs[i] = fields[name]
+	}
+	return strings.Join(msgs, " ")
+}
 
-	//parse template
-	tmpl, err := template.ParseFiles("templates/delete.html")
+// addPage is the data for add.html; Genres are the choices for the genre list, Labels the label suggestions
+type addPage struct {
+	Success bool
+	Body    string
+	Message string
+	Form    AlbumForm
+	Genres  []Genre
+	Labels  []string
+}
+
+// addHandler - handler for add action
+func addHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	l := logFrom(ctx).WithField("func", "addHandler")
+
+	genres, err := allGenres(ctx)
+	if err != nil {
+		renderError(w, r, err)
+		return
+	}
+	labels, err := allLabels(ctx)
 	if err != nil {
-		l.Fatalf("Delete album Handler ParseFiles Error: %v", err)
+		renderError(w, r, err)
+		return
 	}
 
-	//put artist, title and price values in struct
-	details := Album{
-		Title:  r.FormValue("title"),
-		Artist: r.FormValue("artist"),
-		// Price:  price,
+	//execute conditions 1: a GET (fresh start) renders the blank form
+	if r.Method != http.MethodPost {
+		render(w, r, "add.html", addPage{Genres: genres, Labels: labels})
+		l.Debug("rendered blank add form")
+		return
 	}
 
-	//execute conditions 1: if inputs blank(fresh start), render blank template
-	if details.Title == "" && details.Artist == "" {
-		l = l.WithFields(log.Fields{"Action": "Render Delete Album Template"})
-		l.Info("Render delete album template.")
-		tmpl.Execute(w, nil)
-	} else {
-		//execute condition 2. execute sql and return success msg to client
-		id, err := deleteAlbum(details)
+	//execute condition 2. validate, execute sql and return success msg to client
+	details, form, err := albumFromForm("addHandler", r)
+	if err == nil {
+		l = l.WithFields(log.Fields{"title": details.Title, "artist": details.Artist, "price": details.Price})
+		var id int64
+		if id, err = addAlbum(ctx, details); err == nil && form.upload != nil {
+			_, err = setCover(ctx, id, form.upload)
+		}
+		if err == nil {
+			render(w, r, "add.html", addPage{Success: true, Body: fmt.Sprintf("%v by %v %s", details.Title, details.Artist, details.Price)})
+			l.WithField("album_id", id).Info("added album")
+			return
+		}
+	}
+	if fieldErrors(err) == nil {
+		renderError(w, r, err)
+		return
+	}
+	form.Errors = fieldErrors(err)
+	renderStatus(w, r, http.StatusBadRequest, "add.html", addPage{Message: errorMessage(err), Form: form, Genres: genres, Labels: labels})
+	l.WithError(err).Debug("add form rejected")
+}
+
+// deleteHandler - handler for delete action
+func deleteHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	l := logFrom(ctx).WithField("func", "deleteHandler")
+
+	//execute condition 1: a GET (fresh start) renders the form with the title and artist lists
+	if r.Method != http.MethodPost {
+		titles, err := allAlbumNames(ctx)
 		if err != nil {
-			l.Fatalf("Sorry, can't let you delete this album because: %v", err)
+			renderError(w, r, err)
+			return
 		}
+		artists, err := allArtistNames(ctx)
+		if err != nil {
+			renderError(w, r, err)
+			return
+		}
+		render(w, r, "delete.html", struct {
+			Success bool
+			Titles  []string
+			Artists []string
+		}{false, titles, artists})
+		l.Debug("rendered blank delete form")
+		return
+	}
 
-		var msg string
-		l = l.WithFields(log.Fields{"Current Action": "Delete Album"})
-		if id == 0 {
-			l.Warnf("This album doesnt exist! %v by %v", details.Title, details.Artist)
-			msg = fmt.Sprintf("This album doesnt exist! %v by %v", details.Title, details.Artist)
-		} else {
-			msg = fmt.Sprintf("Successful deletion of album! %v by %v", details.Title, details.Artist)
-			l.Infof("Successfully deleted album %v by %v (id# %v)", details.Title, details.Artist, id)
+	//execute condition 2: the delete button on a search result posts the album id
+	if idStr := r.FormValue("id"); idStr != "" {
+		id, err := strconv.ParseInt(idStr, 10, 64)
+		if err != nil {
+			renderError(w, r, invalid("deleteHandler", "%q is not an album id.", idStr))
+			return
 		}
-		tmpl.Execute(w, struct {
+		if err := deleteAlbumByID(ctx, id); err != nil {
+			renderError(w, r, err)
+			return
+		}
+		render(w, r, "delete.html", struct {
 			Success bool
 			Body    string
-		}{true, msg})
+		}{true, fmt.Sprintf("Successful deletion of album %d!", id)})
+		l.WithField("album_id", id).Info("deleted album")
+		return
+	}
+
+	//execute condition 3: delete by title and artist and return success msg to client
+	details := Album{
+		Title:  r.FormValue("title"),
+		Artist: r.FormValue("artist"),
 	}
+	if details.Title == "" || details.Artist == "" {
+		renderError(w, r, invalid("deleteHandler", "Pick both a title and an artist to delete."))
+		return
+	}
+	l = l.WithFields(log.Fields{"title": details.Title, "artist": details.Artist})
+	count, err := deleteAlbum(ctx, details)
+	if err != nil {
+		renderError(w, r, err)
+		return
+	}
+	render(w, r, "delete.html", struct {
+		Success bool
+		Body    string
+	}{true, fmt.Sprintf("Successful deletion of album! %v by %v", details.Title, details.Artist)})
+	l.WithField("count", count).Info("deleted album")
 }
 
-// allArtistNames - helper func to get names of all artists in album table
-func allArtistNames() ([]string, error) {
+// allArtistNames - helper func to get names of all artists credited on an album
+func allArtistNames(ctx context.Context) ([]string, error) {
 	// res us a slice to hold artist names returned
 	var res []string
-	l := log.WithFields(log.Fields{"IN": "allArtistNames()"})
+	l := logFrom(ctx).WithField("func", "allArtistNames")
 
 	// db query - distinct, no overlap
-	rows, err := db.Query("SELECT DISTINCT artist from album;")
+	rows, err := readDB(ctx).QueryContext(ctx, `SELECT name FROM artists WHERE EXISTS (SELECT 1 FROM album_artists WHERE artist_id = artists.id)
+		OR EXISTS (SELECT 1 FROM tracks WHERE artist_id = artists.id);`)
 	if err != nil {
-		return nil, fmt.Errorf("allArtistNames: %v", err)
+		return nil, dbError("allArtistNames", err)
 	}
 
 	defer rows.Close()
@@ -556,33 +1027,32 @@ func allArtistNames() ([]string, error) {
 	//if data in rows exists
 	for rows.Next() {
 		if err := rows.Scan(&alb); err != nil {
-			return nil, fmt.Errorf("In allArtistNames: %v", err)
+			return nil, dbError("allArtistNames", err)
 		}
-		res = append(res, fmt.Sprintf(alb))
+		res = append(res, alb)
 	}
 	// if error in rows ie rows.Err()
 	if err := rows.Err(); err != nil {
-		return nil, fmt.Errorf("allArtistNames: %v", err)
+		return nil, dbError("allArtistNames", err)
 	}
 	//need to sort res and all the Db dropdown lists
 	sort.Slice(res, func(i, j int) bool {
 		return res[i] < res[j]
 	})
 
-	l = l.WithFields(log.Fields{"Result": fmt.Sprintf("%v count", len(res))})
-	l.Info()
+	l.WithField("count", len(res)).Debug("fetched artist names")
 	return res, nil
 }
 
 // albumNames
-func allAlbumNames() ([]string, error) {
+func allAlbumNames(ctx context.Context) ([]string, error) {
 	var res []string
-	l := log.WithFields(log.Fields{"IN": "allAlbumNames()"})
+	l := logFrom(ctx).WithField("func", "allAlbumNames")
 	// db query - distinct, no overlap
 	cmd := "SELECT DISTINCT title from album ORDER BY 1;"
-	rows, err := db.Query(cmd)
+	rows, err := readDB(ctx).QueryContext(ctx, cmd)
 	if err != nil {
-		return nil, fmt.Errorf("allAlbumNames: %v", err)
+		return nil, dbError("allAlbumNames", err)
 	}
 
 	defer rows.Close()
@@ -591,177 +1061,243 @@ func allAlbumNames() ([]string, error) {
 	//if data in rows exists
 	for rows.Next() {
 		if err := rows.Scan(&alb); err != nil {
-			return nil, fmt.Errorf("In allAlbumNames: %v", err)
+			return nil, dbError("allAlbumNames", err)
 		}
-		res = append(res, fmt.Sprintf(alb))
+		res = append(res, alb)
 	}
 	// if error in rows ie rows.Err()
 	if err := rows.Err(); err != nil {
-		return nil, fmt.Errorf("allAlbumNames: %v", err)
+		return nil, dbError("allAlbumNames", err)
 	}
 	//need to sort res and all the Db dropdown lists
 	sort.Slice(res, func(i, j int) bool {
 		return res[i] < res[j]
 	})
 
-	l = l.WithFields(log.Fields{"Result": fmt.Sprintf("%v count", len(res))})
-	l.Info()
+	l.WithField("count", len(res)).Debug("fetched album names")
 	return res, nil
 }
 
 // allAlbumPrices - returns album price List
-func allAlbumPrices() ([]float32, error) {
-	var res []float32
-	l := log.WithFields(log.Fields{"IN": "allAlbumPrices()"})
+func allAlbumPrices(ctx context.Context) ([]Money, error) {
+	var res []Money
+	l := logFrom(ctx).WithField("func", "allAlbumPrices")
 
 	// db query
-	cmd := "SELECT DISTINCT price from album ORDER BY 1;" //ASC
-	rows, err := db.Query(cmd)
+	cmd := "SELECT DISTINCT price, currency from album ORDER BY 2, 1;" //ASC
+	rows, err := readDB(ctx).QueryContext(ctx, cmd)
 	if err != nil {
-		return nil, fmt.Errorf("allAlbumPrices: %v", err)
+		return nil, dbError("allAlbumPrices", err)
 	}
 
 	defer rows.Close()
-	var alb float32 // temp string to store prices
+	var alb Money // temp string to store prices
 	//if data in rows exists
 	for rows.Next() {
-		if err := rows.Scan(&alb); err != nil {
-			return nil, fmt.Errorf("In allAlbumPrices: %v", err)
+		if err := rows.Scan(&alb, &alb.Currency); err != nil {
+			return nil, dbError("allAlbumPrices", err)
 		}
 		res = append(res, alb)
 	}
 	// if error in rows ie rows.Err()
 	if err := rows.Err(); err != nil {
-		return nil, fmt.Errorf("allAlbumPrices: %v", err)
+		return nil, dbError("allAlbumPrices", err)
 	}
 
-	l = l.WithFields(log.Fields{"Price max": res[(len(res) - 1)]})
-	l.Info()
+	l.WithField("count", len(res)).Debug("fetched album prices")
 	return res, nil
 }
 
 // testHandler
 func testHandler(w http.ResponseWriter, r *http.Request) {
-	l := log.WithFields(log.Fields{"In": "testHandler()"})
-	tmpl, err := template.ParseFiles("templates/test.html")
-	if err != nil {
-		l.Fatalf("test template errors %v", err)
-	}
 	//fictional prices
-	prices := []float32{1.50, 2.50, 3.50, 4.50}
+	base := appCfg.BaseCurrency
+	prices := []Money{{150, base}, {250, base}, {350, base}, {450, base}}
 	priceValue := r.FormValue("price")
 
-	//priceValue to []float32
+	//priceValue to []Money
 	if priceValue != "" {
-		testp := []float32{200.00}
-		tmpl.Execute(w, struct {
+		testp := []Money{{20000, base}}
+		render(w, r, "test.html", struct {
 			Success   bool
 			Message   string
-			Submitted []float32
-		}{true, "Success $", testp})
+			Submitted []Money
+		}{true, "Success ", testp})
 	} else {
-		tmpl.Execute(w, struct {
+		render(w, r, "test.html", struct {
 			Success bool
-			Prices  []float32
+			Prices  []Money
 		}{false, prices})
 	}
 }
 
-// dumpHandler
+// dumpHandler - the first 50 albums, narrowed to ?genre=, ?tag=, ?label=, ?format=, ?year= and ?min_rating=
+// when given and in ?sort= order
 func dumpHandler(w http.ResponseWriter, r *http.Request) {
-	l := log.WithFields(log.Fields{"in": "dumpHandler()"})
-
+	ctx := r.Context()
+	filter, err := albumFilter("dumpHandler", r.FormValue, displayCurrency(r))
+	if err != nil {
+		renderError(w, r, err)
+		return
+	}
 	//fetch data
-	data, err := dataDump()
+	var data []AlbumMap
+	if filter.active() || filter.Sort != "" {
+		data, err = albumsByFilter(ctx, filter, 50)
+	} else {
+		data, err = dataDump(ctx)
+	}
+	if err == nil {
+		err = attachGenresAndTags(ctx, data)
+	}
+	if err == nil {
+		err = attachStock(ctx, data)
+	}
+	if err == nil {
+		err = attachRatings(ctx, data)
+	}
+	if err != nil {
+		renderError(w, r, err)
+		return
+	}
+	genres, err := allGenres(ctx)
+	if err != nil {
+		renderError(w, r, err)
+		return
+	}
+	tags, err := tagCloud(ctx)
+	if err != nil {
+		renderError(w, r, err)
+		return
+	}
+	labels, err := allLabels(ctx)
 	if err != nil {
-		l.Errorf("dumpHandler: %v", err)
+		renderError(w, r, err)
+		return
 	}
 	details := Page{
-		Body: data,
+		Body:   data,
+		Genres: genres,
+		Tags:   tags,
+		Labels: labels,
+		Filter: filter,
 	}
-	tmpl, _ := template.ParseFiles("templates/dump.html")
-	l.Info()
-	tmpl.Execute(w, details)
+	render(w, r, "dump.html", details)
 }
 
 // dataDump
-func dataDump() ([]AlbumMap, error) {
+func dataDump(ctx context.Context) ([]AlbumMap, error) {
 	//similar to album Name Search
 	var albums []AlbumMap
 
-	l := log.WithFields(log.Fields{"Result": "dataDump()"})
+	l := logFrom(ctx).WithField("func", "dataDump")
 
-	rows, err := db.Query("SELECT * FROM album ORDER by title LIMIT 50;")
+	rows, err := readDB(ctx).QueryContext(ctx, "SELECT "+albumColumns+" FROM album a ORDER by a.title LIMIT 50;")
 	if err != nil {
-		return nil, fmt.Errorf("dataDump(): %v", err)
+		return nil, dbError("dataDump", err)
 	}
 	defer rows.Close()
 	// Loop through rows, using Scan to assign column data to struct fields.
 	for rows.Next() {
 		var alb AlbumMap
-		if err := rows.Scan(&alb.ID, &alb.Title, &alb.Artist, &alb.Price); err != nil {
-			return nil, fmt.Errorf("dataDump(): %v", err)
+		if err := rows.Scan(alb.scanFields()...); err != nil {
+			return nil, dbError("dataDump", err)
 		}
 		albums = append(albums, alb)
 	}
 	if err := rows.Err(); err != nil {
-		return nil, fmt.Errorf("dataDump(): %v", err)
+		return nil, dbError("dataDump", err)
 	}
-	l = l.WithFields(log.Fields{"Albums": len(albums)})
-	l.Info()
+	l.WithField("count", len(albums)).Debug("fetched data dump")
 	return albums, nil
 
 }
 
-// generic query
-func genericQuery(cmd string) ([]AlbumMap, error) {
-	l := log.WithFields(log.Fields{"In": "genericQuery()"})
+// allAlbums returns every album ordered by id, for exports
+func allAlbums(ctx context.Context) ([]AlbumMap, error) {
 	var albums []AlbumMap
 
-	rows, err := db.Query(cmd)
+	rows, err := readDB(ctx).QueryContext(ctx, "SELECT "+albumColumns+" FROM album a ORDER BY a.id;")
 	if err != nil {
-		return nil, fmt.Errorf("genericQuery(): %v", err)
+		return nil, dbError("allAlbums", err)
 	}
 	defer rows.Close()
 	// Loop through rows, using Scan to assign column data to struct fields.
 	for rows.Next() {
 		var alb AlbumMap
-		if err := rows.Scan(&alb.ID, &alb.Title, &alb.Artist, &alb.Price); err != nil {
-			return nil, fmt.Errorf("genericQuery(): %v", err)
+		if err := rows.Scan(alb.scanFields()...); err != nil {
+			return nil, dbError("allAlbums", err)
 		}
 		albums = append(albums, alb)
 	}
 	if err := rows.Err(); err != nil {
-		return nil, fmt.Errorf("genericQuery(): %v", err)
+		return nil, dbError("allAlbums", err)
 	}
-	l = l.WithFields(log.Fields{"results": len(albums)})
-	l.Info()
+	if err := attachCredits(ctx, albums); err != nil {
+		return nil, err
+	}
+	if err := attachTrackStats(ctx, albums); err != nil {
+		return nil, err
+	}
+	if err := attachGenresAndTags(ctx, albums); err != nil {
+		return nil, err
+	}
+	logFrom(ctx).WithFields(log.Fields{"func": "allAlbums", "count": len(albums)}).Debug("fetched all albums")
 	return albums, nil
 }
 
 // updateAlbum edits specified album
 // preconditions: editable album struct passed
 // postconditions: updated album & updated row count have been returned
-func updateAlbum(alb Album) (Album, int64, error) {
-	l := log.WithFields(log.Fields{"In": "updateAlbum()", "id editing": alb.ID, "by": alb.Artist})
-	l.Infof("ID:%v, Title:%v, Artist:%v, Price:$%v ", alb.ID, alb.Title, alb.Artist, alb.Price)
-	if alb.Title == "" || alb.Artist == "" {
-		l.Fatal("Artist/title fields required to edit record. %v")
+func updateAlbum(ctx context.Context, alb Album) (Album, int64, error) {
+	l := logFrom(ctx).WithFields(log.Fields{"func": "updateAlbum", "album_id": alb.ID})
+	alb, err := validateAlbum("updateAlbum", alb)
+	if err != nil {
+		return Album{}, 0, err
 	}
-	//title case
-	alb.Title = strings.Title(strings.ToLower(alb.Title))
-	alb.Artist = strings.Title(strings.ToLower(alb.Artist))
 
 	//DB exec
-	result, err := db.Exec("UPDATE album SET title=?,artist=?, price=? WHERE ID=?;", alb.Title, alb.Artist, alb.Price, alb.ID)
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return Album{}, 0, dbError("updateAlbum", err)
+	}
+	defer tx.Rollback()
+
+	if alb.Credits, err = resolveArtists(ctx, tx, alb.Credits); err != nil {
+		return Album{}, 0, err
+	}
+	alb.Artist = creditLine(alb.Credits)
+	args := append(append([]interface{}{alb.Title, alb.Artist, alb.Price, alb.Price.Currency}, detailArgs(alb)...), alb.ID)
+	result, err := tx.ExecContext(ctx, "UPDATE album SET title=?,artist=?, price=?, currency=?, release_date=?, label=?, format=?, catalog_number=?, notes=? WHERE ID=?;", args...)
 	if err != nil {
-		return Album{}, 0, fmt.Errorf("editAlbum: %v", err)
+		return Album{}, 0, catalogConflict("updateAlbum", alb, err)
 	}
 	// rows returns the number of rows affected by an update
 	rows, err := result.RowsAffected()
 	if err != nil {
-		return Album{}, 0, fmt.Errorf("editAlbum: %v", err)
+		return Album{}, 0, dbError("updateAlbum", err)
+	}
+	// MySQL counts unchanged rows as unaffected, so check the album is really missing
+	if rows == 0 {
+		var exists int
+		if err := tx.QueryRowContext(ctx, "SELECT 1 FROM album WHERE id = ?;", alb.ID).Scan(&exists); err == sql.ErrNoRows {
+			return Album{}, 0, notFound("updateAlbum", "There is no album with id %d.", alb.ID)
+		} else if err != nil {
+			return Album{}, 0, dbError("updateAlbum", err)
+		}
+	}
+	if err := saveCredits(ctx, tx, alb.ID, alb.Credits); err != nil {
+		return Album{}, 0, err
+	}
+	if alb.Genres, alb.Tags, err = saveGenresAndTags(ctx, tx, alb.ID, alb.Genres, alb.Tags); err != nil {
+		return Album{}, 0, err
+	}
+	if err := recordChange(ctx, tx, alb.ID, "update"); err != nil {
+		return Album{}, 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return Album{}, 0, dbError("updateAlbum", err)
 	}
-	l.Infof("%v row(s) updated. View Record: %v ", rows, alb)
+	l.WithFields(log.Fields{"title": alb.Title, "artist": alb.Artist, "price": alb.Price, "count": rows}).Debug("updated album")
 	return alb, rows, nil
 }
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// CreditRole is what an artist did on an album
+type CreditRole string
+
+const (
+	CreditPrimary  CreditRole = "primary"  // the album is theirs; shown in the credit
+	CreditFeatured CreditRole = "featured" // guests, shown after "feat."
+	CreditComposer CreditRole = "composer" // wrote the music; not shown in the credit
+)
+
+// creditRoles lists the roles in the order the forms offer them
+var creditRoles = []CreditRole{CreditPrimary, CreditFeatured, CreditComposer}
+
+// maxCredits is the most artists one album can credit
+const maxCredits = 20
+
+// Credit is an artist credited on an album
+type Credit struct {
+	ArtistID int64      `json:"id,omitempty"`
+	Name     string     `json:"name"`
+	Role     CreditRole `json:"role"`
+}
+
+// Artist is a row of the artists table and how many albums credit it
+type Artist struct {
+	ID     int64
+	Name   string
+	Albums int
+}
+
+// validCreditRole reports whether r is one of the credit roles
+func validCreditRole(r CreditRole) bool {
+	for _, have := range creditRoles {
+		if have == r {
+			return true
+		}
+	}
+	return false
+}
+
+// creditLine is the display credit stored in album.artist: the primary artists joined
+// with "&", then any featured artists after "feat."
+func creditLine(credits []Credit) string {
+	var primary, featured []string
+	for _, c := range credits {
+		switch c.Role {
+		case CreditPrimary:
+			primary = append(primary, c.Name)
+		case CreditFeatured:
+			featured = append(featured, c.Name)
+		}
+	}
+	line := joinNames(primary)
+	if len(featured) > 0 {
+		line += " feat. " + joinNames(featured)
+	}
+	return line
+}
+
+// joinNames joins names as "A", "A & B" or "A, B & C"
+func joinNames(names []string) string {
+	if len(names) < 2 {
+		return strings.Join(names, "")
+	}
+	return strings.Join(names[:len(names)-1], ", ") + " & " + names[len(names)-1]
+}
+
+// normalizeCredits cleans up the names and roles of an album's credits, dropping blank
+// rows and repeats. An album given only an artist string credits it as the primary artist.
+func normalizeCredits(artist string, credits []Credit) []Credit {
+	if len(credits) == 0 && strings.TrimSpace(artist) != "" {
+		credits = []Credit{{Name: artist, Role: CreditPrimary}}
+	}
+	var res []Credit
+	seen := make(map[string]bool)
+	for _, c := range credits {
+		c.Name = normalizeText(c.Name)
+		c.Role = CreditRole(strings.ToLower(strings.TrimSpace(string(c.Role))))
+		if c.Role == "" {
+			c.Role = CreditPrimary
+		}
+		key := strings.ToLower(c.Name) + "\x00" + string(c.Role)
+		if c.Name == "" || seen[key] {
+			continue
+		}
+		seen[key] = true
+		res = append(res, c)
+	}
+	return res
+}
+
+// checkCredits records a message under "artist" when the credits are not usable
+func checkCredits(fields map[string]string, credits []Credit) {
+	if len(credits) > maxCredits {
+		fields["artist"] = fmt.Sprintf("Credit at most %d artists.", maxCredits)
+		return
+	}
+	hasPrimary := false
+	for _, c := range credits {
+		if !validCreditRole(c.Role) {
+			fields["artist"] = fmt.Sprintf("%q is not a role, use one of %v.", c.Role, creditRoles)
+			return
+		}
+		checkText(fields, "artist", "an artist", c.Name, maxArtistLen)
+		if fields["artist"] != "" {
+			return
+		}
+		hasPrimary = hasPrimary || c.Role == CreditPrimary
+	}
+	if !hasPrimary {
+		fields["artist"] = "Enter an artist."
+	}
+}
+
+// resolveArtists finds or creates the artist for each credit, inside the caller's transaction.
+// Names match whatever spelling is already stored, ignoring case, and take that spelling.
+func resolveArtists(ctx context.Context, tx *sql.Tx, credits []Credit) ([]Credit, error) {
+	var res []Credit
+	seen := make(map[Credit]bool)
+	for _, c := range credits {
+		result, err := tx.ExecContext(ctx, "INSERT INTO artists (name) VALUES (?) ON DUPLICATE KEY UPDATE id = LAST_INSERT_ID(id);", c.Name)
+		if err != nil {
+			return nil, dbError("resolveArtists", err)
+		}
+		if c.ArtistID, err = result.LastInsertId(); err != nil {
+			return nil, dbError("resolveArtists", err)
+		}
+		if err := tx.QueryRowContext(ctx, "SELECT name FROM artists WHERE id = ?;", c.ArtistID).Scan(&c.Name); err != nil {
+			return nil, dbError("resolveArtists", err)
+		}
+		// two spellings can turn out to be the same artist
+		if !seen[c] {
+			seen[c] = true
+			res = append(res, c)
+		}
+	}
+	return res, nil
+}
+
+// saveCredits replaces an album's credits with resolved ones, inside the caller's transaction
+func saveCredits(ctx context.Context, tx *sql.Tx, albumID int64, credits []Credit) error {
+	if _, err := tx.ExecContext(ctx, "DELETE FROM album_artists WHERE album_id = ?;", albumID); err != nil {
+		return dbError("saveCredits", err)
+	}
+	for i, c := range credits {
+		if _, err := tx.ExecContext(ctx, "INSERT INTO album_artists (album_id, artist_id, role, position) VALUES (?, ?, ?, ?);",
+			albumID, c.ArtistID, c.Role, i); err != nil {
+			return dbError("saveCredits", err)
+		}
+	}
+	return nil
+}
+
+// queryer is what albumCredits needs: a *sql.DB or a *sql.Tx
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// albumCredits loads the credits of the given albums, in credit order, keyed by album id
+func albumCredits(ctx context.Context, q queryer, ids []int64) (map[int64][]Credit, error) {
+	credits := make(map[int64][]Credit, len(ids))
+	if len(ids) == 0 {
+		return credits, nil
+	}
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	rows, err := q.QueryContext(ctx, `SELECT aa.album_id, ar.id, ar.name, aa.role FROM album_artists aa
+		JOIN artists ar ON ar.id = aa.artist_id
+		WHERE aa.album_id IN (?`+strings.Repeat(", ?", len(ids)-1)+`) ORDER BY aa.album_id, aa.position;`, args...)
+	if err != nil {
+		return nil, dbError("albumCredits", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var albumID int64
+		var c Credit
+		if err := rows.Scan(&albumID, &c.ArtistID, &c.Name, &c.Role); err != nil {
+			return nil, dbError("albumCredits", err)
+		}
+		credits[albumID] = append(credits[albumID], c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, dbError("albumCredits", err)
+	}
+	return credits, nil
+}
+
+// attachCredits fills in the Artists of each album, for the API and exports
+func attachCredits(ctx context.Context, albums []AlbumMap) error {
+	ids := make([]int64, len(albums))
+	for i, a := range albums {
+		ids[i] = a.ID
+	}
+	credits, err := albumCredits(ctx, readDB(ctx), ids)
+	if err != nil {
+		return err
+	}
+	for i := range albums {
+		albums[i].Artists = credits[albums[i].ID]
+	}
+	return nil
+}
+
+// refreshCreditLines rewrites the display credit of albums whose artists changed, inside the caller's transaction
+func refreshCreditLines(ctx context.Context, tx *sql.Tx, albumIDs []int64) error {
+	credits, err := albumCredits(ctx, tx, albumIDs)
+	if err != nil {
+		return err
+	}
+	for _, id := range albumIDs {
+		if _, err := tx.ExecContext(ctx, "UPDATE album SET artist = ? WHERE id = ?;", creditLine(credits[id]), id); err != nil {
+			return dbError("refreshCreditLines", err)
+		}
+		if err := recordChange(ctx, tx, id, "update"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// artistAlbumIDs returns the albums crediting an artist, locking their credits
+func artistAlbumIDs(ctx context.Context, tx *sql.Tx, artistID int64) ([]int64, error) {
+	rows, err := tx.QueryContext(ctx, "SELECT DISTINCT album_id FROM album_artists WHERE artist_id = ? FOR UPDATE;", artistID)
+	if err != nil {
+		return nil, dbError("artistAlbumIDs", err)
+	}
+	defer rows.Close()
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, dbError("artistAlbumIDs", err)
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, dbError("artistAlbumIDs", err)
+	}
+	return ids, nil
+}
+
+// allArtists lists every artist by name with the number of albums crediting it
+func allArtists(ctx context.Context) ([]Artist, error) {
+	var artists []Artist
+	rows, err := readDB(ctx).QueryContext(ctx, `SELECT ar.id, ar.name, COUNT(DISTINCT aa.album_id) FROM artists ar
+		LEFT JOIN album_artists aa ON aa.artist_id = ar.id GROUP BY ar.id, ar.name ORDER BY ar.name;`)
+	if err != nil {
+		return nil, dbError("allArtists", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var a Artist
+		if err := rows.Scan(&a.ID, &a.Name, &a.Albums); err != nil {
+			return nil, dbError("allArtists", err)
+		}
+		artists = append(artists, a)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, dbError("allArtists", err)
+	}
+	return artists, nil
+}
+
+// renameArtist corrects an artist's name everywhere it is credited
+func renameArtist(ctx context.Context, id int64, name string) error {
+	name = normalizeText(name)
+	fields := make(map[string]string)
+	checkText(fields, "name", "a name", name, maxArtistLen)
+	if len(fields) > 0 {
+		return invalidFields("renameArtist", fields)
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return dbError("renameArtist", err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, "UPDATE artists SET name = ? WHERE id = ?;", name, id)
+	if err != nil {
+		if errors.Is(dbError("renameArtist", err), ErrConflict) {
+			return &Error{Kind: ErrConflict, Op: "renameArtist", Msg: fmt.Sprintf("There is already an artist called %s; merge the two instead.", name), Err: err}
+		}
+		return dbError("renameArtist", err)
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return dbError("renameArtist", err)
+	} else if n == 0 {
+		var exists int
+		if err := tx.QueryRowContext(ctx, "SELECT 1 FROM artists WHERE id = ?;", id).Scan(&exists); err == sql.ErrNoRows {
+			return notFound("renameArtist", "There is no artist %d.", id)
+		} else if err != nil {
+			return dbError("renameArtist", err)
+		}
+	}
+	ids, err := artistAlbumIDs(ctx, tx, id)
+	if err != nil {
+		return err
+	}
+	if err := refreshCreditLines(ctx, tx, ids); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return dbError("renameArtist", err)
+	}
+	logFrom(ctx).WithFields(log.Fields{"func": "renameArtist", "artist_id": id, "artist": name, "count": len(ids)}).Info("renamed artist")
+	return nil
+}
+
+// mergeArtists moves every credit of artist from to artist into and deletes from, for
+// duplicates created by typos
+func mergeArtists(ctx context.Context, from, into int64) error {
+	if from == into {
+		return invalid("mergeArtists", "Pick two different artists to merge.")
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return dbError("mergeArtists", err)
+	}
+	defer tx.Rollback()
+
+	var exists int
+	if err := tx.QueryRowContext(ctx, "SELECT 1 FROM artists WHERE id = ?;", into).Scan(&exists); err == sql.ErrNoRows {
+		return notFound("mergeArtists", "There is no artist %d.", into)
+	} else if err != nil {
+		return dbError("mergeArtists", err)
+	}
+	ids, err := artistAlbumIDs(ctx, tx, from)
+	if err != nil {
+		return err
+	}
+	// an album crediting both keeps its existing credit for into
+	if _, err := tx.ExecContext(ctx, "UPDATE IGNORE album_artists SET artist_id = ? WHERE artist_id = ?;", into, from); err != nil {
+		return dbError("mergeArtists", err)
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM album_artists WHERE artist_id = ?;", from); err != nil {
+		return dbError("mergeArtists", err)
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE tracks SET artist_id = ? WHERE artist_id = ?;", into, from); err != nil {
+		return dbError("mergeArtists", err)
+	}
+	result, err := tx.ExecContext(ctx, "DELETE FROM artists WHERE id = ?;", from)
+	if err != nil {
+		return dbError("mergeArtists", err)
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return dbError("mergeArtists", err)
+	} else if n == 0 {
+		return notFound("mergeArtists", "There is no artist %d.", from)
+	}
+	if err := refreshCreditLines(ctx, tx, ids); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return dbError("mergeArtists", err)
+	}
+	logFrom(ctx).WithFields(log.Fields{"func": "mergeArtists", "artist_id": from, "into_artist_id": into, "count": len(ids)}).Info("merged artists")
+	return nil
+}
@@ -0,0 +1,411 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"net/http"
+	"os"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// sessionCookie is the name of the login cookie
+const sessionCookie = "session"
+
+// minPasswordLen is the shortest password we accept
+const minPasswordLen = 8
+
+// User is a login account
+type User struct {
+	ID       int64
+	Username string
+	Role     Role
+	Scope    Scope // set when the request was authenticated with an API token
+	TokenID  int64 // and the token's id
+}
+
+// userKey and actorKey are context keys for the logged in user and a non-user actor (e.g. the CLI)
+type userKey struct{}
+type actorKey struct{}
+
+// withUser returns a copy of ctx carrying the logged in user
+func withUser(ctx context.Context, u *User) context.Context {
+	return context.WithValue(ctx, userKey{}, u)
+}
+
+// currentUser returns the logged in user, or nil
+func currentUser(ctx context.Context) *User {
+	u, _ := ctx.Value(userKey{}).(*User)
+	return u
+}
+
+// withActor names who is acting when there is no logged in user
+func withActor(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, actorKey{}, name)
+}
+
+// cliActor names the person running a CLI command
+func cliActor() string {
+	if u := os.Getenv("USER"); u != "" {
+		return "cli:" + u
+	}
+	return "cli"
+}
+
+// actorFrom returns the user ID (if any) and name to record on album changes
+func actorFrom(ctx context.Context) (sql.NullInt64, string) {
+	if u := currentUser(ctx); u != nil {
+		return sql.NullInt64{Int64: u.ID, Valid: true}, u.Username
+	}
+	if name, ok := ctx.Value(actorKey{}).(string); ok {
+		return sql.NullInt64{}, name
+	}
+	return sql.NullInt64{}, "anonymous"
+}
+
+// dummyHash is compared against when the username is unknown, so a failed login takes
+// as long for a missing user as for a wrong password
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("not a real password"), bcrypt.DefaultCost)
+
+// createUser adds an account with a bcrypt hashed password, and its favorites and wishlist
+func createUser(ctx context.Context, username, password string, role Role) (int64, error) {
+	username = strings.TrimSpace(username)
+	if username == "" || len(username) > 64 {
+		return 0, invalid("createUser", "A username must be 1 to 64 characters.")
+	}
+	if len(password) < minPasswordLen {
+		return 0, invalid("createUser", "A password must be at least %d characters.", minPasswordLen)
+	}
+	if !validRole(role) {
+		return 0, invalid("createUser", "%q is not a role, use one of %v.", role, roles)
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return 0, invalid("createUser", "That password cannot be used: %v", err)
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, dbError("createUser", err)
+	}
+	defer tx.Rollback()
+	result, err := tx.ExecContext(ctx, "INSERT INTO users (username, password_hash, role) VALUES (?, ?, ?);", username, hash, role)
+	if err != nil {
+		return 0, dbError("createUser", err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, dbError("createUser", err)
+	}
+	if err := createDefaultLists(ctx, tx, id); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, dbError("createUser", err)
+	}
+	logFrom(ctx).WithFields(log.Fields{"func": "createUser", "user_id": id, "username": username, "role": role}).Info("created user")
+	return id, nil
+}
+
+// setPassword replaces a user's password
+func setPassword(ctx context.Context, username, password string) error {
+	if len(password) < minPasswordLen {
+		return invalid("setPassword", "A password must be at least %d characters.", minPasswordLen)
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return invalid("setPassword", "That password cannot be used: %v", err)
+	}
+	result, err := db.ExecContext(ctx, "UPDATE users SET password_hash = ? WHERE username = ?;", hash, username)
+	if err != nil {
+		return dbError("setPassword", err)
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return dbError("setPassword", err)
+	} else if n == 0 {
+		return notFound("setPassword", "There is no user called %s.", username)
+	}
+	// a new password logs out every existing session
+	if _, err := db.ExecContext(ctx, "DELETE s FROM sessions s JOIN users u ON u.id = s.user_id WHERE u.username = ?;", username); err != nil {
+		return dbError("setPassword", err)
+	}
+	return nil
+}
+
+// setRole changes a user's role
+func setRole(ctx context.Context, username string, role Role) error {
+	if !validRole(role) {
+		return invalid("setRole", "%q is not a role, use one of %v.", role, roles)
+	}
+	result, err := db.ExecContext(ctx, "UPDATE users SET role = ? WHERE username = ?;", role, username)
+	if err != nil {
+		return dbError("setRole", err)
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return dbError("setRole", err)
+	} else if n == 0 {
+		// RowsAffected is 0 when the role is unchanged too
+		var exists bool
+		if err := db.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM users WHERE username = ?);", username).Scan(&exists); err != nil {
+			return dbError("setRole", err)
+		}
+		if !exists {
+			return notFound("setRole", "There is no user called %s.", username)
+		}
+	}
+	logFrom(ctx).WithFields(log.Fields{"func": "setRole", "username": username, "role": role}).Info("changed role")
+	return nil
+}
+
+// deleteUser removes an account and its sessions
+func deleteUser(ctx context.Context, username string) error {
+	result, err := db.ExecContext(ctx, "DELETE FROM users WHERE username = ?;", username)
+	if err != nil {
+		return dbError("deleteUser", err)
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return dbError("deleteUser", err)
+	} else if n == 0 {
+		return notFound("deleteUser", "There is no user called %s.", username)
+	}
+	return nil
+}
+
+// allUsers lists every account by username
+func allUsers(ctx context.Context) ([]User, error) {
+	var users []User
+	rows, err := db.QueryContext(ctx, "SELECT id, username, role FROM users ORDER BY username;")
+	if err != nil {
+		return nil, dbError("allUsers", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var u User
+		if err := rows.Scan(&u.ID, &u.Username, &u.Role); err != nil {
+			return nil, dbError("allUsers", err)
+		}
+		users = append(users, u)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, dbError("allUsers", err)
+	}
+	return users, nil
+}
+
+// userByName looks up an account by username
+func userByName(ctx context.Context, username string) (*User, error) {
+	var u User
+	err := db.QueryRowContext(ctx, "SELECT id, username, role FROM users WHERE username = ?;", username).Scan(&u.ID, &u.Username, &u.Role)
+	if err == sql.ErrNoRows {
+		return nil, notFound("userByName", "There is no user called %s.", username)
+	}
+	if err != nil {
+		return nil, dbError("userByName", err)
+	}
+	return &u, nil
+}
+
+// authenticate checks a username and password, returning the user on success
+func authenticate(ctx context.Context, username, password string) (*User, error) {
+	var u User
+	var hash []byte
+	err := db.QueryRowContext(ctx, "SELECT id, username, role, password_hash FROM users WHERE username = ?;", username).Scan(&u.ID, &u.Username, &u.Role, &hash)
+	if err == sql.ErrNoRows {
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return nil, invalid("authenticate", "Wrong username or password.")
+	}
+	if err != nil {
+		return nil, dbError("authenticate", err)
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil {
+		return nil, invalid("authenticate", "Wrong username or password.")
+	}
+	return &u, nil
+}
+
+// hashToken is how session tokens are stored
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// randomToken returns n random bytes, hex encoded
+func randomToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// createSession starts a session for u, returns the cookie token
+func createSession(ctx context.Context, u *User) (string, error) {
+	token, err := randomToken(32)
+	if err != nil {
+		return "", err
+	}
+	csrf, err := randomToken(32)
+	if err != nil {
+		return "", err
+	}
+	_, err = db.ExecContext(ctx, "INSERT INTO sessions (id, user_id, csrf_token, expires_at) VALUES (?, ?, ?, NOW() + INTERVAL ? SECOND);",
+		hashToken(token), u.ID, csrf, int64(appCfg.SessionTTL.Seconds()))
+	if err != nil {
+		return "", dbError("createSession", err)
+	}
+	return token, nil
+}
+
+// sessionUser returns the user and CSRF token of a live session, or a nil user when the
+// token is unknown or expired
+func sessionUser(ctx context.Context, token string) (*User, string, error) {
+	var u User
+	var csrf string
+	err := db.QueryRowContext(ctx, `SELECT u.id, u.username, u.role, s.csrf_token FROM sessions s JOIN users u ON u.id = s.user_id
+		WHERE s.id = ? AND s.expires_at > NOW();`, hashToken(token)).Scan(&u.ID, &u.Username, &u.Role, &csrf)
+	if err == sql.ErrNoRows {
+		return nil, "", nil
+	}
+	if err != nil {
+		return nil, "", dbError("sessionUser", err)
+	}
+	return &u, csrf, nil
+}
+
+// deleteSession ends a session
+func deleteSession(ctx context.Context, token string) error {
+	_, err := db.ExecContext(ctx, "DELETE FROM sessions WHERE id = ?;", hashToken(token))
+	return dbError("deleteSession", err)
+}
+
+// setSessionCookie writes (or with an empty token, clears) the login cookie
+func setSessionCookie(w http.ResponseWriter, token string) {
+	c := &http.Cookie{
+		Name:     sessionCookie,
+		Value:    token,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   appCfg.CookieSecure,
+		SameSite: http.SameSiteLaxMode,
+		MaxAge:   int(appCfg.SessionTTL.Seconds()),
+	}
+	if token == "" {
+		c.MaxAge = -1
+	}
+	http.SetCookie(w, c)
+}
+
+// loadSession puts the logged in user and their session's CSRF token, if any, on the request context.
+// A Bearer API token takes the place of the session cookie.
+func loadSession(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token := bearerToken(r); token != "" {
+			u, err := tokenUser(r.Context(), token)
+			if err != nil {
+				renderError(w, r, err)
+				return
+			}
+			if u == nil {
+				w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+				renderError(w, r, &Error{Kind: ErrUnauthenticated, Op: "loadSession", Msg: "That API token is unknown, revoked or expired."})
+				return
+			}
+			ctx := withUser(r.Context(), u)
+			ctx = withLogger(ctx, logFrom(ctx).WithFields(log.Fields{"user": u.Username, "scope": u.Scope}))
+			next.ServeHTTP(w, r.WithContext(ctx))
+			return
+		}
+
+		c, err := r.Cookie(sessionCookie)
+		if err != nil || c.Value == "" || isStaticPath(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		u, csrf, err := sessionUser(r.Context(), c.Value)
+		if err != nil {
+			renderError(w, r, err)
+			return
+		}
+		if u == nil {
+			// expired or logged out elsewhere
+			setSessionCookie(w, "")
+			next.ServeHTTP(w, r)
+			return
+		}
+		ctx := withUser(r.Context(), u)
+		ctx = withCSRFToken(ctx, csrf)
+		ctx = withLogger(ctx, logFrom(ctx).WithField("user", u.Username))
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// isSafeMethod reports whether the method only reads
+func isSafeMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+}
+
+// localRedirect returns next if it is a path on this site, otherwise "/"
+func localRedirect(next string) string {
+	if strings.HasPrefix(next, "/") && !strings.HasPrefix(next, "//") && !strings.HasPrefix(next, "/\\") {
+		return next
+	}
+	return "/"
+}
+
+// loginHandler shows the login form and starts a session on a good password
+func loginHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	next := localRedirect(r.FormValue("next"))
+	if r.Method != http.MethodPost {
+		render(w, r, "login.html", struct {
+			Next    string
+			Message string
+		}{next, ""})
+		return
+	}
+
+	username := r.FormValue("username")
+	l := logFrom(ctx).WithFields(log.Fields{"func": "loginHandler", "username": username})
+	u, err := authenticate(ctx, username, r.FormValue("password"))
+	if err != nil {
+		if status, _ := errorStatus(err); status >= http.StatusInternalServerError {
+			renderError(w, r, err)
+			return
+		}
+		l.Warn("login failed")
+		renderStatus(w, r, http.StatusUnauthorized, "login.html", struct {
+			Next    string
+			Message string
+		}{next, errorMessage(err)})
+		return
+	}
+	token, err := createSession(ctx, u)
+	if err != nil {
+		renderError(w, r, err)
+		return
+	}
+	setSessionCookie(w, token)
+	l.WithField("user_id", u.ID).Info("logged in")
+	http.Redirect(w, r, next, http.StatusSeeOther)
+}
+
+// logoutHandler ends the session
+func logoutHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	if c, err := r.Cookie(sessionCookie); err == nil && c.Value != "" {
+		if err := deleteSession(r.Context(), c.Value); err != nil {
+			renderError(w, r, err)
+			return
+		}
+	}
+	setSessionCookie(w, "")
+	logFrom(r.Context()).WithField("func", "logoutHandler").Info("logged out")
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
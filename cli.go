@@ -0,0 +1,1245 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const usage = `usage: data-access <command> [flags]
+
+commands:
+  serve                                   start the web server (the default)
+  migrate [-status]                       apply pending database migrations
+  seed [-force]                           add the sample albums
+  import [-format csv|json] FILE          add albums from FILE ("-" reads stdin)
+  export [-format csv|json] [-o FILE]     write every album to FILE or stdout
+  album get ID                            print one album
+  album list [-title T|-artist A|-price P|-track T] [-genre G] [-tag T] [-label L] [-format F] [-year Y]
+            [-min-price P] [-max-price P] [-currency C] [-min-rating N] [-sort title|rating|reviews]
+                                          the price range is in C, the base currency unless given
+  album add -title T -artist A [-featuring F] [-composer C] -price P [-genre G] [-tag T]
+            [-released YYYY-MM-DD] [-label L] [-format F] [-catalog N] [-notes TEXT] [-cover FILE]
+                                          -artist, -featuring, -composer, -genre and -tag can be repeated;
+                                          F is cd, vinyl, cassette or digital; FILE a JPEG, PNG or GIF
+  album update ID [-title T] [-artist A] [-featuring F] [-composer C] [-price P] [-genre G] [-tag T]
+            [-released YYYY-MM-DD] [-label L] [-format F] [-catalog N] [-notes TEXT] [-cover FILE|-no-cover]
+                                          any artist flag replaces all of the album's credits,
+                                          -genre all of its genres and -tag all of its tags;
+                                          an empty value clears a detail, e.g. -notes ""
+  album delete ID
+  track list ALBUM                        print an album's tracks
+  track add ALBUM -title T [-disc D] [-number N] [-duration M:SS] [-artist A]
+                                          without -number the track goes at the end of its disc
+  track update ID [-title T] [-disc D] [-number N] [-duration M:SS] [-artist A]
+  track delete ID
+  artist list                             list artists and how many albums credit them
+  artist rename ID NAME                   correct an artist's name on all their albums
+  artist merge FROM INTO                  move FROM's credits to INTO and delete FROM
+  genre list                              print the genre tree with album counts
+  genre add NAME [-parent P]              create a genre, under P when given
+  genre rename NAME NEW
+  genre move NAME [-parent P]             put a genre under P, or at the top without -parent
+  genre delete NAME                       only genres without sub-genres can go
+  tag list                                print the tags in use with album counts
+  stock show ALBUM                        print an album's stock and latest movements
+  stock move ALBUM -kind K -quantity N [-note TEXT]
+                                          K is received, sold, returned or adjusted; N counts
+                                          up from 1, or is the signed correction for adjusted
+  stock threshold ALBUM N|-               set the album's low-stock threshold, - for the default
+  stock low                               list the albums at or below their threshold
+  review list ALBUM                       print an album's reviews, hidden ones too
+  review hide ID                          take a review down; it stops counting towards the rating
+  review show ID                          put a hidden review back
+  review delete ID
+  list show USER                          print a user's lists with their albums
+  list export ID [-format csv|json] [-o FILE]
+                                          write a list's albums in order, in the export format
+  rate list                               print the exchange rates, newest first per currency
+  rate set CURRENCY RATE [-from YYYY-MM-DD]
+                                          one unit of BASE_CURRENCY buys RATE of CURRENCY from
+                                          the given day (default today) until the next rate
+  rate delete CURRENCY YYYY-MM-DD
+  user add NAME [-role R]                 create a login, the password is read from stdin
+                                          R is viewer, editor (the default) or admin
+  user passwd NAME                        set a new password, read from stdin
+  user role NAME ROLE                     change a login's role
+  user list
+  user delete NAME
+  token create USER -name N [-scope read|write|admin] [-days D]
+                                          issue an API token (default scope read, 90 days, 0 never expires)
+  token list [USER]
+  token revoke ID
+  secrets keygen                          print a new SECRETS_KEY
+  secrets set NAME                        store a secret in SECRETS_FILE, the value is read from stdin
+  secrets list
+  secrets delete NAME
+
+Settings come from the environment, see README.md.
+`
+
+// seedAlbums are the sample rows from the original create-tables.sql
+var seedAlbums = []Album{
+	{Title: "Blue Train", Artist: "John Coltrane", Price: Money{Cents: 5699}},
+	{Title: "Giant Steps", Artist: "John Coltrane", Price: Money{Cents: 6399}},
+	{Title: "Jeru", Artist: "Gerry Mulligan", Price: Money{Cents: 1799}},
+	{Title: "Sarah Vaughan", Artist: "Sarah Vaughan", Price: Money{Cents: 3498}},
+}
+
+// run dispatches a command line to its subcommand
+func run(args []string) error {
+	cmd := "serve"
+	if len(args) > 0 {
+		cmd, args = args[0], args[1:]
+	}
+	if cmd == "help" || cmd == "-h" || cmd == "--help" {
+		fmt.Print(usage)
+		return nil
+	}
+	if cmd == "secrets" && len(args) > 0 && args[0] == "keygen" {
+		// needs no config, and has to work before SECRETS_KEY exists
+		return secretsKeygen()
+	}
+
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	if err := setupLogging(cfg); err != nil {
+		return err
+	}
+	appCfg = cfg
+	ctx := withActor(context.Background(), cliActor())
+
+	switch cmd {
+	case "serve":
+		return serveCmd(ctx, cfg, args)
+	case "migrate":
+		return migrateCmd(ctx, cfg, args)
+	case "seed":
+		return seedCmd(ctx, cfg, args)
+	case "import":
+		return importCmd(ctx, cfg, args)
+	case "export":
+		return exportCmd(ctx, cfg, args)
+	case "album":
+		return albumCmd(ctx, cfg, args)
+	case "artist":
+		return artistCmd(ctx, cfg, args)
+	case "track":
+		return trackCmd(ctx, cfg, args)
+	case "genre":
+		return genreCmd(ctx, cfg, args)
+	case "tag":
+		return tagCmd(ctx, cfg, args)
+	case "stock":
+		return stockCmd(ctx, cfg, args)
+	case "review":
+		return reviewCmd(ctx, cfg, args)
+	case "list":
+		return listCmd(ctx, cfg, args)
+	case "rate":
+		return rateCmd(ctx, cfg, args)
+	case "user":
+		return userCmd(ctx, cfg, args)
+	case "token":
+		return tokenCmd(ctx, cfg, args)
+	case "secrets":
+		return secretsCmd(ctx, cfg, args)
+	}
+	fmt.Fprint(os.Stderr, usage)
+	return fmt.Errorf("unknown command %q", cmd)
+}
+
+// connect opens the shared database handle used by the data functions
+func connect(ctx context.Context, cfg Config) error {
+	dbCredentials.Store(&credentials{user: cfg.DBUser, pass: cfg.DBPass})
+	var err error
+	if blobs, err = openBlobStore(cfg); err != nil {
+		return err
+	}
+	db, err = openDB(ctx, cfg)
+	return err
+}
+
+// serveCmd starts the web server
+func serveCmd(ctx context.Context, cfg Config, args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ContinueOnError)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := validateTemplates(); err != nil {
+		return err
+	}
+	l := log.WithField("func", "serveCmd")
+	for _, f := range bootstrapFiles {
+		if _, err := os.Stat(f); err != nil {
+			l.Errorf("%s is missing, pages will be unstyled and menus won't open; run scripts/fetch-bootstrap.sh and commit static/bootstrap", f)
+		}
+	}
+	l.Info("starting up")
+	if err := connect(ctx, cfg); err != nil {
+		return err
+	}
+	go monitorDB(ctx, db, cfg.DBHealthInterval)
+	if cfg.SQLConsoleUser != "" {
+		var err error
+		if consoleDB, err = openConsoleDB(cfg); err != nil {
+			return err
+		}
+	}
+	if cfg.SecretsRefresh > 0 {
+		go watchSecrets(ctx, cfg, cfg.SecretsRefresh)
+	}
+	if len(cfg.DBReplicas) > 0 {
+		var err error
+		if replicas, err = openReplicas(ctx, cfg); err != nil {
+			return err
+		}
+		go replicas.monitor(ctx, cfg.DBHealthInterval)
+	}
+	return serve(cfg, routes())
+}
+
+// migrateCmd applies pending migrations, or lists them with -status
+func migrateCmd(ctx context.Context, cfg Config, args []string) error {
+	fs := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	status := fs.Bool("status", false, "list migrations instead of applying them")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := connect(ctx, cfg); err != nil {
+		return err
+	}
+	if *status {
+		migrations, err := loadMigrations(ctx)
+		if err != nil {
+			return err
+		}
+		for _, m := range migrations {
+			state := "pending"
+			if m.Applied {
+				state = "applied"
+			}
+			fmt.Printf("%-8s %s\n", state, m.Version)
+		}
+		return nil
+	}
+	done, err := migrate(ctx)
+	fmt.Printf("applied %d migration(s)\n", len(done))
+	return err
+}
+
+// seedCmd adds the sample albums, unless there are albums already
+func seedCmd(ctx context.Context, cfg Config, args []string) error {
+	fs := flag.NewFlagSet("seed", flag.ContinueOnError)
+	force := fs.Bool("force", false, "add the samples even if the catalog is not empty")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := connect(ctx, cfg); err != nil {
+		return err
+	}
+	existing, err := dataDump(ctx)
+	if err != nil {
+		return err
+	}
+	if len(existing) > 0 && !*force {
+		return fmt.Errorf("seed: the catalog already has albums, use -force to add the samples anyway")
+	}
+	for _, alb := range seedAlbums {
+		if _, err := addAlbum(ctx, alb); err != nil {
+			return err
+		}
+	}
+	fmt.Printf("added %d album(s)\n", len(seedAlbums))
+	return nil
+}
+
+// importCmd adds the albums in a CSV or JSON file
+func importCmd(ctx context.Context, cfg Config, args []string) error {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	format := fs.String("format", "csv", "file format: csv or json")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("import: expected one FILE argument")
+	}
+
+	var in io.Reader = os.Stdin
+	if name := fs.Arg(0); name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			return fmt.Errorf("import: %v", err)
+		}
+		defer f.Close()
+		in = f
+	}
+	albums, err := readAlbums(in, *format)
+	if err != nil {
+		return err
+	}
+
+	if err := connect(ctx, cfg); err != nil {
+		return err
+	}
+	for i, alb := range albums {
+		if _, err := addAlbum(ctx, alb); err != nil {
+			return fmt.Errorf("import: album %d (%s): %w", i+1, alb.Title, err)
+		}
+	}
+	fmt.Printf("imported %d album(s)\n", len(albums))
+	return nil
+}
+
+// exportCmd writes every album as CSV or JSON
+func exportCmd(ctx context.Context, cfg Config, args []string) error {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	format := fs.String("format", "csv", "file format: csv or json")
+	out := fs.String("o", "-", "output file, - for stdout")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := connect(ctx, cfg); err != nil {
+		return err
+	}
+	albums, err := allAlbums(ctx)
+	if err != nil {
+		return err
+	}
+
+	var w io.Writer = os.Stdout
+	if *out != "-" {
+		f, err := os.Create(*out)
+		if err != nil {
+			return fmt.Errorf("export: %v", err)
+		}
+		defer f.Close()
+		w = f
+	}
+	return writeAlbums(w, *format, albums)
+}
+
+// albumCmd runs the album get|list|add|update|delete subcommands
+func albumCmd(ctx context.Context, cfg Config, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("album: expected get, list, add, update or delete")
+	}
+	sub, args := args[0], args[1:]
+
+	// the ID comes first on the command line, flags after it
+	var id int64
+	if sub == "get" || sub == "update" || sub == "delete" {
+		if len(args) == 0 {
+			return fmt.Errorf("album %s: expected an album ID", sub)
+		}
+		var err error
+		if id, err = strconv.ParseInt(args[0], 10, 64); err != nil {
+			return fmt.Errorf("album %s: %q is not an album ID", sub, args[0])
+		}
+		args = args[1:]
+	}
+
+	fs := flag.NewFlagSet("album "+sub, flag.ContinueOnError)
+	title := fs.String("title", "", "album title")
+	var artists, featuring, composers stringList
+	fs.Var(&artists, "artist", "primary artist, repeat for more")
+	fs.Var(&featuring, "featuring", "featured artist, repeat for more")
+	fs.Var(&composers, "composer", "composer, repeat for more")
+	priceStr := fs.String("price", "", "price, e.g. 9.99")
+	track := fs.String("track", "", "part of a track title")
+	var genres, tags stringList
+	fs.Var(&genres, "genre", "genre, repeat for more (list takes one)")
+	fs.Var(&tags, "tag", "tag, repeat for more (list takes one)")
+	released := fs.String("released", "", "release date, YYYY-MM-DD")
+	label := fs.String("label", "", "record label")
+	format := fs.String("format", "", "cd, vinyl, cassette or digital")
+	catalog := fs.String("catalog", "", "catalog number, unique per label")
+	notes := fs.String("notes", "", "notes")
+	year := fs.Int("year", 0, "release year (list only)")
+	minPrice := fs.String("min-price", "", "lowest price, in -currency (list only)")
+	maxPrice := fs.String("max-price", "", "highest price, in -currency (list only)")
+	currency := fs.String("currency", string(cfg.BaseCurrency), "currency of -min-price and -max-price (list only)")
+	minRating := fs.Int("min-rating", 0, "lowest average rating, 1 to 5 (list only)")
+	sortBy := fs.String("sort", "", "title, rating or reviews (list only)")
+	coverFile := fs.String("cover", "", "cover image, a JPEG, PNG or GIF file (add and update)")
+	noCover := fs.Bool("no-cover", false, "take the cover away (update only)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	price, err := parsePrice("album "+sub, *priceStr)
+	if err != nil {
+		return err
+	}
+	var cover *coverImage
+	if *coverFile != "" {
+		data, err := os.ReadFile(*coverFile)
+		if err != nil {
+			return err
+		}
+		img, err := prepareCover("album "+sub, data)
+		if fields := fieldErrors(err); fields != nil {
+			return fmt.Errorf("album %s: %s", sub, fieldMessages(fields))
+		} else if err != nil {
+			return err
+		}
+		cover = &img
+	}
+
+	if err := connect(ctx, cfg); err != nil {
+		return err
+	}
+	switch sub {
+	case "get":
+		alb, err := albumByID(ctx, id)
+		if err != nil {
+			return err
+		}
+		return printJSON(albumMap(alb))
+	case "list":
+		get := map[string]string{"label": *label, "format": *format, "min_price": *minPrice, "max_price": *maxPrice, "sort": *sortBy}
+		if *year != 0 {
+			get["year"] = strconv.Itoa(*year)
+		}
+		if *minRating != 0 {
+			get["min_rating"] = strconv.Itoa(*minRating)
+		}
+		filter, err := albumFilter("album list", func(name string) string { return get[name] }, Currency(strings.ToUpper(*currency)))
+		if err != nil {
+			return err
+		}
+		if len(genres) > 0 {
+			filter.Genre = genres[0]
+		}
+		if len(tags) > 0 {
+			filter.Tag = tags[0]
+		}
+		var albums []AlbumMap
+		switch {
+		case !price.IsZero():
+			albums, err = albumsByPrice(ctx, price)
+		case *title != "":
+			albums, err = albumsByTitle(ctx, *title)
+		case len(artists) > 0:
+			albums, err = albumsByArtist(ctx, artists[0])
+		case *track != "":
+			albums, err = albumsByTrack(ctx, *track)
+		case filter.active() || filter.Sort != "":
+			albums, err = albumsByFilter(ctx, filter, 0)
+		default:
+			albums, err = allAlbums(ctx)
+		}
+		if err == nil && (!price.IsZero() || *title != "" || len(artists) > 0 || *track != "") {
+			albums, err = filterAlbums(ctx, albums, filter)
+		}
+		if err == nil {
+			err = attachRatings(ctx, albums)
+		}
+		if err != nil {
+			return err
+		}
+		sortAlbums(albums, filter.Sort)
+		return printJSON(albums)
+	case "add":
+		id, err := addAlbum(ctx, Album{Title: *title, Price: price, Credits: creditsFromFlags(artists, featuring, composers),
+			Released: *released, Label: *label, Format: AlbumFormat(*format), CatalogNumber: *catalog, Notes: *notes,
+			Genres: genres, Tags: tags})
+		if err != nil {
+			return err
+		}
+		if cover != nil {
+			if _, err := setCover(ctx, id, cover); err != nil {
+				return err
+			}
+		}
+		alb, err := albumByID(withPrimary(ctx), id)
+		if err != nil {
+			return err
+		}
+		return printJSON(albumMap(alb))
+	case "update":
+		alb, err := albumByID(ctx, id)
+		if err != nil {
+			return err
+		}
+		fs.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "title":
+				alb.Title = *title
+			case "artist", "featuring", "composer":
+				alb.Credits = creditsFromFlags(artists, featuring, composers)
+			case "price":
+				alb.Price = price
+			case "genre":
+				alb.Genres = genres
+			case "tag":
+				alb.Tags = tags
+			case "released":
+				alb.Released = *released
+			case "label":
+				alb.Label = *label
+			case "format":
+				alb.Format = AlbumFormat(*format)
+			case "catalog":
+				alb.CatalogNumber = *catalog
+			case "notes":
+				alb.Notes = *notes
+			}
+		})
+		if alb, _, err = updateAlbum(ctx, alb); err != nil {
+			return err
+		}
+		if cover != nil || *noCover {
+			if _, err := setCover(ctx, id, cover); err != nil {
+				return err
+			}
+		}
+		if alb, err = albumByID(withPrimary(ctx), id); err != nil {
+			return err
+		}
+		return printJSON(albumMap(alb))
+	case "delete":
+		if err := deleteAlbumByID(ctx, id); err != nil {
+			return err
+		}
+		fmt.Printf("deleted album %d\n", id)
+		return nil
+	}
+	return fmt.Errorf("album: unknown subcommand %q", sub)
+}
+
+// stringList is a flag that can be given more than once
+type stringList []string
+
+func (s *stringList) String() string { return strings.Join(*s, ", ") }
+
+func (s *stringList) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
+
+// creditsFromFlags turns the -artist, -featuring and -composer flags into credits
+func creditsFromFlags(artists, featuring, composers []string) []Credit {
+	var credits []Credit
+	for _, f := range []struct {
+		names []string
+		role  CreditRole
+	}{{artists, CreditPrimary}, {featuring, CreditFeatured}, {composers, CreditComposer}} {
+		for _, name := range f.names {
+			credits = append(credits, Credit{Name: name, Role: f.role})
+		}
+	}
+	return credits
+}
+
+// artistCmd runs the artist list|rename|merge subcommands
+func artistCmd(ctx context.Context, cfg Config, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("artist: expected list, rename or merge")
+	}
+	sub, args := args[0], args[1:]
+	var ids []string
+	switch sub {
+	case "list":
+	case "rename":
+		if len(args) != 2 {
+			return fmt.Errorf("artist rename: expected an artist ID and a name")
+		}
+		ids = args[:1]
+	case "merge":
+		if len(args) != 2 {
+			return fmt.Errorf("artist merge: expected the artist ID to merge and the one to keep")
+		}
+		ids = args
+	default:
+		return fmt.Errorf("artist: unknown subcommand %q", sub)
+	}
+	var nums []int64
+	for _, a := range ids {
+		id, err := strconv.ParseInt(a, 10, 64)
+		if err != nil {
+			return fmt.Errorf("artist %s: %q is not an artist ID", sub, a)
+		}
+		nums = append(nums, id)
+	}
+	if err := connect(ctx, cfg); err != nil {
+		return err
+	}
+	switch sub {
+	case "rename":
+		if err := renameArtist(ctx, nums[0], args[1]); err != nil {
+			return err
+		}
+		fmt.Printf("renamed artist %d\n", nums[0])
+	case "merge":
+		if err := mergeArtists(ctx, nums[0], nums[1]); err != nil {
+			return err
+		}
+		fmt.Printf("merged artist %d into %d\n", nums[0], nums[1])
+	default:
+		artists, err := allArtists(ctx)
+		if err != nil {
+			return err
+		}
+		for _, a := range artists {
+			fmt.Printf("%d\t%s\t%d albums\n", a.ID, a.Name, a.Albums)
+		}
+	}
+	return nil
+}
+
+// genreCmd runs the genre list|add|rename|move|delete subcommands
+func genreCmd(ctx context.Context, cfg Config, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("genre: expected list, add, rename, move or delete")
+	}
+	sub, args := args[0], args[1:]
+
+	// the genre name comes first, flags after it
+	var name string
+	switch sub {
+	case "list":
+	case "add", "rename", "move", "delete":
+		if len(args) == 0 {
+			return fmt.Errorf("genre %s: expected a genre name", sub)
+		}
+		name, args = args[0], args[1:]
+	default:
+		return fmt.Errorf("genre: unknown subcommand %q", sub)
+	}
+	fs := flag.NewFlagSet("genre "+sub, flag.ContinueOnError)
+	parent := fs.String("parent", "", "the genre to put it under")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if sub == "rename" && fs.NArg() != 1 {
+		return fmt.Errorf("genre rename: expected a genre name and the new name")
+	}
+	if err := connect(ctx, cfg); err != nil {
+		return err
+	}
+	switch sub {
+	case "add":
+		id, err := addGenre(ctx, name, *parent)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("added genre %d\n", id)
+	case "rename":
+		if err := renameGenre(ctx, name, fs.Arg(0)); err != nil {
+			return err
+		}
+		fmt.Printf("renamed genre %s\n", name)
+	case "move":
+		if err := moveGenre(ctx, name, *parent); err != nil {
+			return err
+		}
+		fmt.Printf("moved genre %s\n", name)
+	case "delete":
+		if err := deleteGenre(ctx, name); err != nil {
+			return err
+		}
+		fmt.Printf("deleted genre %s\n", name)
+	default:
+		genres, err := genreTree(ctx)
+		if err != nil {
+			return err
+		}
+		for _, g := range genres {
+			fmt.Printf("%s%s\t%d albums\n", strings.Repeat("  ", g.Depth), g.Name, g.Albums)
+		}
+	}
+	return nil
+}
+
+// tagCmd runs the tag list subcommand
+func tagCmd(ctx context.Context, cfg Config, args []string) error {
+	if len(args) != 1 || args[0] != "list" {
+		return fmt.Errorf("tag: expected list")
+	}
+	if err := connect(ctx, cfg); err != nil {
+		return err
+	}
+	tags, err := tagCloud(ctx)
+	if err != nil {
+		return err
+	}
+	for _, t := range tags {
+		fmt.Printf("%s\t%d albums\n", t.Name, t.Albums)
+	}
+	return nil
+}
+
+// stockCmd runs the stock show|move|threshold|low subcommands
+func stockCmd(ctx context.Context, cfg Config, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("stock: expected show, move, threshold or low")
+	}
+	sub, args := args[0], args[1:]
+
+	// the album ID comes first, flags after it
+	var id int64
+	switch sub {
+	case "low":
+	case "show", "move", "threshold":
+		if len(args) == 0 {
+			return fmt.Errorf("stock %s: expected an album ID", sub)
+		}
+		var err error
+		if id, err = strconv.ParseInt(args[0], 10, 64); err != nil {
+			return fmt.Errorf("stock %s: %q is not an ID", sub, args[0])
+		}
+		args = args[1:]
+	default:
+		return fmt.Errorf("stock: unknown subcommand %q", sub)
+	}
+	fs := flag.NewFlagSet("stock "+sub, flag.ContinueOnError)
+	kind := fs.String("kind", "", "received, sold, returned or adjusted")
+	quantity := fs.Int("quantity", 0, "copies moved, signed for adjusted")
+	note := fs.String("note", "", "what the movement was for")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if sub == "threshold" && fs.NArg() != 1 {
+		return fmt.Errorf("stock threshold: expected an album ID and a threshold, or - for the default")
+	}
+	if err := connect(ctx, cfg); err != nil {
+		return err
+	}
+	switch sub {
+	case "show":
+		alb, err := albumByID(ctx, id)
+		if err != nil {
+			return err
+		}
+		movements, err := stockMovements(ctx, id, 50)
+		if err != nil {
+			return err
+		}
+		return printJSON(albumStock{AlbumID: id, Stock: alb.Stock, Movements: movements})
+	case "move":
+		m, err := recordMovement(ctx, StockMovement{AlbumID: id, Kind: MovementKind(*kind), Quantity: *quantity, Note: *note})
+		if err != nil {
+			return err
+		}
+		return printJSON(m)
+	case "threshold":
+		threshold, err := parseThreshold("stockCmd", fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		if err := setStockThreshold(ctx, id, threshold); err != nil {
+			return err
+		}
+		fmt.Printf("set the threshold of album %d\n", id)
+	default:
+		albums, err := lowStock(ctx)
+		if err != nil {
+			return err
+		}
+		for _, a := range albums {
+			fmt.Printf("%d\t%s\t%s\t%d in stock (low at %d)\n", a.ID, a.Title, a.Artist, a.Stock.Quantity, a.Stock.Threshold)
+		}
+	}
+	return nil
+}
+
+// rateCmd runs the rate list|set|delete subcommands
+func rateCmd(ctx context.Context, cfg Config, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("rate: expected list, set or delete")
+	}
+	sub, args := args[0], args[1:]
+
+	// the currency and rate or day come first, flags after them
+	var pos []string
+	switch sub {
+	case "list":
+	case "set", "delete":
+		if len(args) < 2 {
+			return fmt.Errorf("rate %s: expected a currency and a rate or day", sub)
+		}
+		pos, args = args[:2], args[2:]
+	default:
+		return fmt.Errorf("rate: unknown subcommand %q", sub)
+	}
+	fs := flag.NewFlagSet("rate "+sub, flag.ContinueOnError)
+	from := fs.String("from", "", "first day the rate applies, YYYY-MM-DD (default today)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := connect(ctx, cfg); err != nil {
+		return err
+	}
+	switch sub {
+	case "set":
+		r, err := setRate(ctx, ExchangeRate{Currency: Currency(pos[0]), Rate: pos[1], Effective: *from})
+		if err != nil {
+			return err
+		}
+		fmt.Printf("1 %s = %s %s from %s\n", cfg.BaseCurrency, r.Rate, r.Currency, r.Effective)
+	case "delete":
+		if err := deleteRate(ctx, Currency(pos[0]), pos[1]); err != nil {
+			return err
+		}
+		fmt.Printf("deleted the %s rate from %s\n", strings.ToUpper(pos[0]), pos[1])
+	default:
+		rates, err := allRates(ctx)
+		if err != nil {
+			return err
+		}
+		for _, r := range rates {
+			fmt.Printf("%s\t%s\tfrom %s\t(%s)\n", r.Currency, r.Rate, r.Effective, r.Actor)
+		}
+	}
+	return nil
+}
+
+// reviewCmd runs the review list|hide|show|delete subcommands. The CLI moderates, so it sees
+// and can change every review.
+func reviewCmd(ctx context.Context, cfg Config, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("review: expected list, hide, show or delete")
+	}
+	sub, args := args[0], args[1:]
+	if sub != "list" && sub != "hide" && sub != "show" && sub != "delete" {
+		return fmt.Errorf("review: unknown subcommand %q", sub)
+	}
+	// the album (list) or review ID is the only argument
+	if len(args) != 1 {
+		return fmt.Errorf("review %s: expected an ID", sub)
+	}
+	id, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil {
+		return fmt.Errorf("review %s: %q is not an ID", sub, args[0])
+	}
+	if err := connect(ctx, cfg); err != nil {
+		return err
+	}
+	switch sub {
+	case "hide", "show":
+		rv, err := setReviewHidden(ctx, id, sub == "hide")
+		if err != nil {
+			return err
+		}
+		return printJSON(rv)
+	case "delete":
+		rv, err := deleteReview(ctx, id)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("deleted %s's review of album %d\n", rv.Username, rv.AlbumID)
+		return nil
+	}
+	if _, err := albumByID(ctx, id); err != nil {
+		return err
+	}
+	reviews, err := albumReviews(ctx, id)
+	if err != nil {
+		return err
+	}
+	return printJSON(reviews)
+}
+
+// listCmd runs the list show|export subcommands; lists are changed by their owners on the site or through the API
+func listCmd(ctx context.Context, cfg Config, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("list: expected show or export")
+	}
+	sub, args := args[0], args[1:]
+	if sub != "show" && sub != "export" {
+		return fmt.Errorf("list: unknown subcommand %q", sub)
+	}
+	// the user (show) or list ID (export) comes first, flags after it
+	if len(args) == 0 {
+		return fmt.Errorf("list %s: expected a user or list ID", sub)
+	}
+	arg, args := args[0], args[1:]
+	fs := flag.NewFlagSet("list "+sub, flag.ContinueOnError)
+	format := fs.String("format", "csv", "file format: csv or json (export only)")
+	out := fs.String("o", "-", "output file, - for stdout (export only)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := connect(ctx, cfg); err != nil {
+		return err
+	}
+	if sub == "show" {
+		u, err := userByName(ctx, arg)
+		if err != nil {
+			return err
+		}
+		lists, err := userLists(ctx, u.ID)
+		if err == nil {
+			err = attachListItems(ctx, lists)
+		}
+		if err != nil {
+			return err
+		}
+		return printJSON(lists)
+	}
+
+	id, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil {
+		return fmt.Errorf("list export: %q is not a list ID", arg)
+	}
+	l, err := listByID(ctx, id)
+	if err != nil {
+		return err
+	}
+	var w io.Writer = os.Stdout
+	if *out != "-" {
+		f, err := os.Create(*out)
+		if err != nil {
+			return fmt.Errorf("list export: %v", err)
+		}
+		defer f.Close()
+		w = f
+	}
+	return writeAlbums(w, *format, l.albums())
+}
+
+// trackCmd runs the track list|add|update|delete subcommands
+func trackCmd(ctx context.Context, cfg Config, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("track: expected list, add, update or delete")
+	}
+	sub, args := args[0], args[1:]
+
+	// the album (list, add) or track (update, delete) ID comes first, flags after it
+	if len(args) == 0 {
+		return fmt.Errorf("track %s: expected an ID", sub)
+	}
+	id, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil {
+		return fmt.Errorf("track %s: %q is not an ID", sub, args[0])
+	}
+	fs := flag.NewFlagSet("track "+sub, flag.ContinueOnError)
+	title := fs.String("title", "", "track title")
+	disc := fs.Int("disc", 1, "disc number")
+	number := fs.Int("number", 0, "track number, 0 for the next on the disc")
+	durationStr := fs.String("duration", "", "length as m:ss")
+	artist := fs.String("artist", "", "artist, if not the album's")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	duration, ok := parseDuration(*durationStr)
+	if !ok {
+		return fmt.Errorf("track %s: %q is not a length, use m:ss", sub, *durationStr)
+	}
+
+	if err := connect(ctx, cfg); err != nil {
+		return err
+	}
+	switch sub {
+	case "list":
+		alb, err := albumByID(ctx, id)
+		if err != nil {
+			return err
+		}
+		return printJSON(alb.Tracks)
+	case "add":
+		t, err := saveTrack(ctx, Track{AlbumID: id, Disc: *disc, Number: *number, Title: *title, Duration: duration, Artist: *artist})
+		if err != nil {
+			return err
+		}
+		return printJSON(t)
+	case "update":
+		t, err := trackByID(ctx, id)
+		if err != nil {
+			return err
+		}
+		fs.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "title":
+				t.Title = *title
+			case "disc":
+				t.Disc = *disc
+			case "number":
+				t.Number = *number
+			case "duration":
+				t.Duration = duration
+			case "artist":
+				t.Artist = *artist
+			}
+		})
+		if t, err = saveTrack(ctx, t); err != nil {
+			return err
+		}
+		return printJSON(t)
+	case "delete":
+		if _, err := deleteTrack(ctx, id); err != nil {
+			return err
+		}
+		fmt.Printf("deleted track %d\n", id)
+		return nil
+	}
+	return fmt.Errorf("track: unknown subcommand %q", sub)
+}
+
+// userCmd runs the user add|passwd|role|list|delete subcommands
+func userCmd(ctx context.Context, cfg Config, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("user: expected add, passwd, role, list or delete")
+	}
+	sub, args := args[0], args[1:]
+	role := RoleEditor
+	switch {
+	case sub == "list":
+	case sub == "role":
+		if len(args) != 2 {
+			return fmt.Errorf("user role: expected a username and a role")
+		}
+		role = Role(args[1])
+	case len(args) == 0:
+		return fmt.Errorf("user %s: expected a username", sub)
+	case sub == "add":
+		fs := flag.NewFlagSet("user add", flag.ContinueOnError)
+		roleFlag := fs.String("role", string(RoleEditor), "viewer, editor or admin")
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+		role = Role(*roleFlag)
+		args = args[:1]
+	case len(args) != 1:
+		return fmt.Errorf("user %s: expected a username", sub)
+	}
+
+	if err := connect(ctx, cfg); err != nil {
+		return err
+	}
+	switch sub {
+	case "add", "passwd":
+		password, err := readPassword()
+		if err != nil {
+			return err
+		}
+		if sub == "add" {
+			_, err = createUser(ctx, args[0], password, role)
+		} else {
+			err = setPassword(ctx, args[0], password)
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Printf("saved user %s\n", args[0])
+		return nil
+	case "role":
+		if err := setRole(ctx, args[0], role); err != nil {
+			return err
+		}
+		fmt.Printf("%s is now %s\n", args[0], role)
+		return nil
+	case "list":
+		users, err := allUsers(ctx)
+		if err != nil {
+			return err
+		}
+		for _, u := range users {
+			fmt.Printf("%s\t%s\n", u.Username, u.Role)
+		}
+		return nil
+	case "delete":
+		if err := deleteUser(ctx, args[0]); err != nil {
+			return err
+		}
+		fmt.Printf("deleted user %s\n", args[0])
+		return nil
+	}
+	return fmt.Errorf("user: unknown subcommand %q", sub)
+}
+
+// tokenCmd runs the token create|list|revoke subcommands
+func tokenCmd(ctx context.Context, cfg Config, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("token: expected create, list or revoke")
+	}
+	sub, args := args[0], args[1:]
+	switch sub {
+	case "create":
+		if len(args) == 0 {
+			return fmt.Errorf("token create: expected a username")
+		}
+		fs := flag.NewFlagSet("token create", flag.ContinueOnError)
+		name := fs.String("name", "", "what the token is for")
+		scope := fs.String("scope", string(ScopeRead), "read, write or admin")
+		days := fs.Int("days", 90, "days until the token expires, 0 for never")
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+		if err := connect(ctx, cfg); err != nil {
+			return err
+		}
+		u, err := userByName(ctx, args[0])
+		if err != nil {
+			return err
+		}
+		token, _, err := createToken(ctx, u.ID, *name, Scope(*scope), *days)
+		if err != nil {
+			return err
+		}
+		// only the token goes to stdout, so it can be captured by a script
+		fmt.Fprintln(os.Stderr, "this token will not be shown again:")
+		fmt.Println(token)
+		return nil
+	case "list":
+		if len(args) > 1 {
+			return fmt.Errorf("token list: expected at most one username")
+		}
+		if err := connect(ctx, cfg); err != nil {
+			return err
+		}
+		var userID int64
+		if len(args) == 1 {
+			u, err := userByName(ctx, args[0])
+			if err != nil {
+				return err
+			}
+			userID = u.ID
+		}
+		tokens, err := userTokens(ctx, userID)
+		if err != nil {
+			return err
+		}
+		for _, t := range tokens {
+			expires, used := "never", "never"
+			if t.ExpiresAt.Valid {
+				expires = t.ExpiresAt.Time.Format(time.RFC3339)
+			}
+			if t.LastUsedAt.Valid {
+				used = t.LastUsedAt.Time.Format(time.RFC3339)
+			}
+			fmt.Printf("%d\t%s\t%s\t%s\t%s\texpires %s\tlast used %s\n", t.ID, t.Username, t.Prefix, t.Scope, t.Name, expires, used)
+		}
+		return nil
+	case "revoke":
+		if len(args) != 1 {
+			return fmt.Errorf("token revoke: expected a token id")
+		}
+		id, err := strconv.ParseInt(args[0], 10, 64)
+		if err != nil {
+			return fmt.Errorf("token revoke: %q is not a token id", args[0])
+		}
+		if err := connect(ctx, cfg); err != nil {
+			return err
+		}
+		if err := revokeToken(ctx, 0, id); err != nil {
+			return err
+		}
+		fmt.Printf("revoked token %d\n", id)
+		return nil
+	}
+	return fmt.Errorf("token: unknown subcommand %q", sub)
+}
+
+// readPassword reads a password from the first line of stdin
+func readPassword() (string, error) {
+	fmt.Fprint(os.Stderr, "password: ")
+	return readLine()
+}
+
+// readLine reads the first line of stdin, without the line ending
+func readLine() (string, error) {
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return "", fmt.Errorf("readLine: %v", err)
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// printJSON writes v to stdout as indented JSON
+func printJSON(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// readAlbums parses albums from CSV (with a title,artist,price header and optionally the
+// currency, released, label, format, catalog_number and notes columns) or a JSON array
+func readAlbums(r io.Reader, format string) ([]Album, error) {
+	var albums []Album
+	switch format {
+	case "json":
+		var in []AlbumMap
+		if err := json.NewDecoder(r).Decode(&in); err != nil {
+			return nil, fmt.Errorf("readAlbums: %v", err)
+		}
+		for _, a := range in {
+			albums = append(albums, albumFromMap(a))
+		}
+	case "csv":
+		records, err := csv.NewReader(r).ReadAll()
+		if err != nil {
+			return nil, fmt.Errorf("readAlbums: %v", err)
+		}
+		if len(records) == 0 {
+			return nil, nil
+		}
+		col := map[string]int{}
+		for i, h := range records[0] {
+			col[strings.ToLower(strings.TrimSpace(h))] = i
+		}
+		for _, h := range []string{"title", "artist", "price"} {
+			if _, ok := col[h]; !ok {
+				return nil, fmt.Errorf("readAlbums: the CSV header has no %q column", h)
+			}
+		}
+		for n, rec := range records[1:] {
+			price, err := parsePrice("readAlbums", strings.TrimSpace(rec[col["price"]]))
+			if err != nil {
+				return nil, fmt.Errorf("readAlbums: line %d: %w", n+2, err)
+			}
+			alb := Album{Title: rec[col["title"]], Artist: rec[col["artist"]], Price: price}
+			if i, ok := col["currency"]; ok && strings.TrimSpace(rec[i]) != "" {
+				alb.Price.Currency = Currency(strings.ToUpper(strings.TrimSpace(rec[i])))
+			}
+			for name, dest := range map[string]*string{"released": &alb.Released, "label": &alb.Label,
+				"catalog_number": &alb.CatalogNumber, "notes": &alb.Notes} {
+				if i, ok := col[name]; ok {
+					*dest = rec[i]
+				}
+			}
+			if i, ok := col["format"]; ok {
+				alb.Format = AlbumFormat(rec[i])
+			}
+			albums = append(albums, alb)
+		}
+	default:
+		return nil, fmt.Errorf("readAlbums: unknown format %q", format)
+	}
+	return albums, nil
+}
+
+// writeAlbums writes albums as CSV with a header row, or as a JSON array
+func writeAlbums(w io.Writer, format string, albums []AlbumMap) error {
+	switch format {
+	case "json":
+		if albums == nil {
+			albums = []AlbumMap{}
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(albums)
+	case "csv":
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"id", "title", "artist", "price", "currency", "released", "label", "format", "catalog_number", "notes"})
+		for _, a := range albums {
+			cw.Write([]string{strconv.FormatInt(a.ID, 10), a.Title, a.Artist, a.Price.Decimal(),
+				string(a.Price.Currency), a.Released, a.Label, string(a.Format), a.CatalogNumber, a.Notes})
+		}
+		cw.Flush()
+		return cw.Error()
+	}
+	return fmt.Errorf("writeAlbums: unknown format %q", format)
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds the runtime settings read from the environment.
+type Config struct {
+	LogLevel  string // LOG_LEVEL: panic, fatal, error, warn, info, debug or trace
+	LogFormat string // LOG_FORMAT: text or json
+
+	DBUser string // DBUSER, or a secret (see SecretsFile)
+	DBPass string // DBPASS, or a secret
+	DBAddr string // DBADDR: host:port of the MySQL server
+	DBName string // DBNAME
+
+	DBConnectTimeout  time.Duration // DB_CONNECT_TIMEOUT: how long startup keeps retrying the first connection
+	DBQueryTimeout    time.Duration // DB_QUERY_TIMEOUT: driver read/write timeout for a single query
+	DBMaxOpenConns    int           // DB_MAX_OPEN_CONNS
+	DBMaxIdleConns    int           // DB_MAX_IDLE_CONNS
+	DBConnMaxLifetime time.Duration // DB_CONN_MAX_LIFETIME
+	DBHealthInterval  time.Duration // DB_HEALTH_INTERVAL: how often the connection is pinged while serving
+
+	SecretsFile    string        // SECRETS_FILE: encrypted secrets file, unlocked with SECRETS_KEY or SECRETS_KEY_FILE
+	SecretsRefresh time.Duration // SECRETS_REFRESH_INTERVAL: how often DBUSER and DBPASS are re-read, 0 for never
+
+	DBReplicas       []string      // DB_REPLICAS: comma separated read replicas, host:port (same credentials) or full DSNs
+	DBReplicaMaxLag  time.Duration // DB_REPLICA_MAX_LAG: replicas further behind than this get no reads
+	DBReadYourWrites time.Duration // DB_READ_YOUR_WRITES: how long a client's reads stay on the primary after it writes
+
+	DBTLS           string // DB_TLS: "" (plain), true, skip-verify or preferred; false and the other envBool spellings are read as those
+	DBTLSCA         string // DB_TLS_CA: PEM file with the CA that signed the MySQL server certificate
+	DBTLSCert       string // DB_TLS_CERT: PEM client certificate for MySQL
+	DBTLSKey        string // DB_TLS_KEY: PEM client key for MySQL
+	DBTLSServerName string // DB_TLS_SERVER_NAME: name to verify the MySQL certificate against
+
+	HTTPAddr          string        // HTTP_ADDR: plain HTTP listener; only redirects to HTTPS when TLS is on
+	HTTPSAddr         string        // HTTPS_ADDR: HTTPS listener used when TLS is on
+	TLSCertFile       string        // TLS_CERT_FILE: PEM certificate chain
+	TLSKeyFile        string        // TLS_KEY_FILE: PEM private key
+	TLSDevCert        bool          // TLS_DEV_CERT: serve HTTPS with a generated self-signed certificate
+	TLSReloadInterval time.Duration // TLS_RELOAD_INTERVAL: how often the certificate files are checked for changes
+
+	SessionTTL   time.Duration // SESSION_TTL: how long a login lasts
+	CookieSecure bool          // COOKIE_SECURE: mark cookies Secure; defaults to on when serving HTTPS
+
+	RateLimitRead       int          // RATE_LIMIT_READ: GET requests per minute per client, 0 turns the limit off
+	RateLimitReadBurst  int          // RATE_LIMIT_READ_BURST: how many reads a client can make at once
+	RateLimitWrite      int          // RATE_LIMIT_WRITE: POST, PUT and DELETE requests per minute per client, 0 turns the limit off
+	RateLimitWriteBurst int          // RATE_LIMIT_WRITE_BURST
+	TrustedProxies      []*net.IPNet // TRUSTED_PROXIES: comma separated IPs or CIDRs whose X-Forwarded-For is believed
+
+	SQLConsoleTimeout time.Duration // SQL_CONSOLE_TIMEOUT: how long a console query may run
+	SQLConsoleMaxRows int           // SQL_CONSOLE_MAX_ROWS: most rows a console query returns
+	SQLConsoleUser    string        // SQL_CONSOLE_USER: MySQL account with only SELECT for the console, optional
+	SQLConsolePass    string        // SQL_CONSOLE_PASSWORD
+
+	LowStockThreshold int // LOW_STOCK_THRESHOLD: stock at or below this is low, for albums without their own threshold
+
+	BaseCurrency Currency // BASE_CURRENCY: the currency album prices are kept in
+
+	CoverStorage   string // COVER_STORAGE: where cover images are kept; only local for now
+	CoverDir       string // COVER_DIR: the directory local storage keeps them in
+	CoverMaxSize   int    // COVER_MAX_SIZE: largest cover upload, in bytes
+	CoverThumbSize int    // COVER_THUMB_SIZE: width and height of cover thumbnails, in pixels
+}
+
+// appCfg is the config the server was started with
+var appCfg Config
+
+// TLSEnabled reports whether the app should serve HTTPS
+func (c Config) TLSEnabled() bool {
+	return c.TLSDevCert || (c.TLSCertFile != "" && c.TLSKeyFile != "")
+}
+
+// loadConfig reads the config from environment variables, using defaults for anything unset
+func loadConfig() (Config, error) {
+	cfg := Config{
+		LogLevel:  envString("LOG_LEVEL", "info"),
+		LogFormat: envString("LOG_FORMAT", "text"),
+
+		DBAddr: envString("DBADDR", "127.0.0.1:3306"),
+		DBName: envString("DBNAME", "recordings"),
+
+		SecretsFile: envString("SECRETS_FILE", ""),
+		DBReplicas:  envList("DB_REPLICAS"),
+
+		DBTLSCA:         envString("DB_TLS_CA", ""),
+		DBTLSCert:       envString("DB_TLS_CERT", ""),
+		DBTLSKey:        envString("DB_TLS_KEY", ""),
+		DBTLSServerName: envString("DB_TLS_SERVER_NAME", ""),
+
+		HTTPAddr:    envString("HTTP_ADDR", ":8080"),
+		HTTPSAddr:   envString("HTTPS_ADDR", ":8443"),
+		TLSCertFile: envString("TLS_CERT_FILE", ""),
+		TLSKeyFile:  envString("TLS_KEY_FILE", ""),
+	}
+
+	var err error
+	if cfg.DBConnectTimeout, err = envDuration("DB_CONNECT_TIMEOUT", time.Minute); err != nil {
+		return cfg, err
+	}
+	if cfg.DBQueryTimeout, err = envDuration("DB_QUERY_TIMEOUT", 30*time.Second); err != nil {
+		return cfg, err
+	}
+	if cfg.DBMaxOpenConns, err = envInt("DB_MAX_OPEN_CONNS", 25); err != nil {
+		return cfg, err
+	}
+	if cfg.DBMaxIdleConns, err = envInt("DB_MAX_IDLE_CONNS", 25); err != nil {
+		return cfg, err
+	}
+	if cfg.DBConnMaxLifetime, err = envDuration("DB_CONN_MAX_LIFETIME", 5*time.Minute); err != nil {
+		return cfg, err
+	}
+	if cfg.DBHealthInterval, err = envDuration("DB_HEALTH_INTERVAL", 5*time.Second); err != nil {
+		return cfg, err
+	}
+	if cfg.SecretsRefresh, err = envDuration("SECRETS_REFRESH_INTERVAL", time.Minute); err != nil {
+		return cfg, err
+	}
+	// DBUSER and DBPASS can come from *_FILE, the secrets file or a registered provider
+	providers, err := secretProviders(cfg)
+	if err != nil {
+		return cfg, err
+	}
+	creds, err := dbCredentialsFrom(context.Background(), providers)
+	if err != nil {
+		return cfg, err
+	}
+	cfg.DBUser, cfg.DBPass = creds.user, creds.pass
+	if cfg.DBReplicaMaxLag, err = envDuration("DB_REPLICA_MAX_LAG", 5*time.Second); err != nil {
+		return cfg, err
+	}
+	if cfg.DBReadYourWrites, err = envDuration("DB_READ_YOUR_WRITES", 10*time.Second); err != nil {
+		return cfg, err
+	}
+	if cfg.TLSDevCert, err = envBool("TLS_DEV_CERT", false); err != nil {
+		return cfg, err
+	}
+	if cfg.TLSReloadInterval, err = envDuration("TLS_RELOAD_INTERVAL", 30*time.Second); err != nil {
+		return cfg, err
+	}
+	if cfg.SessionTTL, err = envDuration("SESSION_TTL", 24*time.Hour); err != nil {
+		return cfg, err
+	}
+	if cfg.CookieSecure, err = envBool("COOKIE_SECURE", cfg.TLSEnabled()); err != nil {
+		return cfg, err
+	}
+	if cfg.RateLimitRead, err = envInt("RATE_LIMIT_READ", 300); err != nil {
+		return cfg, err
+	}
+	if cfg.RateLimitReadBurst, err = envInt("RATE_LIMIT_READ_BURST", 60); err != nil {
+		return cfg, err
+	}
+	if cfg.RateLimitWrite, err = envInt("RATE_LIMIT_WRITE", 60); err != nil {
+		return cfg, err
+	}
+	if cfg.RateLimitWriteBurst, err = envInt("RATE_LIMIT_WRITE_BURST", 10); err != nil {
+		return cfg, err
+	}
+	if cfg.TrustedProxies, err = envCIDRs("TRUSTED_PROXIES"); err != nil {
+		return cfg, err
+	}
+	if cfg.SQLConsoleTimeout, err = envDuration("SQL_CONSOLE_TIMEOUT", 10*time.Second); err != nil {
+		return cfg, err
+	}
+	if cfg.SQLConsoleMaxRows, err = envInt("SQL_CONSOLE_MAX_ROWS", 1000); err != nil {
+		return cfg, err
+	}
+	if cfg.SQLConsoleTimeout <= 0 || cfg.SQLConsoleMaxRows <= 0 {
+		return cfg, fmt.Errorf("SQL_CONSOLE_TIMEOUT and SQL_CONSOLE_MAX_ROWS must be above 0")
+	}
+	cfg.SQLConsoleUser = envString("SQL_CONSOLE_USER", "")
+	cfg.SQLConsolePass = os.Getenv("SQL_CONSOLE_PASSWORD")
+	if cfg.SQLConsoleUser == "" && cfg.SQLConsolePass != "" {
+		return cfg, fmt.Errorf("SQL_CONSOLE_PASSWORD needs SQL_CONSOLE_USER")
+	}
+	if cfg.LowStockThreshold, err = envInt("LOW_STOCK_THRESHOLD", 2); err != nil {
+		return cfg, err
+	}
+	if cfg.LowStockThreshold < 0 {
+		return cfg, fmt.Errorf("LOW_STOCK_THRESHOLD must not be negative")
+	}
+	cfg.BaseCurrency = Currency(strings.ToUpper(envString("BASE_CURRENCY", "USD")))
+	if _, ok := currencies[cfg.BaseCurrency]; !ok {
+		return cfg, fmt.Errorf("BASE_CURRENCY %q is not a currency this app knows", cfg.BaseCurrency)
+	}
+	cfg.CoverStorage = strings.ToLower(envString("COVER_STORAGE", "local"))
+	cfg.CoverDir = envString("COVER_DIR", "covers")
+	if cfg.CoverMaxSize, err = envInt("COVER_MAX_SIZE", 5<<20); err != nil {
+		return cfg, err
+	}
+	if cfg.CoverThumbSize, err = envInt("COVER_THUMB_SIZE", 240); err != nil {
+		return cfg, err
+	}
+	if cfg.CoverMaxSize <= 0 || cfg.CoverThumbSize <= 0 {
+		return cfg, fmt.Errorf("COVER_MAX_SIZE and COVER_THUMB_SIZE must be above 0")
+	}
+	if (cfg.TLSCertFile == "") != (cfg.TLSKeyFile == "") {
+		return cfg, fmt.Errorf("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+	if (cfg.DBTLSCert == "") != (cfg.DBTLSKey == "") {
+		return cfg, fmt.Errorf("DB_TLS_CERT and DB_TLS_KEY must be set together")
+	}
+	if cfg.DBTLS, err = envDBTLS("DB_TLS"); err != nil {
+		return cfg, err
+	}
+	if (cfg.DBTLSCA != "" || cfg.DBTLSCert != "") && cfg.DBTLS != "true" {
+		return cfg, fmt.Errorf("DB_TLS_CA and DB_TLS_CERT need DB_TLS=true (not false, skip-verify or preferred)")
+	}
+	return cfg, nil
+}
+
+// envString returns the trimmed value of env var key, or def when it is unset or blank
+func envString(key, def string) string {
+	if v := strings.TrimSpace(os.Getenv(key)); v != "" {
+		return v
+	}
+	return def
+}
+
+// envInt returns env var key as an int, or def when it is unset
+func envInt(key string, def int) (int, error) {
+	v := envString(key, "")
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %q is not a whole number", key, v)
+	}
+	return n, nil
+}
+
+// envBool returns env var key as a bool (1, true, yes / 0, false, no), or def when it is unset
+func envBool(key string, def bool) (bool, error) {
+	switch strings.ToLower(envString(key, "")) {
+	case "":
+		return def, nil
+	case "1", "true", "yes", "on":
+		return true, nil
+	case "0", "false", "no", "off":
+		return false, nil
+	}
+	return false, fmt.Errorf("%s: %q is not true or false", key, os.Getenv(key))
+}
+
+// envDBTLS returns env var key as a MySQL TLS mode: "" when it is off (read like envBool),
+// "true", "skip-verify" or "preferred"
+func envDBTLS(key string) (string, error) {
+	switch v := strings.ToLower(envString(key, "")); v {
+	case "", "0", "false", "no", "off":
+		return "", nil
+	case "1", "true", "yes", "on":
+		return "true", nil
+	case "skip-verify", "preferred":
+		return v, nil
+	}
+	return "", fmt.Errorf("%s: %q is not true, false, skip-verify or preferred", key, os.Getenv(key))
+}
+
+// envDuration returns env var key as a duration such as "30s" or "5m", or def when it is unset
+func envDuration(key string, def time.Duration) (time.Duration, error) {
+	v := envString(key, "")
+	if v == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %q is not a duration (try 30s or 5m)", key, v)
+	}
+	return d, nil
+}
+
+// envList returns env var key split on commas, with blanks dropped
+func envList(key string) []string {
+	var list []string
+	for _, v := range strings.Split(envString(key, ""), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+// envCIDRs returns env var key as a list of networks; a bare IP is a network of one address
+func envCIDRs(key string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, v := range envList(key) {
+		if !strings.Contains(v, "/") {
+			ip := net.ParseIP(v)
+			if ip == nil {
+				return nil, fmt.Errorf("%s: %q is not an IP address or CIDR", key, v)
+			}
+			bits := 8 * len(ip.To4())
+			if bits == 0 {
+				bits = 128
+			}
+			v = fmt.Sprintf("%s/%d", v, bits)
+		}
+		_, n, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %q is not an IP address or CIDR", key, v)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
@@ -0,0 +1,433 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/go-sql-driver/mysql"
+	log "github.com/sirupsen/logrus"
+)
+
+// MySQL server error numbers the console explains itself
+const (
+	mysqlReadOnlyTx       = 1792 // ER_CANT_EXECUTE_IN_READ_ONLY_TRANSACTION
+	mysqlQueryInterrupted = 3024 // ER_QUERY_TIMEOUT, max_execution_time was hit
+)
+
+// maxStatementLen keeps console statements (and the history) a sensible size
+const maxStatementLen = 10000
+
+// consoleStatements are the first keywords the console accepts. Everything runs in a
+// read-only transaction as well, but DDL would commit that transaction implicitly, so
+// only statements that read are let through at all.
+var consoleStatements = map[string]bool{
+	"select": true, "with": true, "table": true, "values": true,
+	"show": true, "describe": true, "desc": true, "explain": true,
+}
+
+// explainable are the statements EXPLAIN can be put in front of
+var explainable = map[string]bool{"select": true, "with": true, "table": true, "values": true}
+
+// intoFile matches SELECT ... INTO OUTFILE/DUMPFILE, which writes on the database server
+var intoFile = regexp.MustCompile(`(?i)\binto\s+(outfile|dumpfile)\b`)
+
+// QueryOptions controls one console query
+type QueryOptions struct {
+	Explain bool          // show the plan instead of running the statement
+	Limit   int           // most rows returned, the rest is cut off
+	Timeout time.Duration // the statement is stopped after this long
+}
+
+// QueryColumn is a result column and its database type
+type QueryColumn struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+// Cell is one value of a result row; NULL is kept apart from the empty string
+type Cell struct {
+	Value string
+	Null  bool
+}
+
+// MarshalJSON writes NULL as null and everything else as a string
+func (c Cell) MarshalJSON() ([]byte, error) {
+	if c.Null {
+		return []byte("null"), nil
+	}
+	return json.Marshal(c.Value)
+}
+
+// QueryResult is whatever columns a console statement returned, as text
+type QueryResult struct {
+	Statement string        `json:"statement"`
+	Columns   []QueryColumn `json:"columns"`
+	Rows      [][]Cell      `json:"rows"`
+	Truncated bool          `json:"truncated"` // there were more than the limit
+	Duration  time.Duration `json:"duration_ms"`
+}
+
+// MarshalJSON reports the duration in milliseconds
+func (res QueryResult) MarshalJSON() ([]byte, error) {
+	type plain QueryResult
+	out := plain(res)
+	out.Duration = res.Duration / time.Millisecond
+	return json.Marshal(out)
+}
+
+// executableComment matches MySQL's /*! ... */ and /*+ ... */ comments, whose contents
+// the server runs rather than skips
+var executableComment = regexp.MustCompile(`/\*[!+]`)
+
+// consoleStatement checks stmt is a single statement that only reads, and returns it without
+// its trailing semicolon, with EXPLAIN put in front when opts asks for the plan
+func consoleStatement(stmt string, explain bool) (string, error) {
+	stmt = strings.TrimRight(strings.TrimSpace(stmt), "; \t\r\n")
+	if stmt == "" {
+		return "", invalid("genericQuery", "Enter a statement.")
+	}
+	if utf8.RuneCountInString(stmt) > maxStatementLen {
+		return "", invalid("genericQuery", "Keep statements to %d characters.", maxStatementLen)
+	}
+	if executableComment.MatchString(stmt) {
+		return "", invalid("genericQuery", "The console does not run /*! */ or /*+ */ comments.")
+	}
+	keyword := strings.ToLower(firstKeyword(stmt))
+	if !consoleStatements[keyword] {
+		return "", invalid("genericQuery", "The console only runs SELECT, WITH, TABLE, VALUES, SHOW, DESCRIBE and EXPLAIN.")
+	}
+	if intoFile.MatchString(stmt) {
+		return "", invalid("genericQuery", "The console cannot write files.")
+	}
+	if explain && keyword != "explain" {
+		if !explainable[keyword] {
+			return "", invalid("genericQuery", "Only SELECT, WITH, TABLE and VALUES statements have a plan.")
+		}
+		stmt = "EXPLAIN " + stmt
+	}
+	return stmt, nil
+}
+
+// firstKeyword returns the first word of stmt after any opening parentheses. Comments are
+// not skipped: a statement that starts with one has no keyword and is turned away.
+func firstKeyword(stmt string) string {
+	stmt = strings.TrimLeft(stmt, " \t\r\n(")
+	end := strings.IndexFunc(stmt, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z')
+	})
+	if end < 0 {
+		return stmt
+	}
+	return stmt[:end]
+}
+
+// consoleDB is the pool console statements run on when SQL_CONSOLE_USER is set, so they
+// go through a MySQL account that can only SELECT; nil means they share readDB
+var consoleDB *sql.DB
+
+// openConsoleDB opens the console's pool on the primary with the SQL_CONSOLE_USER account
+func openConsoleDB(cfg Config) (*sql.DB, error) {
+	c := cfg
+	c.DBUser, c.DBPass = cfg.SQLConsoleUser, cfg.SQLConsolePass
+	my, err := mysqlConfig(c)
+	if err != nil {
+		return nil, err
+	}
+	conn := sql.OpenDB(newDBConnector(my, false))
+	conn.SetMaxOpenConns(cfg.DBMaxOpenConns)
+	conn.SetMaxIdleConns(cfg.DBMaxIdleConns)
+	conn.SetConnMaxLifetime(cfg.DBConnMaxLifetime)
+	return conn, nil
+}
+
+// genericQuery runs an ad-hoc statement for the SQL console inside a read-only transaction,
+// stopping it after opts.Timeout, and scans whatever columns come back into a QueryResult
+// holding at most opts.Limit rows
+func genericQuery(ctx context.Context, stmt string, opts QueryOptions) (*QueryResult, error) {
+	l := logFrom(ctx).WithField("func", "genericQuery")
+	stmt, err := consoleStatement(stmt, opts.Explain)
+	if err != nil {
+		return nil, err
+	}
+	res := &QueryResult{Statement: stmt, Columns: []QueryColumn{}, Rows: [][]Cell{}}
+	start := time.Now()
+
+	queryCtx, cancel := context.WithTimeout(ctx, opts.Timeout)
+	defer cancel()
+	pool := consoleDB
+	if pool == nil {
+		pool = readDB(ctx)
+	}
+	conn, err := pool.Conn(queryCtx)
+	if err != nil {
+		return nil, consoleError(err, opts.Timeout)
+	}
+	defer conn.Close()
+	// the server stops a SELECT that runs too long even if the client has given up on it;
+	// it is a session setting, so put it back before the connection returns to the pool
+	if _, err := conn.ExecContext(queryCtx, "SET SESSION max_execution_time = ?;", opts.Timeout.Milliseconds()); err != nil {
+		return nil, consoleError(err, opts.Timeout)
+	}
+	defer conn.ExecContext(context.Background(), "SET SESSION max_execution_time = DEFAULT;")
+
+	tx, err := conn.BeginTx(queryCtx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return nil, consoleError(err, opts.Timeout)
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(queryCtx, stmt)
+	if err != nil {
+		return nil, consoleError(err, opts.Timeout)
+	}
+	defer rows.Close()
+	types, err := rows.ColumnTypes()
+	if err != nil {
+		return nil, consoleError(err, opts.Timeout)
+	}
+	for _, t := range types {
+		res.Columns = append(res.Columns, QueryColumn{Name: t.Name(), Type: t.DatabaseTypeName()})
+	}
+
+	values := make([]sql.NullString, len(types))
+	dest := make([]interface{}, len(types))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	for rows.Next() {
+		if len(res.Rows) == opts.Limit {
+			res.Truncated = true
+			break
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, consoleError(err, opts.Timeout)
+		}
+		row := make([]Cell, len(values))
+		for i, v := range values {
+			row[i] = Cell{Value: v.String, Null: !v.Valid}
+		}
+		res.Rows = append(res.Rows, row)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, consoleError(err, opts.Timeout)
+	}
+	res.Duration = time.Since(start)
+	l.WithFields(log.Fields{"count": len(res.Rows), "duration": res.Duration.String()}).Debug("ran console query")
+	return res, nil
+}
+
+// consoleError turns what went wrong with a console statement into a message for the admin.
+// Mistakes in the SQL are the user's, so MySQL's own message is shown as invalid input.
+func consoleError(err error, timeout time.Duration) error {
+	var myErr *mysql.MySQLError
+	switch {
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &myErr) && myErr.Number == mysqlQueryInterrupted:
+		return &Error{Kind: ErrValidation, Op: "genericQuery", Msg: "The statement was stopped after " + timeout.String() + ".", Err: err}
+	case errors.As(err, &myErr) && myErr.Number == mysqlReadOnlyTx:
+		return &Error{Kind: ErrValidation, Op: "genericQuery", Msg: "The console is read-only.", Err: err}
+	case errors.As(err, &myErr):
+		return &Error{Kind: ErrValidation, Op: "genericQuery", Msg: "MySQL error " + strconv.Itoa(int(myErr.Number)) + ": " + myErr.Message, Err: err}
+	}
+	return dbError("genericQuery", err)
+}
+
+// HistoryEntry is a statement a user ran in the console
+type HistoryEntry struct {
+	ID        int64     `json:"id"`
+	Statement string    `json:"statement"`
+	Explain   bool      `json:"explain"`
+	RowCount  int       `json:"row_count"`
+	Duration  int64     `json:"duration_ms"`
+	Error     string    `json:"error,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// maxHistory is how many statements the console lists
+const maxHistory = 50
+
+// maxHistoryErrorLen is the size, in characters, of query_history.error
+const maxHistoryErrorLen = 512
+
+// truncateRunes cuts s to at most n characters without splitting a UTF-8 sequence
+func truncateRunes(s string, n int) string {
+	i := 0
+	for pos := range s {
+		if i == n {
+			return s[:pos]
+		}
+		i++
+	}
+	return s
+}
+
+// recordQuery adds a statement to the user's history, with the error message if it failed
+func recordQuery(ctx context.Context, userID int64, stmt string, explain bool, res *QueryResult, queryErr error) error {
+	var rowCount int
+	var duration time.Duration
+	if res != nil {
+		rowCount, duration = len(res.Rows), res.Duration
+	}
+	var msg sql.NullString
+	if queryErr != nil {
+		msg = sql.NullString{String: truncateRunes(errorMessage(queryErr), maxHistoryErrorLen), Valid: true}
+	}
+	_, err := db.ExecContext(ctx, `INSERT INTO query_history (user_id, statement, is_explain, row_count, duration_ms, error)
+		VALUES (?, ?, ?, ?, ?, ?);`, userID, stmt, explain, rowCount, duration.Milliseconds(), msg)
+	return dbError("recordQuery", err)
+}
+
+// queryHistory returns a user's most recent console statements, newest first
+func queryHistory(ctx context.Context, userID int64) ([]HistoryEntry, error) {
+	history := []HistoryEntry{}
+	rows, err := db.QueryContext(ctx, `SELECT id, statement, is_explain, row_count, duration_ms, error, created_at
+		FROM query_history WHERE user_id = ? ORDER BY created_at DESC, id DESC LIMIT ?;`, userID, maxHistory)
+	if err != nil {
+		return nil, dbError("queryHistory", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var h HistoryEntry
+		var msg sql.NullString
+		if err := rows.Scan(&h.ID, &h.Statement, &h.Explain, &h.RowCount, &h.Duration, &msg, &h.CreatedAt); err != nil {
+			return nil, dbError("queryHistory", err)
+		}
+		h.Error = msg.String
+		history = append(history, h)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, dbError("queryHistory", err)
+	}
+	return history, nil
+}
+
+// historyEntry returns one of the user's history entries
+func historyEntry(ctx context.Context, userID, id int64) (HistoryEntry, error) {
+	var h HistoryEntry
+	err := db.QueryRowContext(ctx, "SELECT id, statement, is_explain FROM query_history WHERE id = ? AND user_id = ?;",
+		id, userID).Scan(&h.ID, &h.Statement, &h.Explain)
+	if err == sql.ErrNoRows {
+		return h, notFound("historyEntry", "There is no query %d in your history.", id)
+	}
+	return h, dbError("historyEntry", err)
+}
+
+// runConsoleQuery runs a statement for the current user with the configured limits and
+// records it in their history. Failing to record it is logged but does not fail the query.
+func runConsoleQuery(ctx context.Context, stmt string, explain bool, limit int) (*QueryResult, error) {
+	u := currentUser(ctx)
+	if limit <= 0 || limit > appCfg.SQLConsoleMaxRows {
+		limit = appCfg.SQLConsoleMaxRows
+	}
+	res, err := genericQuery(ctx, stmt, QueryOptions{Explain: explain, Limit: limit, Timeout: appCfg.SQLConsoleTimeout})
+	l := logFrom(ctx).WithFields(log.Fields{"func": "runConsoleQuery", "username": u.Username, "statement": stmt, "explain": explain})
+	l.WithError(err).Info("ran console statement")
+	if status, _ := errorStatus(err); err != nil && status >= http.StatusInternalServerError {
+		return nil, err
+	}
+	if histErr := recordQuery(ctx, u.ID, strings.TrimSpace(stmt), explain, res, err); histErr != nil {
+		l.WithError(histErr).Error("could not record console statement in history")
+	}
+	return res, err
+}
+
+// consolePage is the data for console.html
+type consolePage struct {
+	Statement string
+	Explain   bool
+	Limit     int
+	MaxRows   int
+	Result    *QueryResult
+	Message   string
+	History   []HistoryEntry
+}
+
+// consoleHandler is the admin SQL console: POST runs a statement, GET ?history=ID loads
+// one from the user's history into the form
+func consoleHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	u := currentUser(ctx)
+	page := consolePage{Limit: 100, MaxRows: appCfg.SQLConsoleMaxRows}
+
+	switch {
+	case r.Method == http.MethodPost:
+		page.Statement = r.FormValue("statement")
+		page.Explain = r.FormValue("explain") != ""
+		if n, err := strconv.Atoi(r.FormValue("limit")); err == nil {
+			page.Limit = n
+		}
+		res, err := runConsoleQuery(ctx, page.Statement, page.Explain, page.Limit)
+		if status, _ := errorStatus(err); err != nil && status >= http.StatusInternalServerError {
+			renderError(w, r, err)
+			return
+		}
+		page.Result = res
+		if err != nil {
+			page.Message = errorMessage(err)
+		}
+	case r.URL.Query().Get("history") != "":
+		id, err := strconv.ParseInt(r.URL.Query().Get("history"), 10, 64)
+		if err != nil {
+			renderError(w, r, notFound("consoleHandler", "There is no query %q in your history.", r.URL.Query().Get("history")))
+			return
+		}
+		h, err := historyEntry(ctx, u.ID, id)
+		if err != nil {
+			renderError(w, r, err)
+			return
+		}
+		page.Statement, page.Explain = h.Statement, h.Explain
+	}
+
+	history, err := queryHistory(ctx, u.ID)
+	if err != nil {
+		renderError(w, r, err)
+		return
+	}
+	page.History = history
+	render(w, r, "console.html", page)
+}
+
+// apiSQLHandler serves POST /api/sql: {"statement": "...", "explain": false, "limit": 100}
+func apiSQLHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w, "POST")
+		return
+	}
+	var in struct {
+		Statement string `json:"statement"`
+		Explain   bool   `json:"explain"`
+		Limit     int    `json:"limit"`
+	}
+	if err := decodeJSON(r, &in); err != nil {
+		renderError(w, r, err)
+		return
+	}
+	res, err := runConsoleQuery(r.Context(), in.Statement, in.Explain, in.Limit)
+	if err != nil {
+		renderError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+// apiSQLHistoryHandler serves GET /api/sql/history, the caller's recent statements
+func apiSQLHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, "GET")
+		return
+	}
+	history, err := queryHistory(r.Context(), currentUser(r.Context()).ID)
+	if err != nil {
+		renderError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, history)
+}
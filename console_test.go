@@ -0,0 +1,77 @@
+package main
+
+import "testing"
+
+func TestConsoleStatement(t *testing.T) {
+	for _, tc := range []struct {
+		in      string
+		explain bool
+		want    string // the statement run, empty when it is turned away
+	}{
+		{"SELECT 1", false, "SELECT 1"},
+		{"  select * from album;  ", false, "select * from album"},
+		{"SELECT 1;\n", true, "EXPLAIN SELECT 1"},
+		{"(SELECT 1) UNION (SELECT 2)", false, "(SELECT 1) UNION (SELECT 2)"},
+		{"((select 1))", false, "((select 1))"},
+		{"WITH a AS (SELECT 1) SELECT * FROM a", false, "WITH a AS (SELECT 1) SELECT * FROM a"},
+		{"TABLE album", false, "TABLE album"},
+		{"VALUES ROW(1, 2)", false, "VALUES ROW(1, 2)"},
+		{"SHOW TABLES", false, "SHOW TABLES"},
+		{"DESCRIBE album", false, "DESCRIBE album"},
+		{"EXPLAIN SELECT 1", true, "EXPLAIN SELECT 1"},
+		{"SELECT 1 -- trailing comment", false, "SELECT 1 -- trailing comment"},
+		{"SELECT /* plain comment */ 1", false, "SELECT /* plain comment */ 1"},
+		{"SHOW TABLES", true, ""},
+		{"", false, ""},
+		{";", false, ""},
+		{"DELETE FROM album", false, ""},
+		{"UPDATE album SET price = 0", false, ""},
+		{"DROP TABLE album", false, ""},
+		{"KILL 12", false, ""},
+		{"SET GLOBAL max_connections = 1", false, ""},
+		{"-- comment\nDELETE FROM album", false, ""},
+		{"-- comment\nSELECT 1", false, ""},
+		{"# comment\nSELECT 1", false, ""},
+		{"/* comment */ SELECT 1", false, ""},
+		{"(/* comment */ DELETE FROM album)", false, ""},
+		{"SELECT * FROM album INTO OUTFILE '/tmp/a'", false, ""},
+		{"select * from album into\n dumpfile '/tmp/a'", false, ""},
+		{"/*!KILL 12*/", false, ""},
+		{"/*!SET GLOBAL max_connections=1*/", false, ""},
+		{"/*!CREATE TABLE t AS*/ SELECT * FROM users", false, ""},
+		{"/*!50000 DROP TABLE album*/", false, ""},
+		{"SELECT 1 /*!, (SELECT password FROM users) */", false, ""},
+		{"SELECT /*+ MAX_EXECUTION_TIME(1) */ 1", false, ""},
+		{"/*+ SET_VAR(sql_mode='') */ SELECT 1", false, ""},
+	} {
+		got, err := consoleStatement(tc.in, tc.explain)
+		if tc.want == "" {
+			if err == nil {
+				t.Errorf("consoleStatement(%q, %v) = %q, want it turned away", tc.in, tc.explain, got)
+			}
+			continue
+		}
+		if err != nil || got != tc.want {
+			t.Errorf("consoleStatement(%q, %v) = %q, %v, want %q", tc.in, tc.explain, got, err, tc.want)
+		}
+	}
+}
+
+func TestFirstKeyword(t *testing.T) {
+	for _, tc := range []struct{ in, want string }{
+		{"SELECT 1", "SELECT"},
+		{"  \n\tselect*from album", "select"},
+		{"((SELECT 1))", "SELECT"},
+		{"SHOW", "SHOW"},
+		{"", ""},
+		{"-- comment\nSELECT 1", ""},
+		{"# comment\nSELECT 1", ""},
+		{"/* comment */ SELECT 1", ""},
+		{"/*!KILL 12*/", ""},
+		{"1 + 1", ""},
+	} {
+		if got := firstKeyword(tc.in); got != tc.want {
+			t.Errorf("firstKeyword(%q) = %q, want %q", tc.in, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,544 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/gif" // registers the GIF decoder for image.Decode
+	"image/jpeg"
+	_ "image/png" // registers the PNG decoder for image.Decode
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// BlobStore keeps binary objects, such as cover images, under slash separated keys.
+// Open and Delete of a missing key return an ErrNotFound error and nil.
+type BlobStore interface {
+	Put(ctx context.Context, key string, data []byte) error
+	Open(ctx context.Context, key string) (io.ReadCloser, error)
+	Delete(ctx context.Context, key string) error
+}
+
+// blobs is the store cover images go to, opened by connect
+var blobs BlobStore
+
+// openBlobStore returns the store COVER_STORAGE names
+func openBlobStore(cfg Config) (BlobStore, error) {
+	switch cfg.CoverStorage {
+	case "local":
+		return localStore{dir: cfg.CoverDir}, nil
+	}
+	return nil, fmt.Errorf("COVER_STORAGE %q is not a storage this app knows, use local", cfg.CoverStorage)
+}
+
+// localStore keeps blobs as files under dir, one per key; directories are made as needed
+type localStore struct {
+	dir string
+}
+
+// path is the file for key, refusing keys that would leave dir
+func (s localStore) path(key string) (string, error) {
+	if key == "" || path.Clean(key) != key || path.IsAbs(key) || key == ".." || strings.HasPrefix(key, "../") {
+		return "", fmt.Errorf("localStore: bad key %q", key)
+	}
+	return filepath.Join(s.dir, filepath.FromSlash(key)), nil
+}
+
+// Put writes data to a temporary file next to the blob and renames it into place, so
+// readers never see half a file
+func (s localStore) Put(ctx context.Context, key string, data []byte) error {
+	p, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		return fmt.Errorf("localStore: %v", err)
+	}
+	f, err := os.CreateTemp(filepath.Dir(p), ".upload-*")
+	if err != nil {
+		return fmt.Errorf("localStore: %v", err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return fmt.Errorf("localStore: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("localStore: %v", err)
+	}
+	if err := os.Chmod(f.Name(), 0o644); err != nil {
+		return fmt.Errorf("localStore: %v", err)
+	}
+	if err := os.Rename(f.Name(), p); err != nil {
+		return fmt.Errorf("localStore: %v", err)
+	}
+	return nil
+}
+
+// Open opens the file of key for reading
+func (s localStore) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	p, err := s.path(key)
+	if err != nil {
+		return nil, notFound("localStore", "There is no %s.", key)
+	}
+	f, err := os.Open(p)
+	if os.IsNotExist(err) {
+		return nil, notFound("localStore", "There is no %s.", key)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("localStore: %v", err)
+	}
+	return f, nil
+}
+
+// Delete removes the file of key; one that is already gone is fine
+func (s localStore) Delete(ctx context.Context, key string) error {
+	p, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("localStore: %v", err)
+	}
+	return nil
+}
+
+// maxCoverPixels bounds the width and height of an uploaded cover, so a small file
+// can't decode into gigabytes: at 4000×4000 a decoded image and its square crop take
+// about 64 MB each
+const maxCoverPixels = 4000
+
+// coverDecodes limits how many uploads are decoded and thumbnailed at once, one per CPU,
+// so a burst of large images can't add up to more memory than the server has
+var coverDecodes = make(chan struct{}, runtime.GOMAXPROCS(0))
+
+// coverTypes maps the content types covers may have to the extension they are stored under
+var coverTypes = map[string]string{
+	"image/jpeg": "jpg",
+	"image/png":  "png",
+	"image/gif":  "gif",
+}
+
+// Cover is an album's cover image: the SHA-256 of the uploaded file and its extension.
+// Covers are stored by content, so their URLs never change and can be cached for good.
+type Cover struct {
+	Hash string
+	Type string
+}
+
+// URL is where the full size image is served, empty when there is no cover
+func (c Cover) URL() string {
+	if c.Hash == "" {
+		return ""
+	}
+	return "/" + c.key()
+}
+
+// ThumbURL is where the thumbnail is served, empty when there is no cover
+func (c Cover) ThumbURL() string {
+	if c.Hash == "" {
+		return ""
+	}
+	return "/" + c.thumbKey()
+}
+
+// key and thumbKey are the blob keys of the image and its thumbnail
+func (c Cover) key() string      { return "covers/" + c.Hash + "." + c.Type }
+func (c Cover) thumbKey() string { return "covers/" + c.Hash + "-thumb.jpg" }
+
+// MarshalJSON writes the cover as {"url": "...", "thumb_url": "..."}, or null when there is none
+func (c Cover) MarshalJSON() ([]byte, error) {
+	if c.Hash == "" {
+		return []byte("null"), nil
+	}
+	return json.Marshal(map[string]string{"url": c.URL(), "thumb_url": c.ThumbURL()})
+}
+
+// UnmarshalJSON accepts and ignores a cover, so exports import again; covers are uploaded on their own
+func (c *Cover) UnmarshalJSON([]byte) error {
+	return nil
+}
+
+// coverImage is an upload that passed the checks: the file as sent and its thumbnail
+type coverImage struct {
+	Cover
+	Data  []byte
+	Thumb []byte
+}
+
+// prepareCover checks an uploaded image's size, type and dimensions and makes its
+// thumbnail. Problems are reported on the cover field.
+func prepareCover(op string, data []byte) (coverImage, error) {
+	bad := func(format string, args ...interface{}) (coverImage, error) {
+		return coverImage{}, invalidFields(op, map[string]string{"cover": fmt.Sprintf(format, args...)})
+	}
+	if len(data) == 0 {
+		return bad("Choose an image file.")
+	}
+	if len(data) > appCfg.CoverMaxSize {
+		return bad("The image is %s, keep it to %s.", byteSize(len(data)), byteSize(appCfg.CoverMaxSize))
+	}
+	ext, ok := coverTypes[http.DetectContentType(data)]
+	if !ok {
+		return bad("Upload a JPEG, PNG or GIF image.")
+	}
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return bad("This image can't be read.")
+	}
+	if cfg.Width < 1 || cfg.Height < 1 || cfg.Width > maxCoverPixels || cfg.Height > maxCoverPixels {
+		return bad("Keep the image within %d×%d pixels (this is %d×%d).", maxCoverPixels, maxCoverPixels, cfg.Width, cfg.Height)
+	}
+	coverDecodes <- struct{}{}
+	defer func() { <-coverDecodes }()
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return bad("This image can't be read.")
+	}
+	var thumb bytes.Buffer
+	if err := jpeg.Encode(&thumb, thumbnail(img, appCfg.CoverThumbSize), &jpeg.Options{Quality: 85}); err != nil {
+		return coverImage{}, fmt.Errorf("prepareCover: %v", err)
+	}
+	sum := sha256.Sum256(data)
+	return coverImage{Cover: Cover{Hash: hex.EncodeToString(sum[:]), Type: ext}, Data: data, Thumb: thumb.Bytes()}, nil
+}
+
+// thumbnail crops the middle square out of src and shrinks it to size×size (never
+// enlarging it) by averaging the pixels that fall into each one, on a white background
+func thumbnail(src image.Image, size int) *image.RGBA {
+	b := src.Bounds()
+	side := b.Dx()
+	if b.Dy() < side {
+		side = b.Dy()
+	}
+	crop := image.Rect(0, 0, side, side)
+	square := image.NewRGBA(crop)
+	draw.Draw(square, crop, image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.Draw(square, crop, src, image.Pt(b.Min.X+(b.Dx()-side)/2, b.Min.Y+(b.Dy()-side)/2), draw.Over)
+	if side <= size {
+		return square
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, size, size))
+	for y := 0; y < size; y++ {
+		y0, y1 := y*side/size, (y+1)*side/size
+		for x := 0; x < size; x++ {
+			x0, x1 := x*side/size, (x+1)*side/size
+			var sum [4]int
+			for sy := y0; sy < y1; sy++ {
+				row := square.Pix[sy*square.Stride+x0*4 : sy*square.Stride+x1*4]
+				for i := 0; i < len(row); i += 4 {
+					sum[0] += int(row[i])
+					sum[1] += int(row[i+1])
+					sum[2] += int(row[i+2])
+					sum[3] += int(row[i+3])
+				}
+			}
+			n := (x1 - x0) * (y1 - y0)
+			o := y*dst.Stride + x*4
+			for i := range sum {
+				dst.Pix[o+i] = uint8((sum[i] + n/2) / n)
+			}
+		}
+	}
+	return dst
+}
+
+// byteSize shows n bytes the way people read them, e.g. "5 MB" or "300 KB"
+func byteSize(n int) string {
+	switch {
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1f MB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%d KB", n/(1<<10))
+	}
+	return fmt.Sprintf("%d bytes", n)
+}
+
+// lockCover takes the row lock on a cover's hash for the rest of tx, adding the row if
+// needed. Storing a cover's images and deleting them both happen under this lock.
+func lockCover(ctx context.Context, tx *sql.Tx, hash string) error {
+	_, err := tx.ExecContext(ctx, "INSERT INTO cover_locks (hash) VALUES (?) ON DUPLICATE KEY UPDATE hash = hash;", hash)
+	return dbError("lockCover", err)
+}
+
+// setCover gives an album a new cover, or takes its cover away when img is nil. The
+// images are stored under the cover's lock before the album points at them; the old
+// ones are deleted when no other album uses them.
+func setCover(ctx context.Context, albumID int64, img *coverImage) (Cover, error) {
+	var cover Cover
+	committed := false
+	if img != nil {
+		cover = img.Cover
+		// images nothing ended up pointing at go again, once tx has let go of the lock
+		defer func() {
+			if !committed {
+				dropCover(ctx, cover)
+			}
+		}()
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return cover, dbError("setCover", err)
+	}
+	defer tx.Rollback()
+	if img != nil {
+		if err := lockCover(ctx, tx, cover.Hash); err != nil {
+			return cover, err
+		}
+		if err := blobs.Put(ctx, cover.key(), img.Data); err != nil {
+			return cover, fmt.Errorf("setCover: %v", err)
+		}
+		if err := blobs.Put(ctx, cover.thumbKey(), img.Thumb); err != nil {
+			return cover, fmt.Errorf("setCover: %v", err)
+		}
+	}
+	var old Cover
+	err = tx.QueryRowContext(ctx, "SELECT COALESCE(cover, ''), COALESCE(cover_type, '') FROM album WHERE id = ? FOR UPDATE;", albumID).
+		Scan(&old.Hash, &old.Type)
+	if err == sql.ErrNoRows {
+		return cover, notFound("setCover", "There is no album with id %d.", albumID)
+	}
+	if err != nil {
+		return cover, dbError("setCover", err)
+	}
+	var hash, typ sql.NullString
+	if img != nil {
+		hash = sql.NullString{String: cover.Hash, Valid: true}
+		typ = sql.NullString{String: cover.Type, Valid: true}
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE album SET cover = ?, cover_type = ? WHERE id = ?;", hash, typ, albumID); err != nil {
+		return cover, dbError("setCover", err)
+	}
+	if err := recordChange(ctx, tx, albumID, "cover"); err != nil {
+		return cover, err
+	}
+	if err := tx.Commit(); err != nil {
+		return cover, dbError("setCover", err)
+	}
+	committed = true
+	logFrom(ctx).WithFields(log.Fields{"func": "setCover", "album_id": albumID, "cover": cover.Hash, "old": old.Hash}).Info("set album cover")
+	if old.Hash != "" && old.Hash != cover.Hash {
+		dropCover(ctx, old)
+	}
+	return cover, nil
+}
+
+// dropCover deletes a cover's images once no album uses them. It runs after the change
+// that let go of the cover has committed, so a failure only leaves files behind. The
+// check and the delete hold the cover's lock, so an album setting the same image
+// concurrently either finds the images gone and stores them again or is seen using them.
+func dropCover(ctx context.Context, c Cover) {
+	l := logFrom(ctx).WithFields(log.Fields{"func": "dropCover", "cover": c.Hash})
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		l.WithError(err).Warn("keeping cover images")
+		return
+	}
+	defer tx.Rollback()
+	if err := lockCover(ctx, tx, c.Hash); err != nil {
+		l.WithError(err).Warn("keeping cover images")
+		return
+	}
+	var n int
+	if err := tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM album WHERE cover = ? LOCK IN SHARE MODE;", c.Hash).Scan(&n); err != nil {
+		l.WithError(err).Warn("keeping cover images")
+		return
+	}
+	if n > 0 {
+		return
+	}
+	for _, key := range []string{c.key(), c.thumbKey()} {
+		if err := blobs.Delete(ctx, key); err != nil {
+			l.WithError(err).Warn("could not delete cover image")
+		}
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM cover_locks WHERE hash = ?;", c.Hash); err != nil {
+		l.WithError(err).Warn("could not release cover lock row")
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		l.WithError(err).Warn("could not release cover lock row")
+	}
+}
+
+// albumCovers returns the covers of the given albums that have one, inside the caller's transaction
+func albumCovers(ctx context.Context, tx *sql.Tx, ids []int64) ([]Cover, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	rows, err := tx.QueryContext(ctx, `SELECT cover, cover_type FROM album WHERE cover IS NOT NULL
+		AND id IN (?`+strings.Repeat(", ?", len(ids)-1)+`);`, args...)
+	if err != nil {
+		return nil, dbError("albumCovers", err)
+	}
+	defer rows.Close()
+	var covers []Cover
+	for rows.Next() {
+		var c Cover
+		if err := rows.Scan(&c.Hash, &c.Type); err != nil {
+			return nil, dbError("albumCovers", err)
+		}
+		covers = append(covers, c)
+	}
+	return covers, dbError("albumCovers", rows.Err())
+}
+
+// coverFromRequest reads the "cover" file of a multipart form; no file means no new cover
+func coverFromRequest(op string, r *http.Request) (*coverImage, error) {
+	f, _, err := r.FormFile("cover")
+	if err == http.ErrMissingFile || err == http.ErrNotMultipart {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, invalidFields(op, map[string]string{"cover": "The image did not arrive, try again."})
+	}
+	defer f.Close()
+	data, err := io.ReadAll(io.LimitReader(f, int64(appCfg.CoverMaxSize)+1))
+	if err != nil {
+		return nil, invalidFields(op, map[string]string{"cover": "The image did not arrive, try again."})
+	}
+	if len(data) == 0 {
+		// a file input left empty still sends a part with no content
+		return nil, nil
+	}
+	img, err := prepareCover(op, data)
+	if err != nil {
+		return nil, err
+	}
+	return &img, nil
+}
+
+// coverUploadLimit is the most a request carrying a cover may send: the image plus the rest of the form
+func coverUploadLimit() int64 {
+	return int64(appCfg.CoverMaxSize) + 1<<20
+}
+
+// limitUploads turns away multipart requests bigger than a cover upload can be, before
+// anything reads the body, and caps the body of the rest at that size
+func limitUploads(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/") && !strings.HasPrefix(r.Header.Get("Content-Type"), "image/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if r.ContentLength > coverUploadLimit() {
+			renderError(w, r, &Error{Kind: ErrTooLarge, Op: "limitUploads",
+				Msg: fmt.Sprintf("That upload is too big, keep images to %s.", byteSize(appCfg.CoverMaxSize))})
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, coverUploadLimit())
+		next.ServeHTTP(w, r)
+	})
+}
+
+// coverHandler serves /covers/{hash}.{ext} and /covers/{hash}-thumb.jpg. The names
+// change with the content, so browsers may keep them for a year without asking again.
+func coverHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, "/covers/")
+	hash, ext, _ := strings.Cut(name, ".")
+	hash = strings.TrimSuffix(hash, "-thumb")
+	contentType := ""
+	for t, e := range coverTypes {
+		if e == ext {
+			contentType = t
+		}
+	}
+	if _, err := hex.DecodeString(hash); err != nil || len(hash) != sha256.Size*2 || contentType == "" || strings.Contains(name, "/") {
+		http.NotFound(w, r)
+		return
+	}
+	etag := `"` + name + `"`
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	w.Header().Set("ETag", etag)
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	f, err := blobs.Open(r.Context(), "covers/"+name)
+	if err != nil {
+		w.Header().Del("Cache-Control")
+		if status, _ := errorStatus(err); status == http.StatusNotFound {
+			http.NotFound(w, r)
+			return
+		}
+		logFrom(r.Context()).WithError(err).WithField("func", "coverHandler").Error("could not open cover")
+		http.Error(w, "cover unavailable", http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	w.Header().Set("Content-Type", contentType)
+	if r.Method == http.MethodHead {
+		return
+	}
+	io.Copy(w, f)
+}
+
+// apiAlbumCoverHandler serves /api/albums/{id}/cover: PUT sets the cover from an image
+// request body (or a multipart "cover" file), DELETE takes it away
+func apiAlbumCoverHandler(w http.ResponseWriter, r *http.Request, albumID int64) {
+	ctx := r.Context()
+	switch r.Method {
+	case http.MethodPut:
+		var img *coverImage
+		var err error
+		if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/") {
+			img, err = coverFromRequest("apiAlbumCoverHandler", r)
+		} else {
+			var data []byte
+			if data, err = io.ReadAll(io.LimitReader(r.Body, int64(appCfg.CoverMaxSize)+1)); err != nil {
+				err = invalid("apiAlbumCoverHandler", "The image did not arrive: %v", err)
+			} else {
+				var prepared coverImage
+				if prepared, err = prepareCover("apiAlbumCoverHandler", data); err == nil {
+					img = &prepared
+				}
+			}
+		}
+		if err == nil && img == nil {
+			err = invalidFields("apiAlbumCoverHandler", map[string]string{"cover": "Choose an image file."})
+		}
+		if err != nil {
+			renderError(w, r, err)
+			return
+		}
+		cover, err := setCover(ctx, albumID, img)
+		if err != nil {
+			renderError(w, r, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, cover)
+	case http.MethodDelete:
+		if _, err := setCover(ctx, albumID, nil); err != nil {
+			renderError(w, r, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		methodNotAllowed(w, "PUT, DELETE")
+	}
+}
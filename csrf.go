@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// CSRF token names: the hidden form field, the header for scripts and the cookie for visitors without a session
+const (
+	csrfField  = "csrf_token"
+	csrfHeader = "X-CSRF-Token"
+	csrfCookie = "csrf"
+)
+
+// csrfKey is the context key for the request's CSRF token
+type csrfKey struct{}
+
+// withCSRFToken returns a copy of ctx carrying the token forms must send back
+func withCSRFToken(ctx context.Context, token string) context.Context {
+	return context.WithValue(ctx, csrfKey{}, token)
+}
+
+// csrfTokenFrom returns the request's CSRF token, or "" if there is none yet
+func csrfTokenFrom(ctx context.Context) string {
+	token, _ := ctx.Value(csrfKey{}).(string)
+	return token
+}
+
+// csrfProtect rejects state-changing requests that do not carry the CSRF token or come
+// from another site. Logged in users have a token per session (set by loadSession);
+// everyone else gets one in a cookie, so the login form is covered too.
+func csrfProtect(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isStaticPath(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ctx := r.Context()
+		token := csrfTokenFrom(ctx)
+		if token == "" && !strings.HasPrefix(r.URL.Path, "/api/") {
+			if c, err := r.Cookie(csrfCookie); err == nil && validCSRFToken(c.Value) {
+				token = c.Value
+			} else {
+				var err error
+				if token, err = randomToken(32); err != nil {
+					renderError(w, r, fmt.Errorf("csrfProtect: %v", err))
+					return
+				}
+				setCSRFCookie(w, token)
+			}
+			ctx = withCSRFToken(ctx, token)
+			r = r.WithContext(ctx)
+		}
+
+		if isSafeMethod(r.Method) || !usesCookies(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		l := logFrom(ctx).WithField("func", "csrfProtect")
+		if !sameOrigin(r) {
+			l.WithFields(log.Fields{"origin": r.Header.Get("Origin"), "referer": r.Referer()}).Warn("cross-site request blocked")
+			renderError(w, r, &Error{Kind: ErrForbidden, Op: "csrfProtect", Msg: "That request came from another site."})
+			return
+		}
+		sent := r.Header.Get(csrfHeader)
+		if sent == "" {
+			sent = r.PostFormValue(csrfField)
+		}
+		if subtle.ConstantTimeCompare([]byte(sent), []byte(token)) != 1 {
+			l.Warn("missing or wrong CSRF token")
+			renderError(w, r, &Error{Kind: ErrForbidden, Op: "csrfProtect", Msg: "This form has expired. Reload the page and try again."})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// usesCookies reports whether the browser could have attached credentials on its own.
+// API calls with no cookies at all, and anything sent with a Bearer token, cannot be
+// forged this way and skip the token check.
+func usesCookies(r *http.Request) bool {
+	if bearerToken(r) != "" {
+		return false
+	}
+	return !strings.HasPrefix(r.URL.Path, "/api/") || len(r.Cookies()) > 0
+}
+
+// sameOrigin checks the Origin header, falling back to the Referer, against the host
+// the request was sent to. Requests with neither are let through to the token check.
+func sameOrigin(r *http.Request) bool {
+	source := r.Header.Get("Origin")
+	if source == "null" {
+		// sandboxed frames and cross-site redirects
+		return false
+	}
+	if source == "" {
+		source = r.Referer()
+	}
+	if source == "" {
+		return true
+	}
+	u, err := url.Parse(source)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Host, r.Host)
+}
+
+// validCSRFToken reports whether a cookie value looks like one of our tokens
+func validCSRFToken(token string) bool {
+	if len(token) != 64 {
+		return false
+	}
+	return strings.Trim(token, "0123456789abcdef") == ""
+}
+
+// setCSRFCookie stores the token for visitors without a session. SameSite=Strict
+// keeps other sites from sending it at all.
+func setCSRFCookie(w http.ResponseWriter, token string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookie,
+		Value:    token,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   appCfg.CookieSecure,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	log "github.com/sirupsen/logrus"
+)
+
+// Backoff bounds for the startup connection retries
+const (
+	dbRetryMin = 500 * time.Millisecond
+	dbRetryMax = 10 * time.Second
+)
+
+// dbHealthy is false while the health monitor cannot reach the database
+var dbHealthy atomic.Bool
+
+// mysqlConfig builds the driver config from cfg
+func mysqlConfig(cfg Config) (*mysql.Config, error) {
+	my := mysql.NewConfig()
+	my.User = cfg.DBUser
+	my.Passwd = cfg.DBPass
+	my.Net = "tcp"
+	my.Addr = cfg.DBAddr
+	my.DBName = cfg.DBName
+	my.ParseTime = true
+	my.Timeout = 5 * time.Second
+	my.ReadTimeout = cfg.DBQueryTimeout
+	my.WriteTimeout = cfg.DBQueryTimeout
+	if err := configureMySQLTLS(cfg, my); err != nil {
+		return nil, err
+	}
+	return my, nil
+}
+
+// openDB opens the connection pool and waits for the server, retrying with exponential
+// backoff until cfg.DBConnectTimeout has passed
+func openDB(ctx context.Context, cfg Config) (*sql.DB, error) {
+	l := log.WithFields(log.Fields{"func": "openDB", "db_addr": cfg.DBAddr, "db_name": cfg.DBName})
+
+	my, err := mysqlConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	conn := sql.OpenDB(newDBConnector(my, true))
+	conn.SetMaxOpenConns(cfg.DBMaxOpenConns)
+	conn.SetMaxIdleConns(cfg.DBMaxIdleConns)
+	conn.SetConnMaxLifetime(cfg.DBConnMaxLifetime)
+
+	ctx, cancel := context.WithTimeout(ctx, cfg.DBConnectTimeout)
+	defer cancel()
+
+	wait := dbRetryMin
+	for attempt := 1; ; attempt++ {
+		err = conn.PingContext(ctx)
+		if err == nil {
+			dbHealthy.Store(true)
+			l.WithField("attempt", attempt).Info("connected to database")
+			return conn, nil
+		}
+		l.WithError(err).WithFields(log.Fields{"attempt": attempt, "retry_in": wait.String()}).Warn("database not ready")
+
+		select {
+		case <-ctx.Done():
+			conn.Close()
+			return nil, fmt.Errorf("openDB: gave up after %d attempts: %v", attempt, err)
+		case <-time.After(wait + time.Duration(rand.Int63n(int64(wait)/4))):
+		}
+		if wait *= 2; wait > dbRetryMax {
+			wait = dbRetryMax
+		}
+	}
+}
+
+// monitorDB pings the database every interval until ctx is done. database/sql
+// replaces broken connections on its own; the monitor only tracks whether the
+// server is reachable so requests can fail fast with a 503 during an outage.
+func monitorDB(ctx context.Context, conn *sql.DB, interval time.Duration) {
+	l := log.WithField("func", "monitorDB")
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		pingCtx, cancel := context.WithTimeout(ctx, interval)
+		err := conn.PingContext(pingCtx)
+		cancel()
+
+		healthy := err == nil
+		if dbHealthy.Swap(healthy) != healthy {
+			if healthy {
+				l.Info("database connection restored")
+			} else {
+				l.WithError(err).Error("database connection lost")
+			}
+		}
+	}
+}
+
+// requireDB answers 503 straight away while the database is known to be down,
+// except for static files and the health check
+func requireDB(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !dbHealthy.Load() && !isStaticPath(r.URL.Path) && r.URL.Path != "/healthz" {
+			renderError(w, r, &Error{Kind: ErrUnavailable, Op: "requireDB", Msg: "The database is unavailable, please try again shortly."})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// healthHandler reports whether the server can reach the database
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+	defer cancel()
+	if err := db.PingContext(ctx); err != nil {
+		logFrom(r.Context()).WithError(err).Warn("health check failed")
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "unavailable"})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Release detail limits; the lengths match the album columns
+const (
+	maxLabelLen       = 128
+	maxCatalogLen     = 32
+	maxNotesLen       = 2000
+	releaseDateLayout = "2006-01-02"
+)
+
+// AlbumFormat is the physical or digital format an album was released on
+type AlbumFormat string
+
+const (
+	FormatCD       AlbumFormat = "cd"
+	FormatVinyl    AlbumFormat = "vinyl"
+	FormatCassette AlbumFormat = "cassette"
+	FormatDigital  AlbumFormat = "digital"
+)
+
+// albumFormats lists the formats in the order the forms offer them
+var albumFormats = []AlbumFormat{FormatCD, FormatVinyl, FormatCassette, FormatDigital}
+
+// validAlbumFormat reports whether f is one of the formats
+func validAlbumFormat(f AlbumFormat) bool {
+	for _, have := range albumFormats {
+		if have == f {
+			return true
+		}
+	}
+	return false
+}
+
+// albumColumns selects an album row, aliased a, with NULL details and cover as empty strings.
+// Scan it with scanFields; the release date comes back as YYYY-MM-DD.
+const albumColumns = `a.id, a.title, a.artist, a.price, a.currency, COALESCE(CAST(a.release_date AS CHAR), ''), COALESCE(a.label, ''),
+	COALESCE(a.format, ''), COALESCE(a.catalog_number, ''), COALESCE(a.notes, ''), COALESCE(a.cover, ''), COALESCE(a.cover_type, '')`
+
+// scanFields are the scan destinations for albumColumns
+func (a *AlbumMap) scanFields() []interface{} {
+	return []interface{}{&a.ID, &a.Title, &a.Artist, &a.Price, &a.Price.Currency, &a.Released, &a.Label, &a.Format, &a.CatalogNumber, &a.Notes,
+		&a.Cover.Hash, &a.Cover.Type}
+}
+
+// scanFields are the scan destinations for albumColumns
+func (a *Album) scanFields() []interface{} {
+	return []interface{}{&a.ID, &a.Title, &a.Artist, &a.Price, &a.Price.Currency, &a.Released, &a.Label, &a.Format, &a.CatalogNumber, &a.Notes,
+		&a.Cover.Hash, &a.Cover.Type}
+}
+
+// normalizeNotes cleans up notes like normalizeText but keeps single line breaks,
+// dropping blank lines at the ends and collapsing runs of them to one
+func normalizeNotes(s string) string {
+	var lines []string
+	blank := false
+	for _, line := range strings.Split(strings.ReplaceAll(s, "\r\n", "\n"), "\n") {
+		line = normalizeText(line)
+		if line == "" {
+			blank = len(lines) > 0
+			continue
+		}
+		if blank {
+			lines = append(lines, "")
+			blank = false
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// normalizeDetails cleans up an album's release details
+func normalizeDetails(alb Album) Album {
+	alb.Released = strings.TrimSpace(alb.Released)
+	alb.Label = normalizeText(alb.Label)
+	alb.Format = AlbumFormat(strings.ToLower(strings.TrimSpace(string(alb.Format))))
+	alb.CatalogNumber = normalizeText(alb.CatalogNumber)
+	alb.Notes = normalizeNotes(alb.Notes)
+	return alb
+}
+
+// checkDetails records a message per bad release detail. All of them are optional, but
+// a catalog number only means something together with its label.
+func checkDetails(fields map[string]string, alb Album) {
+	if alb.Released != "" {
+		if _, err := time.Parse(releaseDateLayout, alb.Released); err != nil {
+			fields["released"] = fmt.Sprintf("%q is not a date, use YYYY-MM-DD.", alb.Released)
+		}
+	}
+	if alb.Label != "" {
+		checkText(fields, "label", "a label", alb.Label, maxLabelLen)
+	}
+	if alb.Format != "" && !validAlbumFormat(alb.Format) {
+		fields["format"] = fmt.Sprintf("%q is not a format, use one of %v.", alb.Format, albumFormats)
+	}
+	if alb.CatalogNumber != "" {
+		checkText(fields, "catalog_number", "a catalog number", alb.CatalogNumber, maxCatalogLen)
+		if alb.Label == "" && fields["label"] == "" {
+			fields["label"] = "Enter the label the catalog number belongs to."
+		}
+	}
+	if n := utf8.RuneCountInString(alb.Notes); n > maxNotesLen {
+		fields["notes"] = fmt.Sprintf("Keep the notes to %d characters (these are %d).", maxNotesLen, n)
+	}
+}
+
+// detailArgs are the release_date, label, format, catalog_number and notes values to store, NULL when empty
+func detailArgs(alb Album) []interface{} {
+	args := make([]interface{}, 0, 5)
+	for _, v := range []string{alb.Released, alb.Label, string(alb.Format), alb.CatalogNumber, alb.Notes} {
+		args = append(args, sql.NullString{String: v, Valid: v != ""})
+	}
+	return args
+}
+
+// catalogConflict turns the duplicate key error of an album insert or update into a
+// message on the catalog number, the only unique key of the album table
+func catalogConflict(op string, alb Album, err error) error {
+	if errors.Is(dbError(op, err), ErrConflict) {
+		return invalidFields(op, map[string]string{"catalog_number": fmt.Sprintf("%s already has an album with catalog number %s.", alb.Label, alb.CatalogNumber)})
+	}
+	return dbError(op, err)
+}
+
+// allLabels returns the labels in use, by name, for the search form and the add and edit forms
+func allLabels(ctx context.Context) ([]string, error) {
+	rows, err := readDB(ctx).QueryContext(ctx, "SELECT DISTINCT label FROM album WHERE label IS NOT NULL ORDER BY label;")
+	if err != nil {
+		return nil, dbError("allLabels", err)
+	}
+	defer rows.Close()
+	labels := []string{}
+	for rows.Next() {
+		var label string
+		if err := rows.Scan(&label); err != nil {
+			return nil, dbError("allLabels", err)
+		}
+		labels = append(labels, label)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, dbError("allLabels", err)
+	}
+	return labels, nil
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"runtime/debug"
+	"strings"
+
+	"github.com/go-sql-driver/mysql"
+	log "github.com/sirupsen/logrus"
+)
+
+// Domain error kinds. Data functions wrap them in *Error so handlers can pick a status code with errors.Is.
+var (
+	ErrNotFound        = errors.New("not found")
+	ErrValidation      = errors.New("invalid input")
+	ErrConflict        = errors.New("conflict")
+	ErrUnavailable     = errors.New("service unavailable")
+	ErrUnauthenticated = errors.New("not logged in")
+	ErrForbidden       = errors.New("forbidden")
+	ErrRateLimited     = errors.New("too many requests")
+	ErrTooLarge        = errors.New("request too large")
+)
+
+// Error is a typed domain error. Msg is safe to show to users, Err is the underlying cause (if any).
+// Validation errors can name the bad fields in Fields, keyed by form/JSON field name.
+type Error struct {
+	Kind   error
+	Op     string
+	Msg    string
+	Err    error
+	Fields map[string]string
+}
+
+func (e *Error) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("%s: %s: %v", e.Op, e.Msg, e.Err)
+	}
+	return fmt.Sprintf("%s: %s", e.Op, e.Msg)
+}
+
+func (e *Error) Unwrap() error { return e.Err }
+
+// Is reports whether target is the kind of e, so errors.Is(err, ErrNotFound) works through wrapping
+func (e *Error) Is(target error) bool { return target == e.Kind }
+
+// notFound returns an ErrNotFound error for op
+func notFound(op, format string, args ...interface{}) error {
+	return &Error{Kind: ErrNotFound, Op: op, Msg: fmt.Sprintf(format, args...)}
+}
+
+// invalid returns an ErrValidation error for op
+func invalid(op, format string, args ...interface{}) error {
+	return &Error{Kind: ErrValidation, Op: op, Msg: fmt.Sprintf(format, args...)}
+}
+
+// MySQL server error numbers we map to domain errors
+const (
+	mysqlDupEntry        = 1062
+	mysqlRowIsReferenced = 1451
+	mysqlNoReferencedRow = 1452
+)
+
+// dbError classifies an error returned by database/sql. Duplicate keys and foreign key
+// violations become ErrConflict, lost connections and timeouts become ErrUnavailable,
+// anything else is returned wrapped with op.
+func dbError(op string, err error) error {
+	if err == nil {
+		return nil
+	}
+	var myErr *mysql.MySQLError
+	if errors.As(err, &myErr) {
+		switch myErr.Number {
+		case mysqlDupEntry:
+			return &Error{Kind: ErrConflict, Op: op, Msg: "That record already exists.", Err: err}
+		case mysqlRowIsReferenced, mysqlNoReferencedRow:
+			return &Error{Kind: ErrConflict, Op: op, Msg: "That record is still used by other data.", Err: err}
+		}
+	}
+	var netErr net.Error
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, mysql.ErrInvalidConn) ||
+		errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr) {
+		return &Error{Kind: ErrUnavailable, Op: op, Msg: "The database is unavailable, please try again shortly.", Err: err}
+	}
+	return fmt.Errorf("%s: %w", op, err)
+}
+
+// errorStatus maps an error to its HTTP status code and machine readable code
+func errorStatus(err error) (int, string) {
+	switch {
+	case errors.Is(err, ErrNotFound):
+		return http.StatusNotFound, "not_found"
+	case errors.Is(err, ErrValidation):
+		return http.StatusBadRequest, "invalid_input"
+	case errors.Is(err, ErrConflict):
+		return http.StatusConflict, "conflict"
+	case errors.Is(err, ErrUnavailable):
+		return http.StatusServiceUnavailable, "unavailable"
+	case errors.Is(err, ErrUnauthenticated):
+		return http.StatusUnauthorized, "unauthenticated"
+	case errors.Is(err, ErrForbidden):
+		return http.StatusForbidden, "forbidden"
+	case errors.Is(err, ErrRateLimited):
+		return http.StatusTooManyRequests, "rate_limited"
+	case errors.Is(err, ErrTooLarge):
+		return http.StatusRequestEntityTooLarge, "too_large"
+	}
+	return http.StatusInternalServerError, "internal"
+}
+
+// errorMessage returns the user facing message for err; internal errors get a generic one
+func errorMessage(err error) string {
+	var e *Error
+	if errors.As(err, &e) && e.Msg != "" {
+		return e.Msg
+	}
+	return "Something went wrong on our side. Please try again."
+}
+
+// fieldErrors returns the per-field messages of a validation error, or nil
+func fieldErrors(err error) map[string]string {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Fields
+	}
+	return nil
+}
+
+// wantsJSON reports whether the client should get a JSON error rather than an HTML page
+func wantsJSON(r *http.Request) bool {
+	if strings.HasPrefix(r.URL.Path, "/api/") {
+		return true
+	}
+	accept := r.Header.Get("Accept")
+	return strings.Contains(accept, "application/json") && !strings.Contains(accept, "text/html")
+}
+
+// renderError logs err and writes it as a JSON error for API clients or a friendly error page
+func renderError(w http.ResponseWriter, r *http.Request, err error) {
+	status, code := errorStatus(err)
+	l := logFrom(r.Context()).WithError(err).WithField("status", status)
+	if status >= http.StatusInternalServerError {
+		l.Error("request failed")
+	} else {
+		l.Warn("request rejected")
+	}
+
+	msg := errorMessage(err)
+	requestID := w.Header().Get(requestIDHeader)
+	if status == http.StatusServiceUnavailable {
+		w.Header().Set("Retry-After", "5")
+	}
+	if wantsJSON(r) {
+		body := map[string]interface{}{"code": code, "message": msg, "request_id": requestID}
+		if fields := fieldErrors(err); len(fields) > 0 {
+			body["fields"] = fields
+		}
+		writeJSON(w, status, map[string]interface{}{"error": body})
+		return
+	}
+
+	tmpl, tmplErr := parseTemplate(r, "error.html")
+	if tmplErr != nil {
+		l.WithError(tmplErr).Error("parse error template")
+		http.Error(w, msg, status)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	tmpl.Execute(w, struct {
+		Status    int
+		Title     string
+		Message   string
+		Fields    map[string]string
+		RequestID string
+	}{status, http.StatusText(status), msg, fieldErrors(err), requestID})
+}
+
+// writeJSON writes v as a JSON response with the given status
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// recoverPanics turns a panicking handler into a 500 response instead of a dead connection
+func recoverPanics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			p := recover()
+			if p == nil {
+				return
+			}
+			if p == http.ErrAbortHandler {
+				panic(p)
+			}
+			logFrom(r.Context()).WithFields(log.Fields{"panic": p, "stack": string(debug.Stack())}).Error("handler panicked")
+			renderError(w, r, fmt.Errorf("panic: %v", p))
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,791 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Genre and tag limits; the lengths match the name columns
+const (
+	maxGenreLen    = 64
+	maxTagLen      = 64
+	maxAlbumGenres = 10
+	maxAlbumTags   = 20
+)
+
+// Genre is a node of the genre tree. Depth is 0 for top-level genres; Albums counts
+// the albums filed under the genre or any genre below it.
+type Genre struct {
+	ID       int64  `json:"id"`
+	Name     string `json:"name"`
+	ParentID int64  `json:"parent_id,omitempty"`
+	Depth    int    `json:"depth"`
+	Albums   int    `json:"albums"`
+}
+
+// Label is the genre name indented by its depth, for select options and lists
+func (g Genre) Label() string {
+	return strings.Repeat("— ", g.Depth) + g.Name
+}
+
+// TagCount is a tag and how many albums carry it. Size is the Bootstrap fs-N class
+// the tag cloud shows it with, 1 for the most used tags.
+type TagCount struct {
+	Name   string `json:"name"`
+	Albums int    `json:"albums"`
+	Size   int    `json:"-"`
+}
+
+// AlbumFilter narrows album listings to a genre (and the genres below it), a tag, a label,
+// a format, a release year, a price range and/or a lowest average rating. Sort is the
+// order to list them in, one of albumSorts, or "" for by title.
+type AlbumFilter struct {
+	Genre     string
+	Tag       string
+	Label     string
+	Format    AlbumFormat
+	Year      int
+	MinPrice  Money
+	MaxPrice  Money
+	MinRating int
+	Sort      string
+}
+
+// active reports whether the filter narrows anything
+func (f AlbumFilter) active() bool {
+	return f.Genre != "" || f.Tag != "" || f.Label != "" || f.Format != "" || f.Year != 0 ||
+		!f.MinPrice.IsZero() || !f.MaxPrice.IsZero() || f.MinRating != 0
+}
+
+// albumFilter reads the genre, tag, label, format, year, min_price, max_price, min_rating and sort
+// parameters through get, which is r.FormValue for pages or a query's Get for the API. The prices are in cur.
+func albumFilter(op string, get func(string) string, cur Currency) (AlbumFilter, error) {
+	f := AlbumFilter{Genre: get("genre"), Tag: get("tag"), Label: get("label"), Format: AlbumFormat(get("format"))}
+	if y := strings.TrimSpace(get("year")); y != "" {
+		year, err := strconv.Atoi(y)
+		if err != nil || year < 1 || year > 9999 {
+			return f, invalid(op, "%q is not a year.", y)
+		}
+		f.Year = year
+	}
+	for _, p := range []struct {
+		name string
+		dest *Money
+	}{{"min_price", &f.MinPrice}, {"max_price", &f.MaxPrice}} {
+		if v := strings.TrimSpace(get(p.name)); v != "" {
+			m, ok := parseMoney(v, cur)
+			if !ok || m.Cents < 0 {
+				return f, invalid(op, "%q is not a price.", v)
+			}
+			*p.dest = m
+		}
+	}
+	if v := strings.TrimSpace(get("min_rating")); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < minRating || n > maxRating {
+			return f, invalid(op, "%q is not a rating, use %d to %d.", v, minRating, maxRating)
+		}
+		f.MinRating = n
+	}
+	if f.Sort = get("sort"); f.Sort != "" && !validSort(f.Sort) {
+		return f, invalid(op, "Albums can't be sorted by %q, use one of %s.", f.Sort, strings.Join(albumSorts, ", "))
+	}
+	return f, nil
+}
+
+// normalizeNames cleans up genre or tag names, dropping blanks and repeats that differ only
+// in case. nil stays nil, so an update can tell "leave alone" from "clear".
+func normalizeNames(names []string) []string {
+	if names == nil {
+		return nil
+	}
+	res := []string{}
+	seen := make(map[string]bool)
+	for _, n := range names {
+		n = normalizeText(n)
+		if n == "" || seen[strings.ToLower(n)] {
+			continue
+		}
+		seen[strings.ToLower(n)] = true
+		res = append(res, n)
+	}
+	return res
+}
+
+// splitTags reads the comma separated tags field of the add and edit forms
+func splitTags(s string) []string {
+	return normalizeNames(strings.Split(s, ","))
+}
+
+// checkGenresAndTags records a message under "genre" or "tags" when an album's genres or tags are not usable
+func checkGenresAndTags(fields map[string]string, genres, tags []string) {
+	if len(genres) > maxAlbumGenres {
+		fields["genre"] = fmt.Sprintf("File the album under at most %d genres.", maxAlbumGenres)
+	}
+	for _, g := range genres {
+		if utf8.RuneCountInString(g) > maxGenreLen {
+			fields["genre"] = fmt.Sprintf("There is no genre %q.", g)
+		}
+	}
+	if len(tags) > maxAlbumTags {
+		fields["tags"] = fmt.Sprintf("Use at most %d tags.", maxAlbumTags)
+		return
+	}
+	for _, t := range tags {
+		switch {
+		case strings.Contains(t, ","):
+			fields["tags"] = fmt.Sprintf("Tags cannot contain commas (%q).", t)
+		case utf8.RuneCountInString(t) > maxTagLen:
+			fields["tags"] = fmt.Sprintf("Keep each tag to %d characters (%q is longer).", maxTagLen, t)
+		}
+	}
+}
+
+// allGenres returns the genre tree depth first, each genre's sub-genres by name after it
+func allGenres(ctx context.Context) ([]Genre, error) {
+	rows, err := readDB(ctx).QueryContext(ctx, "SELECT id, name, COALESCE(parent_id, 0) FROM genres ORDER BY name;")
+	if err != nil {
+		return nil, dbError("allGenres", err)
+	}
+	defer rows.Close()
+	children := make(map[int64][]Genre)
+	for rows.Next() {
+		var g Genre
+		if err := rows.Scan(&g.ID, &g.Name, &g.ParentID); err != nil {
+			return nil, dbError("allGenres", err)
+		}
+		children[g.ParentID] = append(children[g.ParentID], g)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, dbError("allGenres", err)
+	}
+	genres := []Genre{}
+	var walk func(parent int64, depth int)
+	walk = func(parent int64, depth int) {
+		for _, g := range children[parent] {
+			g.Depth = depth
+			genres = append(genres, g)
+			walk(g.ID, depth+1)
+		}
+	}
+	walk(0, 0)
+	return genres, nil
+}
+
+// genreTree is allGenres with the number of albums under each genre filled in.
+// An album filed under both Jazz and Bebop counts once for Jazz.
+func genreTree(ctx context.Context) ([]Genre, error) {
+	genres, err := allGenres(ctx)
+	if err != nil {
+		return nil, err
+	}
+	parent := make(map[int64]int64, len(genres))
+	index := make(map[int64]int, len(genres))
+	for i, g := range genres {
+		parent[g.ID], index[g.ID] = g.ParentID, i
+	}
+	rows, err := readDB(ctx).QueryContext(ctx, "SELECT album_id, genre_id FROM album_genres ORDER BY album_id;")
+	if err != nil {
+		return nil, dbError("genreTree", err)
+	}
+	defer rows.Close()
+	var current int64
+	counted := make(map[int64]bool)
+	for rows.Next() {
+		var albumID, genreID int64
+		if err := rows.Scan(&albumID, &genreID); err != nil {
+			return nil, dbError("genreTree", err)
+		}
+		if albumID != current {
+			current, counted = albumID, make(map[int64]bool)
+		}
+		for id := genreID; id != 0 && !counted[id]; id = parent[id] {
+			counted[id] = true
+			if i, ok := index[id]; ok {
+				genres[i].Albums++
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, dbError("genreTree", err)
+	}
+	return genres, nil
+}
+
+// findGenre looks a genre up by name, ignoring case like the database does
+func findGenre(genres []Genre, name string) (Genre, bool) {
+	name = normalizeText(name)
+	for _, g := range genres {
+		if strings.EqualFold(g.Name, name) {
+			return g, true
+		}
+	}
+	return Genre{}, false
+}
+
+// subtreeIDs returns the id of a genre and of every genre below it
+func subtreeIDs(genres []Genre, id int64) []int64 {
+	ids := []int64{id}
+	for i := 0; i < len(ids); i++ {
+		for _, g := range genres {
+			if g.ParentID == ids[i] {
+				ids = append(ids, g.ID)
+			}
+		}
+	}
+	return ids
+}
+
+// filterConds turns f into WHERE conditions on album a, with their arguments.
+// A genre filter also matches albums filed under its sub-genres.
+func filterConds(ctx context.Context, f AlbumFilter) ([]string, []interface{}, error) {
+	var conds []string
+	var args []interface{}
+	if f.Genre != "" {
+		genres, err := allGenres(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+		g, ok := findGenre(genres, f.Genre)
+		if !ok {
+			return nil, nil, notFound("filterConds", "There is no genre %q.", f.Genre)
+		}
+		ids := subtreeIDs(genres, g.ID)
+		conds = append(conds, "a.id IN (SELECT album_id FROM album_genres WHERE genre_id IN (?"+strings.Repeat(", ?", len(ids)-1)+"))")
+		for _, id := range ids {
+			args = append(args, id)
+		}
+	}
+	if f.Tag != "" {
+		conds = append(conds, "a.id IN (SELECT atg.album_id FROM album_tags atg JOIN tags t ON t.id = atg.tag_id WHERE t.name = ?)")
+		args = append(args, normalizeText(f.Tag))
+	}
+	if f.Label != "" {
+		conds = append(conds, "a.label = ?")
+		args = append(args, normalizeText(f.Label))
+	}
+	if f.Format != "" {
+		conds = append(conds, "a.format = ?")
+		args = append(args, f.Format)
+	}
+	if f.Year != 0 {
+		// a range rather than YEAR() so the release_date index is used
+		conds = append(conds, "a.release_date >= ? AND a.release_date < ?")
+		args = append(args, fmt.Sprintf("%04d-01-01", f.Year), fmt.Sprintf("%04d-01-01", f.Year+1))
+	}
+	if !f.MinPrice.IsZero() || !f.MaxPrice.IsZero() {
+		// the range is in the currency the prices are shown in, so it becomes the range of
+		// base prices that come out inside it at today's rates
+		rates, err := currentRates(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+		lo, hi, err := rates.baseRange(f.MinPrice, f.MaxPrice)
+		if err != nil {
+			return nil, nil, err
+		}
+		conds = append(conds, "a.currency = ?")
+		args = append(args, appCfg.BaseCurrency)
+		if lo >= 0 {
+			conds = append(conds, "a.price >= CAST(? AS DECIMAL(10,2))")
+			args = append(args, Money{Cents: lo})
+		}
+		if hi >= 0 {
+			conds = append(conds, "a.price <= CAST(? AS DECIMAL(10,2))")
+			args = append(args, Money{Cents: hi})
+		}
+	}
+	if f.MinRating != 0 {
+		conds = append(conds, "a.id IN (SELECT album_id FROM reviews WHERE hidden = FALSE GROUP BY album_id HAVING AVG(rating) >= ?)")
+		args = append(args, f.MinRating)
+	}
+	return conds, args, nil
+}
+
+// albumsByFilter lists the albums matching f in f.Sort order, at most limit of them (0 for all)
+func albumsByFilter(ctx context.Context, f AlbumFilter, limit int) ([]AlbumMap, error) {
+	conds, args, err := filterConds(ctx, f)
+	if err != nil {
+		return nil, err
+	}
+	join, order := ratingOrder(f.Sort)
+	query := "SELECT " + albumColumns + " FROM album a" + join
+	if len(conds) > 0 {
+		query += " WHERE " + strings.Join(conds, " AND ")
+	}
+	query += order
+	if limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, limit)
+	}
+	rows, err := readDB(ctx).QueryContext(ctx, query+";", args...)
+	if err != nil {
+		return nil, dbError("albumsByFilter", err)
+	}
+	defer rows.Close()
+	albums := []AlbumMap{}
+	for rows.Next() {
+		var alb AlbumMap
+		if err := rows.Scan(alb.scanFields()...); err != nil {
+			return nil, dbError("albumsByFilter", err)
+		}
+		albums = append(albums, alb)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, dbError("albumsByFilter", err)
+	}
+	logFrom(ctx).WithFields(log.Fields{"func": "albumsByFilter", "genre": f.Genre, "tag": f.Tag, "label": f.Label, "format": f.Format,
+		"year": f.Year, "min_price": f.MinPrice, "max_price": f.MaxPrice,
+		"min_rating": f.MinRating, "sort": f.Sort, "count": len(albums)}).Debug("fetched filtered albums")
+	return albums, nil
+}
+
+// filterAlbums keeps the albums that also match f, in their order
+func filterAlbums(ctx context.Context, albums []AlbumMap, f AlbumFilter) ([]AlbumMap, error) {
+	if !f.active() || len(albums) == 0 {
+		return albums, nil
+	}
+	conds, args, err := filterConds(ctx, f)
+	if err != nil {
+		return nil, err
+	}
+	conds = append(conds, "a.id IN (?"+strings.Repeat(", ?", len(albums)-1)+")")
+	for _, a := range albums {
+		args = append(args, a.ID)
+	}
+	rows, err := readDB(ctx).QueryContext(ctx, "SELECT a.id FROM album a WHERE "+strings.Join(conds, " AND ")+";", args...)
+	if err != nil {
+		return nil, dbError("filterAlbums", err)
+	}
+	defer rows.Close()
+	match := make(map[int64]bool)
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, dbError("filterAlbums", err)
+		}
+		match[id] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, dbError("filterAlbums", err)
+	}
+	res := []AlbumMap{}
+	for _, a := range albums {
+		if match[a.ID] {
+			res = append(res, a)
+		}
+	}
+	return res, nil
+}
+
+// resolveGenres looks up the genres an album is filed under, inside the caller's transaction.
+// Genres are never created here; an unknown name is an error on the "genre" field.
+func resolveGenres(ctx context.Context, tx *sql.Tx, names []string) ([]int64, []string, error) {
+	var ids []int64
+	var res []string
+	for _, name := range names {
+		var id int64
+		var canonical string
+		err := tx.QueryRowContext(ctx, "SELECT id, name FROM genres WHERE name = ?;", name).Scan(&id, &canonical)
+		if err == sql.ErrNoRows {
+			return nil, nil, invalidFields("resolveGenres", map[string]string{"genre": fmt.Sprintf("There is no genre %q.", name)})
+		} else if err != nil {
+			return nil, nil, dbError("resolveGenres", err)
+		}
+		ids, res = append(ids, id), append(res, canonical)
+	}
+	return ids, res, nil
+}
+
+// resolveTags finds or creates each tag, inside the caller's transaction, taking the spelling already stored
+func resolveTags(ctx context.Context, tx *sql.Tx, names []string) ([]int64, []string, error) {
+	var ids []int64
+	var res []string
+	for _, name := range names {
+		result, err := tx.ExecContext(ctx, "INSERT INTO tags (name) VALUES (?) ON DUPLICATE KEY UPDATE id = LAST_INSERT_ID(id);", name)
+		if err != nil {
+			return nil, nil, dbError("resolveTags", err)
+		}
+		id, err := result.LastInsertId()
+		if err != nil {
+			return nil, nil, dbError("resolveTags", err)
+		}
+		if err := tx.QueryRowContext(ctx, "SELECT name FROM tags WHERE id = ?;", id).Scan(&name); err != nil {
+			return nil, nil, dbError("resolveTags", err)
+		}
+		ids, res = append(ids, id), append(res, name)
+	}
+	return ids, res, nil
+}
+
+// saveGenresAndTags files an album under its genres and tags, inside the caller's
+// transaction, and returns their stored spellings. A nil list is left as it is.
+func saveGenresAndTags(ctx context.Context, tx *sql.Tx, albumID int64, genres, tags []string) ([]string, []string, error) {
+	if genres != nil {
+		ids, names, err := resolveGenres(ctx, tx, genres)
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := replaceLinks(ctx, tx, "album_genres", "genre_id", albumID, ids); err != nil {
+			return nil, nil, err
+		}
+		genres = names
+	}
+	if tags != nil {
+		ids, names, err := resolveTags(ctx, tx, tags)
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := replaceLinks(ctx, tx, "album_tags", "tag_id", albumID, ids); err != nil {
+			return nil, nil, err
+		}
+		tags = names
+	}
+	return genres, tags, nil
+}
+
+// replaceLinks replaces the rows of a link table (album_genres or album_tags) for an album
+func replaceLinks(ctx context.Context, tx *sql.Tx, table, column string, albumID int64, ids []int64) error {
+	if _, err := tx.ExecContext(ctx, "DELETE FROM "+table+" WHERE album_id = ?;", albumID); err != nil {
+		return dbError("replaceLinks", err)
+	}
+	for _, id := range ids {
+		// resolving two spellings of one tag gives the same id twice
+		if _, err := tx.ExecContext(ctx, "INSERT IGNORE INTO "+table+" (album_id, "+column+") VALUES (?, ?);", albumID, id); err != nil {
+			return dbError("replaceLinks", err)
+		}
+	}
+	return nil
+}
+
+// albumGenresAndTags loads the genre and tag names of the given albums, each sorted by name, keyed by album id
+func albumGenresAndTags(ctx context.Context, q queryer, ids []int64) (map[int64][]string, map[int64][]string, error) {
+	genres, err := namesByAlbum(ctx, q, "SELECT ag.album_id, g.name FROM album_genres ag JOIN genres g ON g.id = ag.genre_id", "ag", ids)
+	if err != nil {
+		return nil, nil, err
+	}
+	tags, err := namesByAlbum(ctx, q, "SELECT atg.album_id, t.name FROM album_tags atg JOIN tags t ON t.id = atg.tag_id", "atg", ids)
+	if err != nil {
+		return nil, nil, err
+	}
+	return genres, tags, nil
+}
+
+// namesByAlbum runs one of the albumGenresAndTags queries for the given albums
+func namesByAlbum(ctx context.Context, q queryer, query, alias string, ids []int64) (map[int64][]string, error) {
+	names := make(map[int64][]string, len(ids))
+	if len(ids) == 0 {
+		return names, nil
+	}
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	rows, err := q.QueryContext(ctx, query+" WHERE "+alias+".album_id IN (?"+strings.Repeat(", ?", len(ids)-1)+") ORDER BY 1, 2;", args...)
+	if err != nil {
+		return nil, dbError("namesByAlbum", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var albumID int64
+		var name string
+		if err := rows.Scan(&albumID, &name); err != nil {
+			return nil, dbError("namesByAlbum", err)
+		}
+		names[albumID] = append(names[albumID], name)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, dbError("namesByAlbum", err)
+	}
+	return names, nil
+}
+
+// attachGenresAndTags fills in the Genres and Tags of each album, for listings, the API and exports
+func attachGenresAndTags(ctx context.Context, albums []AlbumMap) error {
+	ids := make([]int64, len(albums))
+	for i, a := range albums {
+		ids[i] = a.ID
+	}
+	genres, tags, err := albumGenresAndTags(ctx, readDB(ctx), ids)
+	if err != nil {
+		return err
+	}
+	for i := range albums {
+		albums[i].Genres, albums[i].Tags = genres[albums[i].ID], tags[albums[i].ID]
+	}
+	return nil
+}
+
+// tagCloud lists the tags in use by name with how many albums carry each, sized for the cloud
+func tagCloud(ctx context.Context) ([]TagCount, error) {
+	rows, err := readDB(ctx).QueryContext(ctx, `SELECT t.name, COUNT(*) FROM tags t JOIN album_tags atg ON atg.tag_id = t.id
+		GROUP BY t.id, t.name ORDER BY t.name;`)
+	if err != nil {
+		return nil, dbError("tagCloud", err)
+	}
+	defer rows.Close()
+	tags := []TagCount{}
+	least, most := 0, 0
+	for rows.Next() {
+		var t TagCount
+		if err := rows.Scan(&t.Name, &t.Albums); err != nil {
+			return nil, dbError("tagCloud", err)
+		}
+		if len(tags) == 0 || t.Albums < least {
+			least = t.Albums
+		}
+		if t.Albums > most {
+			most = t.Albums
+		}
+		tags = append(tags, t)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, dbError("tagCloud", err)
+	}
+	// five sizes, fs-5 for the least used up to fs-1 for the most
+	for i := range tags {
+		tags[i].Size = 3
+		if most > least {
+			tags[i].Size = 5 - 4*(tags[i].Albums-least)/(most-least)
+		}
+	}
+	return tags, nil
+}
+
+// genreID looks up a genre by name inside a transaction, locking it
+func genreID(ctx context.Context, tx *sql.Tx, op, name string) (int64, error) {
+	var id int64
+	err := tx.QueryRowContext(ctx, "SELECT id FROM genres WHERE name = ? FOR UPDATE;", normalizeText(name)).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, notFound(op, "There is no genre %q.", name)
+	}
+	return id, dbError(op, err)
+}
+
+// checkGenreName normalizes a new genre name and checks it
+func checkGenreName(op, name string) (string, error) {
+	name = normalizeText(name)
+	fields := make(map[string]string)
+	checkText(fields, "name", "a genre name", name, maxGenreLen)
+	if len(fields) > 0 {
+		return name, invalidFields(op, fields)
+	}
+	return name, nil
+}
+
+// genreConflict explains a duplicate genre name
+func genreConflict(op, name string, err error) error {
+	if errors.Is(dbError(op, err), ErrConflict) {
+		return &Error{Kind: ErrConflict, Op: op, Msg: fmt.Sprintf("There is already a genre called %s.", name), Err: err}
+	}
+	return dbError(op, err)
+}
+
+// addGenre creates a genre, top-level when parent is empty
+func addGenre(ctx context.Context, name, parent string) (int64, error) {
+	name, err := checkGenreName("addGenre", name)
+	if err != nil {
+		return 0, err
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, dbError("addGenre", err)
+	}
+	defer tx.Rollback()
+
+	var parentID sql.NullInt64
+	if parent != "" {
+		if parentID.Int64, err = genreID(ctx, tx, "addGenre", parent); err != nil {
+			return 0, err
+		}
+		parentID.Valid = true
+	}
+	result, err := tx.ExecContext(ctx, "INSERT INTO genres (name, parent_id) VALUES (?, ?);", name, parentID)
+	if err != nil {
+		return 0, genreConflict("addGenre", name, err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, dbError("addGenre", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, dbError("addGenre", err)
+	}
+	logFrom(ctx).WithFields(log.Fields{"func": "addGenre", "genre_id": id, "genre": name, "parent": parent}).Info("added genre")
+	return id, nil
+}
+
+// renameGenre corrects a genre's name
+func renameGenre(ctx context.Context, name, newName string) error {
+	newName, err := checkGenreName("renameGenre", newName)
+	if err != nil {
+		return err
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return dbError("renameGenre", err)
+	}
+	defer tx.Rollback()
+
+	id, err := genreID(ctx, tx, "renameGenre", name)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE genres SET name = ? WHERE id = ?;", newName, id); err != nil {
+		return genreConflict("renameGenre", newName, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return dbError("renameGenre", err)
+	}
+	logFrom(ctx).WithFields(log.Fields{"func": "renameGenre", "genre_id": id, "genre": newName}).Info("renamed genre")
+	return nil
+}
+
+// moveGenre puts a genre, with everything below it, under another genre or at the top when parent is empty
+func moveGenre(ctx context.Context, name, parent string) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return dbError("moveGenre", err)
+	}
+	defer tx.Rollback()
+
+	id, err := genreID(ctx, tx, "moveGenre", name)
+	if err != nil {
+		return err
+	}
+	var parentID sql.NullInt64
+	if parent != "" {
+		if parentID.Int64, err = genreID(ctx, tx, "moveGenre", parent); err != nil {
+			return err
+		}
+		parentID.Valid = true
+		// walk up from the new parent; meeting the genre itself would make a loop
+		for p := parentID.Int64; p != 0; {
+			if p == id {
+				return invalid("moveGenre", "%s cannot go under itself or one of its own sub-genres.", name)
+			}
+			var up sql.NullInt64
+			if err := tx.QueryRowContext(ctx, "SELECT parent_id FROM genres WHERE id = ?;", p).Scan(&up); err != nil {
+				return dbError("moveGenre", err)
+			}
+			p = up.Int64
+		}
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE genres SET parent_id = ? WHERE id = ?;", parentID, id); err != nil {
+		return dbError("moveGenre", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return dbError("moveGenre", err)
+	}
+	logFrom(ctx).WithFields(log.Fields{"func": "moveGenre", "genre_id": id, "parent": parent}).Info("moved genre")
+	return nil
+}
+
+// deleteGenre deletes a genre with no sub-genres; its albums are no longer filed under it
+func deleteGenre(ctx context.Context, name string) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return dbError("deleteGenre", err)
+	}
+	defer tx.Rollback()
+
+	id, err := genreID(ctx, tx, "deleteGenre", name)
+	if err != nil {
+		return err
+	}
+	var children int
+	if err := tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM genres WHERE parent_id = ?;", id).Scan(&children); err != nil {
+		return dbError("deleteGenre", err)
+	}
+	if children > 0 {
+		return &Error{Kind: ErrConflict, Op: "deleteGenre", Msg: fmt.Sprintf("%s has %d sub-genres; move or delete them first.", name, children)}
+	}
+	rows, err := tx.QueryContext(ctx, "SELECT album_id FROM album_genres WHERE genre_id = ? FOR UPDATE;", id)
+	if err != nil {
+		return dbError("deleteGenre", err)
+	}
+	var albumIDs []int64
+	for rows.Next() {
+		var albumID int64
+		if err := rows.Scan(&albumID); err != nil {
+			rows.Close()
+			return dbError("deleteGenre", err)
+		}
+		albumIDs = append(albumIDs, albumID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return dbError("deleteGenre", err)
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM genres WHERE id = ?;", id); err != nil {
+		return dbError("deleteGenre", err)
+	}
+	for _, albumID := range albumIDs {
+		if err := recordChange(ctx, tx, albumID, "update"); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return dbError("deleteGenre", err)
+	}
+	logFrom(ctx).WithFields(log.Fields{"func": "deleteGenre", "genre_id": id, "genre": name, "count": len(albumIDs)}).Info("deleted genre")
+	return nil
+}
+
+// tagsPage is the data for tags.html
+type tagsPage struct {
+	Tags   []TagCount
+	Genres []Genre
+}
+
+// tagsHandler shows the tag cloud and the genre tree, each with album counts
+func tagsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	tags, err := tagCloud(ctx)
+	if err != nil {
+		renderError(w, r, err)
+		return
+	}
+	genres, err := genreTree(ctx)
+	if err != nil {
+		renderError(w, r, err)
+		return
+	}
+	render(w, r, "tags.html", tagsPage{Tags: tags, Genres: genres})
+}
+
+// apiTagsHandler serves GET /api/tags: the tags in use with their album counts
+func apiTagsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, "GET")
+		return
+	}
+	tags, err := tagCloud(r.Context())
+	if err != nil {
+		renderError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, tags)
+}
+
+// apiGenresHandler serves GET /api/genres: the genre tree depth first, with album counts
+func apiGenresHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, "GET")
+		return
+	}
+	genres, err := genreTree(r.Context())
+	if err != nil {
+		renderError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, genres)
+}
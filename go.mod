@@ -2,9 +2,11 @@ module example/data-access
 
 go 1.19
 
-require github.com/go-sql-driver/mysql v1.6.0
-
 require (
-	github.com/sirupsen/logrus v1.9.0 // indirect
-	golang.org/x/sys v0.0.0-20220715151400-c0bba94af5f8 // indirect
+	github.com/go-sql-driver/mysql v1.6.0
+	github.com/sirupsen/logrus v1.9.0
+	golang.org/x/crypto v0.10.0
+	golang.org/x/text v0.13.0
 )
+
+require golang.org/x/sys v0.9.0 // indirect
@@ -0,0 +1,936 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// List limits; the name length matches the lists.name column
+const (
+	maxListNameLen = 64
+	maxUserLists   = 50
+	maxListAlbums  = 1000
+)
+
+// ListKind tells the lists every account has from the ones users make themselves
+type ListKind string
+
+const (
+	ListFavorites ListKind = "favorites"
+	ListWishlist  ListKind = "wishlist"
+	ListCustom    ListKind = "custom"
+)
+
+// defaultLists are the lists every account starts with; they can't be renamed or deleted
+var defaultLists = []List{{Name: "Favorites", Kind: ListFavorites}, {Name: "Wishlist", Kind: ListWishlist}}
+
+// List is a user's named list of albums, in the order they keep it. Count is how many albums
+// are on it; Albums holds them when the list was loaded with its albums.
+type List struct {
+	ID        int64      `json:"id"`
+	UserID    int64      `json:"user_id"`
+	Username  string     `json:"username"`
+	Name      string     `json:"name"`
+	Kind      ListKind   `json:"kind"`
+	Count     int        `json:"count"`
+	CreatedAt time.Time  `json:"created_at"`
+	Albums    []ListItem `json:"albums,omitempty"`
+}
+
+// Custom reports whether the user made the list, so they may rename and delete it
+func (l List) Custom() bool {
+	return l.Kind == ListCustom
+}
+
+// ListItem is an album on a list at its position, counting from 1
+type ListItem struct {
+	AlbumMap
+	Position int       `json:"position"`
+	AddedAt  time.Time `json:"added_at"`
+}
+
+// listColumns selects a list, aliased l, with its owner's name and album count
+const listColumns = `l.id, l.user_id, u.username, l.name, l.kind, l.created_at,
+	(SELECT COUNT(*) FROM list_albums la WHERE la.list_id = l.id) FROM lists l JOIN users u ON u.id = l.user_id`
+
+// scanFields are the scan destinations for listColumns
+func (l *List) scanFields() []interface{} {
+	return []interface{}{&l.ID, &l.UserID, &l.Username, &l.Name, &l.Kind, &l.CreatedAt, &l.Count}
+}
+
+// createDefaultLists gives a new account its favorites and wishlist, inside the caller's transaction
+func createDefaultLists(ctx context.Context, tx *sql.Tx, userID int64) error {
+	for _, l := range defaultLists {
+		if _, err := tx.ExecContext(ctx, "INSERT INTO lists (user_id, name, kind) VALUES (?, ?, ?);", userID, l.Name, l.Kind); err != nil {
+			return dbError("createDefaultLists", err)
+		}
+	}
+	return nil
+}
+
+// userLists returns a user's lists without their albums: favorites, the wishlist, then the rest by name
+func userLists(ctx context.Context, userID int64) ([]List, error) {
+	rows, err := readDB(ctx).QueryContext(ctx, "SELECT "+listColumns+`
+		WHERE l.user_id = ? ORDER BY FIELD(l.kind, 'favorites', 'wishlist', 'custom'), l.name, l.id;`, userID)
+	if err != nil {
+		return nil, dbError("userLists", err)
+	}
+	defer rows.Close()
+	lists := []List{}
+	for rows.Next() {
+		var l List
+		if err := rows.Scan(l.scanFields()...); err != nil {
+			return nil, dbError("userLists", err)
+		}
+		lists = append(lists, l)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, dbError("userLists", err)
+	}
+	return lists, nil
+}
+
+// listByID returns a list with its albums in order
+func listByID(ctx context.Context, id int64) (List, error) {
+	var l List
+	err := readDB(ctx).QueryRowContext(ctx, "SELECT "+listColumns+" WHERE l.id = ?;", id).Scan(l.scanFields()...)
+	if err == sql.ErrNoRows {
+		return l, notFound("listByID", "There is no list with id %d.", id)
+	}
+	if err != nil {
+		return l, dbError("listByID", err)
+	}
+	items, err := listItems(ctx, []int64{id})
+	if err != nil {
+		return l, err
+	}
+	l.Albums = items[id]
+	return l, nil
+}
+
+// attachListItems loads the albums of each list
+func attachListItems(ctx context.Context, lists []List) error {
+	ids := make([]int64, len(lists))
+	for i, l := range lists {
+		ids[i] = l.ID
+	}
+	items, err := listItems(ctx, ids)
+	if err != nil {
+		return err
+	}
+	for i := range lists {
+		lists[i].Albums = items[lists[i].ID]
+	}
+	return nil
+}
+
+// listItems loads the albums on the given lists in their order, with their credits, genres and
+// tags, keyed by list id
+func listItems(ctx context.Context, ids []int64) (map[int64][]ListItem, error) {
+	items := make(map[int64][]ListItem, len(ids))
+	if len(ids) == 0 {
+		return items, nil
+	}
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	rows, err := readDB(ctx).QueryContext(ctx, "SELECT la.list_id, la.position, la.added_at, "+albumColumns+`
+		FROM list_albums la JOIN album a ON a.id = la.album_id
+		WHERE la.list_id IN (?`+strings.Repeat(", ?", len(ids)-1)+`) ORDER BY la.list_id, la.position;`, args...)
+	if err != nil {
+		return nil, dbError("listItems", err)
+	}
+	defer rows.Close()
+	var all []AlbumMap
+	var lists []int64
+	var positions []ListItem
+	for rows.Next() {
+		var listID int64
+		var it ListItem
+		if err := rows.Scan(append([]interface{}{&listID, &it.Position, &it.AddedAt}, it.AlbumMap.scanFields()...)...); err != nil {
+			return nil, dbError("listItems", err)
+		}
+		all = append(all, it.AlbumMap)
+		lists = append(lists, listID)
+		positions = append(positions, it)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, dbError("listItems", err)
+	}
+	// the attach helpers work on a slice of albums, so fill that in and copy the albums back
+	if err := attachCredits(ctx, all); err != nil {
+		return nil, err
+	}
+	if err := attachGenresAndTags(ctx, all); err != nil {
+		return nil, err
+	}
+	for i, it := range positions {
+		it.AlbumMap = all[i]
+		items[lists[i]] = append(items[lists[i]], it)
+	}
+	return items, nil
+}
+
+// listedAlbums says which of the given albums are on which of a user's lists: album id to list ids
+func listedAlbums(ctx context.Context, userID int64, albumIDs []int64) (map[int64]map[int64]bool, error) {
+	listed := make(map[int64]map[int64]bool)
+	if len(albumIDs) == 0 {
+		return listed, nil
+	}
+	args := []interface{}{userID}
+	for _, id := range albumIDs {
+		args = append(args, id)
+	}
+	rows, err := readDB(ctx).QueryContext(ctx, `SELECT la.album_id, la.list_id FROM list_albums la JOIN lists l ON l.id = la.list_id
+		WHERE l.user_id = ? AND la.album_id IN (?`+strings.Repeat(", ?", len(albumIDs)-1)+`);`, args...)
+	if err != nil {
+		return nil, dbError("listedAlbums", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var albumID, listID int64
+		if err := rows.Scan(&albumID, &listID); err != nil {
+			return nil, dbError("listedAlbums", err)
+		}
+		if listed[albumID] == nil {
+			listed[albumID] = make(map[int64]bool)
+		}
+		listed[albumID][listID] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, dbError("listedAlbums", err)
+	}
+	return listed, nil
+}
+
+// searchLists are the lists the current user can put search results on, and which of the
+// albums are on which list already; nothing for visitors and users who can't keep lists
+func searchLists(ctx context.Context, albums []AlbumMap) ([]List, map[int64]map[int64]bool, error) {
+	u := currentUser(ctx)
+	if u == nil || !u.Can(PermListsOwn) {
+		return nil, nil, nil
+	}
+	lists, err := userLists(ctx, u.ID)
+	if err != nil {
+		return nil, nil, err
+	}
+	ids := make([]int64, len(albums))
+	for i, a := range albums {
+		ids[i] = a.ID
+	}
+	listed, err := listedAlbums(ctx, u.ID, ids)
+	if err != nil {
+		return nil, nil, err
+	}
+	return lists, listed, nil
+}
+
+// checkListName normalizes a list name and checks its length
+func checkListName(op, name string) (string, error) {
+	name = normalizeText(name)
+	fields := make(map[string]string)
+	checkText(fields, "name", "a name for the list", name, maxListNameLen)
+	if len(fields) > 0 {
+		return name, invalidFields(op, fields)
+	}
+	return name, nil
+}
+
+// listConflict turns a duplicate name into a message the user can act on
+func listConflict(op, name string, err error) error {
+	if errors.Is(dbError(op, err), ErrConflict) {
+		return &Error{Kind: ErrConflict, Op: op, Msg: fmt.Sprintf("You already have a list called %s.", name), Err: err}
+	}
+	return dbError(op, err)
+}
+
+// ownList locks one of the current user's lists for a change inside tx
+func ownList(ctx context.Context, tx *sql.Tx, op string, id int64) (List, error) {
+	u := currentUser(ctx)
+	if u == nil {
+		return List{}, &Error{Kind: ErrUnauthenticated, Op: op, Msg: "Log in to keep lists."}
+	}
+	var l List
+	err := tx.QueryRowContext(ctx, "SELECT id, user_id, name, kind, created_at FROM lists WHERE id = ? FOR UPDATE;", id).
+		Scan(&l.ID, &l.UserID, &l.Name, &l.Kind, &l.CreatedAt)
+	if err == sql.ErrNoRows {
+		return l, notFound(op, "There is no list with id %d.", id)
+	}
+	if err != nil {
+		return l, dbError(op, err)
+	}
+	if l.UserID != u.ID {
+		return l, &Error{Kind: ErrForbidden, Op: op, Msg: "You can only change your own lists."}
+	}
+	l.Username = u.Username
+	if err := tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM list_albums WHERE list_id = ?;", id).Scan(&l.Count); err != nil {
+		return l, dbError(op, err)
+	}
+	return l, nil
+}
+
+// createList makes a custom list for the current user
+func createList(ctx context.Context, name string) (List, error) {
+	u := currentUser(ctx)
+	if u == nil {
+		return List{}, &Error{Kind: ErrUnauthenticated, Op: "createList", Msg: "Log in to keep lists."}
+	}
+	name, err := checkListName("createList", name)
+	if err != nil {
+		return List{}, err
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return List{}, dbError("createList", err)
+	}
+	defer tx.Rollback()
+	// lock the user's row so two new lists can't both slip under the limit
+	var n int
+	if err := tx.QueryRowContext(ctx, "SELECT 1 FROM users WHERE id = ? FOR UPDATE;", u.ID).Scan(&n); err != nil {
+		return List{}, dbError("createList", err)
+	}
+	if err := tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM lists WHERE user_id = ?;", u.ID).Scan(&n); err != nil {
+		return List{}, dbError("createList", err)
+	}
+	if n >= maxUserLists {
+		return List{}, invalid("createList", "You can keep up to %d lists; delete one first.", maxUserLists)
+	}
+	result, err := tx.ExecContext(ctx, "INSERT INTO lists (user_id, name, kind) VALUES (?, ?, ?);", u.ID, name, ListCustom)
+	if err != nil {
+		return List{}, listConflict("createList", name, err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return List{}, dbError("createList", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return List{}, dbError("createList", err)
+	}
+	logFrom(ctx).WithFields(log.Fields{"func": "createList", "list_id": id, "name": name}).Info("created list")
+	return listByID(withPrimary(ctx), id)
+}
+
+// renameList renames one of the current user's custom lists
+func renameList(ctx context.Context, id int64, name string) (List, error) {
+	name, err := checkListName("renameList", name)
+	if err != nil {
+		return List{}, err
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return List{}, dbError("renameList", err)
+	}
+	defer tx.Rollback()
+	l, err := ownList(ctx, tx, "renameList", id)
+	if err != nil {
+		return l, err
+	}
+	if !l.Custom() {
+		return l, invalid("renameList", "%s can't be renamed.", l.Name)
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE lists SET name = ? WHERE id = ?;", name, id); err != nil {
+		return l, listConflict("renameList", name, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return l, dbError("renameList", err)
+	}
+	logFrom(ctx).WithFields(log.Fields{"func": "renameList", "list_id": id, "from": l.Name, "to": name}).Info("renamed list")
+	l.Name = name
+	return l, nil
+}
+
+// deleteList deletes one of the current user's custom lists
+func deleteList(ctx context.Context, id int64) (List, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return List{}, dbError("deleteList", err)
+	}
+	defer tx.Rollback()
+	l, err := ownList(ctx, tx, "deleteList", id)
+	if err != nil {
+		return l, err
+	}
+	if !l.Custom() {
+		return l, invalid("deleteList", "%s can't be deleted, only emptied.", l.Name)
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM lists WHERE id = ?;", id); err != nil {
+		return l, dbError("deleteList", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return l, dbError("deleteList", err)
+	}
+	logFrom(ctx).WithFields(log.Fields{"func": "deleteList", "list_id": id, "name": l.Name}).Info("deleted list")
+	return l, nil
+}
+
+// addToList puts an album at the end of one of the current user's lists. It reports false
+// when the album was on the list already, which leaves it where it was.
+func addToList(ctx context.Context, listID, albumID int64) (List, bool, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return List{}, false, dbError("addToList", err)
+	}
+	defer tx.Rollback()
+	l, err := ownList(ctx, tx, "addToList", listID)
+	if err != nil {
+		return l, false, err
+	}
+	var n int
+	if err := tx.QueryRowContext(ctx, "SELECT 1 FROM album WHERE id = ?;", albumID).Scan(&n); err == sql.ErrNoRows {
+		return l, false, notFound("addToList", "There is no album with id %d.", albumID)
+	} else if err != nil {
+		return l, false, dbError("addToList", err)
+	}
+	switch _, err := listPosition(ctx, tx, "addToList", l, albumID); {
+	case err == nil:
+		return l, false, nil
+	case !errors.Is(err, ErrNotFound):
+		return l, false, err
+	}
+	if l.Count >= maxListAlbums {
+		return l, false, invalid("addToList", "%s is full, it holds up to %d albums.", l.Name, maxListAlbums)
+	}
+	if _, err := tx.ExecContext(ctx, "INSERT INTO list_albums (list_id, album_id, position) VALUES (?, ?, ?);",
+		listID, albumID, l.Count+1); err != nil {
+		return l, false, dbError("addToList", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return l, false, dbError("addToList", err)
+	}
+	l.Count++
+	logFrom(ctx).WithFields(log.Fields{"func": "addToList", "list_id": listID, "album_id": albumID}).Info("added album to list")
+	return l, true, nil
+}
+
+// listPosition is where an album is on list l, or a not found error when it isn't on it
+func listPosition(ctx context.Context, tx *sql.Tx, op string, l List, albumID int64) (int, error) {
+	var pos int
+	err := tx.QueryRowContext(ctx, "SELECT position FROM list_albums WHERE list_id = ? AND album_id = ?;", l.ID, albumID).Scan(&pos)
+	if err == sql.ErrNoRows {
+		return 0, notFound(op, "That album is not on %s.", l.Name)
+	}
+	if err != nil {
+		return 0, dbError(op, err)
+	}
+	return pos, nil
+}
+
+// removeFromList takes an album off one of the current user's lists, closing the gap it leaves
+func removeFromList(ctx context.Context, listID, albumID int64) (List, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return List{}, dbError("removeFromList", err)
+	}
+	defer tx.Rollback()
+	l, err := ownList(ctx, tx, "removeFromList", listID)
+	if err != nil {
+		return l, err
+	}
+	pos, err := listPosition(ctx, tx, "removeFromList", l, albumID)
+	if err != nil {
+		return l, err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM list_albums WHERE list_id = ? AND album_id = ?;", listID, albumID); err != nil {
+		return l, dbError("removeFromList", err)
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE list_albums SET position = position - 1 WHERE list_id = ? AND position > ?;", listID, pos); err != nil {
+		return l, dbError("removeFromList", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return l, dbError("removeFromList", err)
+	}
+	l.Count--
+	logFrom(ctx).WithFields(log.Fields{"func": "removeFromList", "list_id": listID, "album_id": albumID}).Info("removed album from list")
+	return l, nil
+}
+
+// moveInList moves an album on one of the current user's lists to position to (from 1),
+// shifting the albums in between; positions past either end go to that end
+func moveInList(ctx context.Context, listID, albumID int64, to int) (List, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return List{}, dbError("moveInList", err)
+	}
+	defer tx.Rollback()
+	l, err := ownList(ctx, tx, "moveInList", listID)
+	if err != nil {
+		return l, err
+	}
+	from, err := listPosition(ctx, tx, "moveInList", l, albumID)
+	if err != nil {
+		return l, err
+	}
+	if to < 1 {
+		to = 1
+	}
+	if to > l.Count {
+		to = l.Count
+	}
+	if to == from {
+		return l, nil
+	}
+	shift := "UPDATE list_albums SET position = position + 1 WHERE list_id = ? AND position >= ? AND position < ?;"
+	lo, hi := to, from
+	if to > from {
+		shift = "UPDATE list_albums SET position = position - 1 WHERE list_id = ? AND position > ? AND position <= ?;"
+		lo, hi = from, to
+	}
+	if _, err := tx.ExecContext(ctx, shift, listID, lo, hi); err != nil {
+		return l, dbError("moveInList", err)
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE list_albums SET position = ? WHERE list_id = ? AND album_id = ?;", to, listID, albumID); err != nil {
+		return l, dbError("moveInList", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return l, dbError("moveInList", err)
+	}
+	logFrom(ctx).WithFields(log.Fields{"func": "moveInList", "list_id": listID, "album_id": albumID, "from": from, "to": to}).Info("moved album on list")
+	return l, nil
+}
+
+// reorderList puts the albums on one of the current user's lists in the given order, which
+// has to name every album on it exactly once
+func reorderList(ctx context.Context, listID int64, albumIDs []int64) (List, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return List{}, dbError("reorderList", err)
+	}
+	defer tx.Rollback()
+	l, err := ownList(ctx, tx, "reorderList", listID)
+	if err != nil {
+		return l, err
+	}
+	rows, err := tx.QueryContext(ctx, "SELECT album_id FROM list_albums WHERE list_id = ?;", listID)
+	if err != nil {
+		return l, dbError("reorderList", err)
+	}
+	on := make(map[int64]bool)
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return l, dbError("reorderList", err)
+		}
+		on[id] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return l, dbError("reorderList", err)
+	}
+	seen := make(map[int64]bool, len(albumIDs))
+	for _, id := range albumIDs {
+		if !on[id] || seen[id] {
+			return l, invalid("reorderList", "Give every album on %s exactly once; album %d is not on it or comes twice.", l.Name, id)
+		}
+		seen[id] = true
+	}
+	if len(seen) != len(on) {
+		return l, invalid("reorderList", "Give every album on %s exactly once; %d of its %d albums are missing.", l.Name, len(on)-len(seen), len(on))
+	}
+	for i, id := range albumIDs {
+		if _, err := tx.ExecContext(ctx, "UPDATE list_albums SET position = ? WHERE list_id = ? AND album_id = ?;", i+1, listID, id); err != nil {
+			return l, dbError("reorderList", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return l, dbError("reorderList", err)
+	}
+	logFrom(ctx).WithFields(log.Fields{"func": "reorderList", "list_id": listID, "count": len(albumIDs)}).Info("reordered list")
+	return l, nil
+}
+
+// albums are the albums on l in order, for export
+func (l List) albums() []AlbumMap {
+	albums := make([]AlbumMap, len(l.Albums))
+	for i, it := range l.Albums {
+		albums[i] = it.AlbumMap
+	}
+	return albums
+}
+
+// listChange applies the list action a posted form asks for, from the profile page or the
+// search results, and says what it did. Forms name the list in list_id and the album in album_id.
+func listChange(ctx context.Context, r *http.Request, action string) (string, error) {
+	op := "listChange"
+	listID, _ := strconv.ParseInt(r.FormValue("list_id"), 10, 64)
+	albumID, _ := strconv.ParseInt(r.FormValue("album_id"), 10, 64)
+	if action != "create" && listID <= 0 {
+		return "", notFound(op, "Pick a list.")
+	}
+	if (action == "add" || action == "remove" || action == "up" || action == "down" || action == "move") && albumID <= 0 {
+		return "", notFound(op, "Pick an album.")
+	}
+	switch action {
+	case "create":
+		l, err := createList(ctx, r.FormValue("name"))
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("Made the list %s.", l.Name), nil
+	case "rename":
+		l, err := renameList(ctx, listID, r.FormValue("name"))
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("Renamed the list to %s.", l.Name), nil
+	case "delete":
+		l, err := deleteList(ctx, listID)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("Deleted the list %s.", l.Name), nil
+	case "add":
+		l, added, err := addToList(ctx, listID, albumID)
+		if err != nil {
+			return "", err
+		}
+		if !added {
+			return fmt.Sprintf("That album is on %s already.", l.Name), nil
+		}
+		return fmt.Sprintf("Added the album to %s.", l.Name), nil
+	case "remove":
+		l, err := removeFromList(ctx, listID, albumID)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("Took the album off %s.", l.Name), nil
+	case "up", "down", "move":
+		pos, err := strconv.Atoi(r.FormValue("position"))
+		if err != nil {
+			return "", invalid(op, "%q is not a position.", r.FormValue("position"))
+		}
+		switch action {
+		case "up":
+			pos--
+		case "down":
+			pos++
+		}
+		l, err := moveInList(ctx, listID, albumID, pos)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("Moved the album on %s.", l.Name), nil
+	}
+	return "", invalid(op, "Unknown action %q.", action)
+}
+
+// profilePage is the data for profile.html. Own is set when users look at their own profile.
+type profilePage struct {
+	User    *User
+	Lists   []List
+	Own     bool
+	Success bool
+	Message string
+}
+
+// profileHandler - GET ?user= shows a user's lists, your own without ?user=
+func profileHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.FormValue("user")
+	if name == "" {
+		if currentUser(r.Context()) == nil {
+			http.Redirect(w, r, "/login?next="+url.QueryEscape("/profile"), http.StatusSeeOther)
+			return
+		}
+		name = currentUser(r.Context()).Username
+	}
+	renderProfile(w, r, name, profilePage{})
+}
+
+// renderProfile shows the lists of the user called name under the outcome already in page
+func renderProfile(w http.ResponseWriter, r *http.Request, name string, page profilePage) {
+	ctx := r.Context()
+	u, err := userByName(ctx, name)
+	if err != nil {
+		renderError(w, r, err)
+		return
+	}
+	page.User = u
+	if me := currentUser(ctx); me != nil && me.ID == u.ID {
+		page.Own = true
+	}
+	if page.Lists, err = userLists(ctx, u.ID); err == nil {
+		err = attachListItems(ctx, page.Lists)
+	}
+	if err != nil {
+		renderError(w, r, err)
+		return
+	}
+	render(w, r, "profile.html", page)
+}
+
+// listsHandler - POST from the profile page: create, rename and delete lists, and remove and
+// move the albums on them. The profile comes back with the outcome.
+func listsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if r.Method != http.MethodPost {
+		http.Redirect(w, r, "/profile", http.StatusSeeOther)
+		return
+	}
+	u := currentUser(ctx)
+	if u == nil {
+		renderError(w, r, &Error{Kind: ErrUnauthenticated, Op: "listsHandler", Msg: "Log in to keep lists."})
+		return
+	}
+	action := r.FormValue("action")
+	l := logFrom(ctx).WithFields(log.Fields{"func": "listsHandler", "action": action, "list_id": r.FormValue("list_id")})
+	msg, err := listChange(ctx, r, action)
+	if status, _ := errorStatus(err); err != nil && status >= http.StatusInternalServerError {
+		renderError(w, r, err)
+		return
+	}
+	page := profilePage{Success: err == nil, Message: msg}
+	if err != nil {
+		page.Message = errorMessage(err)
+		if fields := fieldErrors(err); len(fields) > 0 {
+			page.Message = fieldMessages(fields)
+		}
+		l.WithError(err).Warn("list change rejected")
+	} else {
+		l.Info("changed list")
+	}
+	renderProfile(w, r, u.Username, page)
+}
+
+// listExportHandler - GET ?id= downloads a list's albums in order, as CSV or with ?format=json
+// as JSON, in the same shape as the export command so the file can be imported again
+func listExportHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.FormValue("id"), 10, 64)
+	if err != nil {
+		renderError(w, r, notFound("listExportHandler", "There is no list %q.", r.FormValue("id")))
+		return
+	}
+	format := r.FormValue("format")
+	if format == "" {
+		format = "csv"
+	}
+	contentType := map[string]string{"csv": "text/csv; charset=utf-8", "json": "application/json"}[format]
+	if contentType == "" {
+		renderError(w, r, invalid("listExportHandler", "%q is not an export format, use csv or json.", format))
+		return
+	}
+	l, err := listByID(r.Context(), id)
+	if err != nil {
+		renderError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", exportName(l)+"."+format))
+	if err := writeAlbums(w, format, l.albums()); err != nil {
+		logFrom(r.Context()).WithError(err).WithField("list_id", id).Error("list export failed")
+	}
+}
+
+// exportName is a file name for a list's export: its owner and name, with anything but
+// letters, digits, dashes and dots made an underscore
+func exportName(l List) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '.':
+			return r
+		}
+		return '_'
+	}, l.Username+"-"+l.Name)
+}
+
+// apiListsPermissions and apiListPermissions say which permission each list API method needs;
+// which lists may be changed is up to their owner, checked by the list functions
+var (
+	apiListsPermissions = map[string]Permission{
+		http.MethodGet:  PermAlbumRead,
+		http.MethodPost: PermListsOwn,
+	}
+	apiListPermissions = map[string]Permission{
+		http.MethodGet:    PermAlbumRead,
+		http.MethodPost:   PermListsOwn, // adds an album at /api/lists/{id}/albums
+		http.MethodPut:    PermListsOwn,
+		http.MethodDelete: PermListsOwn,
+	}
+)
+
+// listInput is the JSON body that creates, renames or reorders a list; in a PUT, a missing
+// name or albums leaves that alone
+type listInput struct {
+	Name   *string  `json:"name"`
+	Albums *[]int64 `json:"albums"`
+}
+
+// apiListsHandler serves /api/lists: GET lists your lists with their albums (?user= someone
+// else's), POST makes one from {"name": "..."}
+func apiListsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	switch r.Method {
+	case http.MethodGet:
+		name := r.URL.Query().Get("user")
+		if name == "" {
+			u := currentUser(ctx)
+			if u == nil {
+				renderError(w, r, &Error{Kind: ErrUnauthenticated, Op: "apiListsHandler", Msg: "Log in, or name a user with ?user=."})
+				return
+			}
+			name = u.Username
+		}
+		u, err := userByName(ctx, name)
+		if err != nil {
+			renderError(w, r, err)
+			return
+		}
+		lists, err := userLists(ctx, u.ID)
+		if err == nil {
+			err = attachListItems(ctx, lists)
+		}
+		if err != nil {
+			renderError(w, r, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, lists)
+	case http.MethodPost:
+		var in listInput
+		if err := decodeJSON(r, &in); err != nil {
+			renderError(w, r, err)
+			return
+		}
+		if in.Name == nil || in.Albums != nil {
+			renderError(w, r, invalid("apiListsHandler", `Send {"name": "..."}; add albums to the new list afterwards.`))
+			return
+		}
+		l, err := createList(ctx, *in.Name)
+		if err != nil {
+			renderError(w, r, err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, l)
+	default:
+		methodNotAllowed(w, "GET, POST")
+	}
+}
+
+// apiListHandler serves /api/lists/{id}: GET, PUT (rename and reorder) and DELETE, and
+// /api/lists/{id}/albums (POST adds one) and /api/lists/{id}/albums/{album_id} (PUT moves it, DELETE takes it off)
+func apiListHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/lists/"), "/")
+	id, err := strconv.ParseInt(parts[0], 10, 64)
+	var albumID int64
+	if err == nil && len(parts) == 3 && parts[1] == "albums" {
+		albumID, err = strconv.ParseInt(parts[2], 10, 64)
+		if albumID <= 0 {
+			err = errors.New("bad album id")
+		}
+	} else if err == nil && len(parts) > 1 && !(len(parts) == 2 && parts[1] == "albums") {
+		err = errors.New("bad path")
+	}
+	if err != nil || id <= 0 {
+		renderError(w, r, notFound("apiListHandler", "There is no list at %s.", r.URL.Path))
+		return
+	}
+	if len(parts) > 1 {
+		apiListAlbumsHandler(w, r, id, albumID)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		l, err := listByID(ctx, id)
+		if err != nil {
+			renderError(w, r, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, l)
+	case http.MethodPut:
+		var in listInput
+		if err := decodeJSON(r, &in); err != nil {
+			renderError(w, r, err)
+			return
+		}
+		if in.Name != nil {
+			if _, err := renameList(ctx, id, *in.Name); err != nil {
+				renderError(w, r, err)
+				return
+			}
+		}
+		if in.Albums != nil {
+			if _, err := reorderList(ctx, id, *in.Albums); err != nil {
+				renderError(w, r, err)
+				return
+			}
+		}
+		l, err := listByID(withPrimary(ctx), id)
+		if err != nil {
+			renderError(w, r, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, l)
+	case http.MethodDelete:
+		if _, err := deleteList(ctx, id); err != nil {
+			renderError(w, r, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		methodNotAllowed(w, "GET, PUT, DELETE")
+	}
+}
+
+// listAlbumInput is the JSON body that adds an album to a list or moves it; position counts from 1
+type listAlbumInput struct {
+	AlbumID  int64 `json:"album_id"`
+	Position int   `json:"position"`
+}
+
+// apiListAlbumsHandler serves /api/lists/{id}/albums: POST adds {"album_id": 3}, at the end or
+// at "position"; and /api/lists/{id}/albums/{album_id}: PUT moves it to {"position": 1}, DELETE takes it off
+func apiListAlbumsHandler(w http.ResponseWriter, r *http.Request, listID, albumID int64) {
+	ctx := r.Context()
+	var err error
+	switch {
+	case albumID == 0 && r.Method == http.MethodPost:
+		var in listAlbumInput
+		if err := decodeJSON(r, &in); err != nil {
+			renderError(w, r, err)
+			return
+		}
+		albumID = in.AlbumID
+		if _, _, err = addToList(ctx, listID, albumID); err == nil && in.Position != 0 {
+			_, err = moveInList(ctx, listID, albumID, in.Position)
+		}
+	case albumID != 0 && r.Method == http.MethodPut:
+		var in listAlbumInput
+		if err := decodeJSON(r, &in); err != nil {
+			renderError(w, r, err)
+			return
+		}
+		if in.Position == 0 {
+			err = invalid("apiListAlbumsHandler", `Send {"position": N} to move the album.`)
+		} else {
+			_, err = moveInList(ctx, listID, albumID, in.Position)
+		}
+	case albumID != 0 && r.Method == http.MethodDelete:
+		_, err = removeFromList(ctx, listID, albumID)
+	case albumID == 0:
+		methodNotAllowed(w, "POST")
+		return
+	default:
+		methodNotAllowed(w, "PUT, DELETE")
+		return
+	}
+	if err != nil {
+		renderError(w, r, err)
+		return
+	}
+	l, err := listByID(withPrimary(ctx), listID)
+	if err != nil {
+		renderError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, l)
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Log field schema. Every log line uses these keys so lines can be filtered and
+// correlated: "request_id", "method", "path", "remote_addr", "status", "bytes" and
+// "duration_ms" come from the request middleware, "func" names the function that
+// logged, and data fields use snake_case names such as "album_id", "title",
+// "artist", "price" and "count". Errors go through WithError ("error").
+
+// requestIDHeader is the header used to receive and return the request ID
+const requestIDHeader = "X-Request-ID"
+
+// loggerKey is the context key for the request-scoped logger
+type loggerKey struct{}
+
+// setupLogging configures the standard logrus logger from cfg
+func setupLogging(cfg Config) error {
+	level, err := log.ParseLevel(cfg.LogLevel)
+	if err != nil {
+		return fmt.Errorf("setupLogging: %v", err)
+	}
+	log.SetLevel(level)
+
+	switch strings.ToLower(cfg.LogFormat) {
+	case "json":
+		log.SetFormatter(&log.JSONFormatter{})
+	case "text":
+		log.SetFormatter(&log.TextFormatter{FullTimestamp: true})
+	default:
+		return fmt.Errorf("setupLogging: unknown log format %q", cfg.LogFormat)
+	}
+	return nil
+}
+
+// withLogger returns a copy of ctx carrying the logger l
+func withLogger(ctx context.Context, l *log.Entry) context.Context {
+	return context.WithValue(ctx, loggerKey{}, l)
+}
+
+// logFrom returns the request-scoped logger in ctx, or the standard logger
+func logFrom(ctx context.Context) *log.Entry {
+	if l, ok := ctx.Value(loggerKey{}).(*log.Entry); ok {
+		return l
+	}
+	return log.NewEntry(log.StandardLogger())
+}
+
+// requestID returns the incoming X-Request-ID if it is sane, otherwise a new random ID
+func requestID(r *http.Request) string {
+	if id := r.Header.Get(requestIDHeader); validRequestID(id) {
+		return id
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+// validRequestID accepts short IDs made of letters, digits, '-', '_' and '.'
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-', c == '_', c == '.':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// statusRecorder remembers the status code and body size written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	if s.status == 0 {
+		s.status = code
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	n, err := s.ResponseWriter.Write(b)
+	s.bytes += n
+	return n, err
+}
+
+// requestLogger assigns or propagates the request ID, puts a request-scoped logger
+// on the context and writes one access line per request
+func requestLogger(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		id := requestID(r)
+		w.Header().Set(requestIDHeader, id)
+
+		l := log.WithFields(log.Fields{
+			"request_id":  id,
+			"method":      r.Method,
+			"path":        r.URL.Path,
+			"remote_addr": r.RemoteAddr,
+		})
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r.WithContext(withLogger(r.Context(), l)))
+
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		l.WithFields(log.Fields{
+			"status":      rec.status,
+			"bytes":       rec.bytes,
+			"duration_ms": time.Since(start).Milliseconds(),
+		}).Info("request completed")
+	})
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"embed"
+	"fmt"
+	"io/fs"
+	"sort"
+	"strings"
+)
+
+// migrationFS holds the schema migrations, applied in file name order
+//
+//go:embed migrations/*.sql
+var migrationFS embed.FS
+
+// migration is one numbered schema change
+type migration struct {
+	Version string // file name without .sql, e.g. 0001_create_album
+	SQL     string
+	Applied bool
+}
+
+// loadMigrations reads the embedded migrations and marks the ones already applied
+func loadMigrations(ctx context.Context) ([]migration, error) {
+	if _, err := db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version    VARCHAR(255) NOT NULL PRIMARY KEY,
+		applied_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+	)`); err != nil {
+		return nil, dbError("loadMigrations", err)
+	}
+
+	applied := map[string]bool{}
+	rows, err := db.QueryContext(ctx, "SELECT version FROM schema_migrations;")
+	if err != nil {
+		return nil, dbError("loadMigrations", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var v string
+		if err := rows.Scan(&v); err != nil {
+			return nil, dbError("loadMigrations", err)
+		}
+		applied[v] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, dbError("loadMigrations", err)
+	}
+
+	files, err := fs.Glob(migrationFS, "migrations/*.sql")
+	if err != nil {
+		return nil, fmt.Errorf("loadMigrations: %v", err)
+	}
+	sort.Strings(files)
+	var res []migration
+	for _, f := range files {
+		b, err := migrationFS.ReadFile(f)
+		if err != nil {
+			return nil, fmt.Errorf("loadMigrations: %v", err)
+		}
+		v := strings.TrimSuffix(strings.TrimPrefix(f, "migrations/"), ".sql")
+		res = append(res, migration{Version: v, SQL: string(b), Applied: applied[v]})
+	}
+	return res, nil
+}
+
+// migrate applies every pending migration, returns the versions it applied
+func migrate(ctx context.Context) ([]string, error) {
+	l := logFrom(ctx).WithField("func", "migrate")
+	migrations, err := loadMigrations(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var done []string
+	for _, m := range migrations {
+		if m.Applied {
+			continue
+		}
+		// MySQL commits DDL implicitly, so a migration is not atomic; keep them small.
+		for _, stmt := range splitStatements(m.SQL) {
+			if _, err := db.ExecContext(ctx, stmt); err != nil {
+				return done, dbError("migrate "+m.Version, err)
+			}
+		}
+		if _, err := db.ExecContext(ctx, "INSERT INTO schema_migrations (version) VALUES (?);", m.Version); err != nil {
+			return done, dbError("migrate "+m.Version, err)
+		}
+		l.WithField("version", m.Version).Info("applied migration")
+		done = append(done, m.Version)
+	}
+	return done, nil
+}
+
+// splitStatements splits a migration file into statements on semicolons that end a line,
+// dropping "--" comment lines
+func splitStatements(src string) []string {
+	var stmts []string
+	var cur strings.Builder
+	for _, line := range strings.Split(src, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "--") {
+			continue
+		}
+		cur.WriteString(line)
+		cur.WriteString("\n")
+		if strings.HasSuffix(trimmed, ";") {
+			stmts = append(stmts, strings.TrimSpace(cur.String()))
+			cur.Reset()
+		}
+	}
+	if s := strings.TrimSpace(cur.String()); s != "" {
+		stmts = append(stmts, s)
+	}
+	return stmts
+}
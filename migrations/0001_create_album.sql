@@ -0,0 +1,8 @@
+-- The album table as created by the original create-tables.sql.
+CREATE TABLE IF NOT EXISTS album (
+  id         INT AUTO_INCREMENT NOT NULL,
+  title      VARCHAR(128) NOT NULL,
+  artist     VARCHAR(255) NOT NULL,
+  price      DECIMAL(5,2) NOT NULL,
+  PRIMARY KEY (`id`)
+);
@@ -0,0 +1,32 @@
+-- Accounts, server-side login sessions and the log of who changed which album.
+CREATE TABLE IF NOT EXISTS users (
+  id            INT AUTO_INCREMENT NOT NULL,
+  username      VARCHAR(64) NOT NULL,
+  password_hash VARCHAR(255) NOT NULL,
+  created_at    TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY users_username (username)
+);
+
+-- id is the SHA-256 of the cookie token, so the table alone cannot be used to log in.
+CREATE TABLE IF NOT EXISTS sessions (
+  id         CHAR(64) NOT NULL,
+  user_id    INT NOT NULL,
+  created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  expires_at TIMESTAMP NOT NULL,
+  PRIMARY KEY (`id`),
+  KEY sessions_user (user_id),
+  CONSTRAINT sessions_user_fk FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
+
+-- No foreign key to album: the history outlives deleted albums.
+CREATE TABLE IF NOT EXISTS album_changes (
+  id         INT AUTO_INCREMENT NOT NULL,
+  album_id   INT NOT NULL,
+  action     VARCHAR(16) NOT NULL,
+  user_id    INT NULL,
+  actor      VARCHAR(64) NOT NULL,
+  changed_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (`id`),
+  KEY album_changes_album (album_id)
+);
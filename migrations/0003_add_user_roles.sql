@@ -0,0 +1,5 @@
+-- Roles: viewer (search and dump), editor (add and edit), admin (delete and manage users).
+ALTER TABLE users ADD COLUMN role VARCHAR(16) NOT NULL DEFAULT 'viewer' AFTER password_hash;
+
+-- Accounts made before roles existed could already do everything, so they keep that.
+UPDATE users SET role = 'admin';
@@ -0,0 +1,5 @@
+-- Each session gets its own CSRF token, checked on every form post.
+ALTER TABLE sessions ADD COLUMN csrf_token CHAR(64) NOT NULL DEFAULT '' AFTER user_id;
+
+-- Sessions from before this migration have no token; make them log in again.
+DELETE FROM sessions;
@@ -0,0 +1,17 @@
+-- Personal access tokens for scripts. token_hash is the SHA-256 of the token, prefix is
+-- its first characters so people can tell their tokens apart. A NULL expires_at never expires.
+CREATE TABLE IF NOT EXISTS api_tokens (
+  id           INT AUTO_INCREMENT NOT NULL,
+  user_id      INT NOT NULL,
+  name         VARCHAR(64) NOT NULL,
+  token_hash   CHAR(64) NOT NULL,
+  prefix       CHAR(12) NOT NULL,
+  scope        VARCHAR(16) NOT NULL,
+  created_at   TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  expires_at   TIMESTAMP NULL DEFAULT NULL,
+  last_used_at TIMESTAMP NULL DEFAULT NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY api_tokens_hash (token_hash),
+  KEY api_tokens_user (user_id),
+  CONSTRAINT api_tokens_user_fk FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
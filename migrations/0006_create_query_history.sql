@@ -0,0 +1,15 @@
+-- Statements run in the admin SQL console, kept per user. error is NULL when the
+-- statement succeeded; row_count is how many rows were returned.
+CREATE TABLE IF NOT EXISTS query_history (
+  id          INT AUTO_INCREMENT NOT NULL,
+  user_id     INT NOT NULL,
+  statement   TEXT NOT NULL,
+  is_explain  BOOLEAN NOT NULL DEFAULT FALSE,
+  row_count   INT NOT NULL DEFAULT 0,
+  duration_ms INT NOT NULL DEFAULT 0,
+  error       VARCHAR(512) NULL DEFAULT NULL,
+  created_at  TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (`id`),
+  KEY query_history_user (user_id, created_at),
+  CONSTRAINT query_history_user_fk FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
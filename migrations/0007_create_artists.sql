@@ -0,0 +1,33 @@
+-- Artists get their own table and albums credit any number of them, each with a role
+-- (primary, featured or composer). album.artist stays as the display credit, e.g.
+-- "John Coltrane & Don Cherry feat. Ed Blackwell", and is rewritten whenever the credits change.
+CREATE TABLE IF NOT EXISTS artists (
+  id         INT AUTO_INCREMENT NOT NULL,
+  name       VARCHAR(255) NOT NULL,
+  created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY artists_name (name)
+);
+
+CREATE TABLE IF NOT EXISTS album_artists (
+  album_id  INT NOT NULL,
+  artist_id INT NOT NULL,
+  role      VARCHAR(16) NOT NULL DEFAULT 'primary',
+  position  INT NOT NULL DEFAULT 0,
+  PRIMARY KEY (album_id, artist_id, role),
+  KEY album_artists_artist (artist_id),
+  CONSTRAINT album_artists_album_fk FOREIGN KEY (album_id) REFERENCES album (id) ON DELETE CASCADE,
+  CONSTRAINT album_artists_artist_fk FOREIGN KEY (artist_id) REFERENCES artists (id)
+);
+
+-- Every existing artist string becomes one primary artist. The name comparison ignores
+-- case, so "john coltrane" and "John Coltrane" end up as the same artist.
+INSERT IGNORE INTO artists (name)
+  SELECT DISTINCT TRIM(artist) FROM album WHERE TRIM(artist) <> '';
+
+INSERT IGNORE INTO album_artists (album_id, artist_id, role, position)
+  SELECT a.id, ar.id, 'primary', 0 FROM album a JOIN artists ar ON ar.name = TRIM(a.artist);
+
+-- and their albums show the one spelling that was kept
+UPDATE album a JOIN album_artists aa ON aa.album_id = a.id JOIN artists ar ON ar.id = aa.artist_id
+  SET a.artist = ar.name;
@@ -0,0 +1,17 @@
+-- Track listings. duration is in seconds, NULL when unknown. artist_id is only set when a
+-- track is credited to someone other than the album's artists, e.g. on a compilation.
+CREATE TABLE IF NOT EXISTS tracks (
+  id        INT AUTO_INCREMENT NOT NULL,
+  album_id  INT NOT NULL,
+  disc      SMALLINT NOT NULL DEFAULT 1,
+  number    SMALLINT NOT NULL,
+  title     VARCHAR(255) NOT NULL,
+  duration  INT NULL DEFAULT NULL,
+  artist_id INT NULL DEFAULT NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY tracks_position (album_id, disc, number),
+  KEY tracks_title (title),
+  KEY tracks_artist (artist_id),
+  CONSTRAINT tracks_album_fk FOREIGN KEY (album_id) REFERENCES album (id) ON DELETE CASCADE,
+  CONSTRAINT tracks_artist_fk FOREIGN KEY (artist_id) REFERENCES artists (id)
+);
@@ -0,0 +1,46 @@
+-- Genres form a tree (Jazz > Bebop) through parent_id; a genre with sub-genres cannot be
+-- deleted until they are moved or deleted. Names are unique across the whole tree so a
+-- genre can be named on its own. Tags are free-form labels created as albums use them.
+CREATE TABLE IF NOT EXISTS genres (
+  id        INT AUTO_INCREMENT NOT NULL,
+  name      VARCHAR(64) NOT NULL,
+  parent_id INT NULL DEFAULT NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY genres_name (name),
+  KEY genres_parent (parent_id),
+  CONSTRAINT genres_parent_fk FOREIGN KEY (parent_id) REFERENCES genres (id)
+);
+
+CREATE TABLE IF NOT EXISTS album_genres (
+  album_id INT NOT NULL,
+  genre_id INT NOT NULL,
+  PRIMARY KEY (album_id, genre_id),
+  KEY album_genres_genre (genre_id),
+  CONSTRAINT album_genres_album_fk FOREIGN KEY (album_id) REFERENCES album (id) ON DELETE CASCADE,
+  CONSTRAINT album_genres_genre_fk FOREIGN KEY (genre_id) REFERENCES genres (id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS tags (
+  id   INT AUTO_INCREMENT NOT NULL,
+  name VARCHAR(64) NOT NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY tags_name (name)
+);
+
+CREATE TABLE IF NOT EXISTS album_tags (
+  album_id INT NOT NULL,
+  tag_id   INT NOT NULL,
+  PRIMARY KEY (album_id, tag_id),
+  KEY album_tags_tag (tag_id),
+  CONSTRAINT album_tags_album_fk FOREIGN KEY (album_id) REFERENCES album (id) ON DELETE CASCADE,
+  CONSTRAINT album_tags_tag_fk FOREIGN KEY (tag_id) REFERENCES tags (id) ON DELETE CASCADE
+);
+
+-- a starting point for the sample albums; more come from "data-access genre add"
+INSERT IGNORE INTO genres (name) VALUES ('Jazz');
+INSERT IGNORE INTO genres (name, parent_id)
+  SELECT 'Hard bop', id FROM genres WHERE name = 'Jazz';
+INSERT IGNORE INTO genres (name, parent_id)
+  SELECT 'Cool jazz', id FROM genres WHERE name = 'Jazz';
+INSERT IGNORE INTO genres (name, parent_id)
+  SELECT 'Vocal jazz', id FROM genres WHERE name = 'Jazz';
@@ -0,0 +1,10 @@
+-- Release details for catalog work. Everything is optional; a catalog number is unique
+-- within its label (rows without a label or catalog number are not checked).
+ALTER TABLE album
+  ADD COLUMN release_date   DATE NULL DEFAULT NULL,
+  ADD COLUMN label          VARCHAR(128) NULL DEFAULT NULL,
+  ADD COLUMN format         VARCHAR(16) NULL DEFAULT NULL,
+  ADD COLUMN catalog_number VARCHAR(32) NULL DEFAULT NULL,
+  ADD COLUMN notes          TEXT NULL,
+  ADD UNIQUE KEY album_catalog_number (label, catalog_number),
+  ADD KEY album_release_date (release_date);
@@ -0,0 +1,26 @@
+-- Stock of physical copies. stock holds the current count per album and an optional
+-- low-stock threshold (NULL uses LOW_STOCK_THRESHOLD); stock_movements is the ledger
+-- every change goes through. quantity there is signed: received and returned copies are
+-- positive, sold ones negative, adjustments either. Like album_changes it outlives the album.
+CREATE TABLE IF NOT EXISTS stock (
+  album_id   INT NOT NULL,
+  quantity   INT NOT NULL DEFAULT 0,
+  threshold  INT NULL DEFAULT NULL,
+  updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+  PRIMARY KEY (album_id),
+  CONSTRAINT stock_album_fk FOREIGN KEY (album_id) REFERENCES album (id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS stock_movements (
+  id         INT AUTO_INCREMENT NOT NULL,
+  album_id   INT NOT NULL,
+  kind       VARCHAR(16) NOT NULL,
+  quantity   INT NOT NULL,
+  balance    INT NOT NULL,
+  note       VARCHAR(255) NOT NULL DEFAULT '',
+  user_id    INT NULL,
+  actor      VARCHAR(64) NOT NULL,
+  created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (`id`),
+  KEY stock_movements_album (album_id, id)
+);
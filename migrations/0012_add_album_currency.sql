@@ -0,0 +1,3 @@
+-- Prices are exact DECIMAL amounts; the currency they are in goes next to them.
+ALTER TABLE album
+  ADD COLUMN currency CHAR(3) NOT NULL DEFAULT 'USD' AFTER price;
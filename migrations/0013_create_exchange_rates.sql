@@ -0,0 +1,14 @@
+-- Exchange rates from the base currency (BASE_CURRENCY), kept by hand. A rate is how many
+-- units of currency one unit of the base currency buys, from effective_date until the next
+-- rate for that currency takes over.
+CREATE TABLE IF NOT EXISTS exchange_rates (
+  id             INT AUTO_INCREMENT NOT NULL,
+  currency       CHAR(3) NOT NULL,
+  rate           DECIMAL(18,8) NOT NULL,
+  effective_date DATE NOT NULL,
+  user_id        INT NULL,
+  actor          VARCHAR(64) NOT NULL,
+  created_at     TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY exchange_rates_currency_date (currency, effective_date)
+);
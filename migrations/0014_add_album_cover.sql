@@ -0,0 +1,6 @@
+-- An album's cover is stored by content: the SHA-256 of the uploaded file names the image
+-- and its thumbnail in the blob store, and cover_type is the image's extension.
+ALTER TABLE album
+  ADD COLUMN cover      CHAR(64) NULL DEFAULT NULL AFTER notes,
+  ADD COLUMN cover_type VARCHAR(8) NULL DEFAULT NULL AFTER cover,
+  ADD KEY album_cover (cover);
@@ -0,0 +1,19 @@
+-- Album ratings and reviews, one per user per album. rating is 1 to 5 stars and body is
+-- the optional written review. Moderators can hide a review, which keeps it out of the
+-- album's average; moderated_by is who last hid, showed or edited it for its author.
+CREATE TABLE IF NOT EXISTS reviews (
+  id           INT AUTO_INCREMENT NOT NULL,
+  album_id     INT NOT NULL,
+  user_id      INT NOT NULL,
+  rating       TINYINT NOT NULL,
+  body         TEXT NOT NULL,
+  hidden       BOOLEAN NOT NULL DEFAULT FALSE,
+  moderated_by VARCHAR(64) NULL DEFAULT NULL,
+  created_at   TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  updated_at   TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY reviews_album_user (album_id, user_id),
+  KEY reviews_album_hidden (album_id, hidden),
+  CONSTRAINT reviews_album_fk FOREIGN KEY (album_id) REFERENCES album (id) ON DELETE CASCADE,
+  CONSTRAINT reviews_user_fk FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
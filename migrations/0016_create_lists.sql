@@ -0,0 +1,29 @@
+-- Per-user album lists. Every account has a favorites and a wishlist list (kind says
+-- which) and can make custom ones. list_albums keeps each list's albums in order:
+-- position runs from 1 without gaps.
+CREATE TABLE IF NOT EXISTS lists (
+  id         INT AUTO_INCREMENT NOT NULL,
+  user_id    INT NOT NULL,
+  name       VARCHAR(64) NOT NULL,
+  kind       VARCHAR(16) NOT NULL DEFAULT 'custom',
+  created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY lists_user_name (user_id, name),
+  CONSTRAINT lists_user_fk FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS list_albums (
+  list_id  INT NOT NULL,
+  album_id INT NOT NULL,
+  position INT NOT NULL,
+  added_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (list_id, album_id),
+  KEY list_albums_position (list_id, position),
+  KEY list_albums_album (album_id),
+  CONSTRAINT list_albums_list_fk FOREIGN KEY (list_id) REFERENCES lists (id) ON DELETE CASCADE,
+  CONSTRAINT list_albums_album_fk FOREIGN KEY (album_id) REFERENCES album (id) ON DELETE CASCADE
+);
+
+-- the accounts that already exist get their two lists too
+INSERT IGNORE INTO lists (user_id, name, kind) SELECT id, 'Favorites', 'favorites' FROM users;
+INSERT IGNORE INTO lists (user_id, name, kind) SELECT id, 'Wishlist', 'wishlist' FROM users;
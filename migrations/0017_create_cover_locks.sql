@@ -0,0 +1,8 @@
+-- One row per cover image in use. Setting and dropping a cover lock its row, so an
+-- album taking an image can't race the cleanup that deletes the same image.
+CREATE TABLE IF NOT EXISTS cover_locks (
+  hash CHAR(64) NOT NULL,
+  PRIMARY KEY (`hash`)
+);
+
+INSERT IGNORE INTO cover_locks (hash) SELECT DISTINCT cover FROM album WHERE cover IS NOT NULL;
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Currency is an ISO 4217 currency code
+type Currency string
+
+// currencyInfo is how a currency is written and rounded. Step is the smallest amount a
+// price can come to, in hundredths: 1 for cents, 5 for the Swiss 5 centimes, 100 for whole yen.
+type currencyInfo struct {
+	Symbol   string
+	Decimals int
+	Step     int64
+}
+
+// currencies lists the currencies money can be in; BASE_CURRENCY has to be one of them
+var currencies = map[Currency]currencyInfo{
+	"USD": {Symbol: "$", Decimals: 2, Step: 1},
+	"EUR": {Symbol: "€", Decimals: 2, Step: 1},
+	"GBP": {Symbol: "£", Decimals: 2, Step: 1},
+	"CAD": {Symbol: "CA$", Decimals: 2, Step: 1},
+	"AUD": {Symbol: "A$", Decimals: 2, Step: 1},
+	"CHF": {Symbol: "CHF ", Decimals: 2, Step: 5},
+	"JPY": {Symbol: "¥", Decimals: 0, Step: 100},
+}
+
+// step is the rounding step of currency c in hundredths, 1 for currencies the app doesn't know
+func step(c Currency) int64 {
+	if info, ok := currencies[c]; ok && info.Step > 0 {
+		return info.Step
+	}
+	return 1
+}
+
+// Money is an exact amount in hundredths of its currency, the same scale as the
+// DECIMAL(…, 2) price columns, so nothing drifts on the way in or out
+type Money struct {
+	Cents    int64
+	Currency Currency
+}
+
+// IsZero reports whether m is no money at all; a blank price parses to zero
+func (m Money) IsZero() bool {
+	return m.Cents == 0
+}
+
+// Cmp compares two amounts of the same currency: -1 when m is less than o, 0 when equal, +1 when more
+func (m Money) Cmp(o Money) int {
+	switch {
+	case m.Cents < o.Cents:
+		return -1
+	case m.Cents > o.Cents:
+		return 1
+	}
+	return 0
+}
+
+// round rounds m to its currency's step, half away from zero
+func (m Money) round() Money {
+	s := step(m.Currency)
+	n := m.Cents
+	if n < 0 {
+		n = -n
+	}
+	n = (n + s/2) / s * s
+	if m.Cents < 0 {
+		n = -n
+	}
+	return Money{Cents: n, Currency: m.Currency}
+}
+
+// Decimal is the exact amount without a symbol, always with two decimals, e.g. "56.99",
+// as forms, CSV and SQL take it
+func (m Money) Decimal() string {
+	sign, cents := "", m.Cents
+	if cents < 0 {
+		sign, cents = "-", -cents
+	}
+	return fmt.Sprintf("%s%d.%02d", sign, cents/100, cents%100)
+}
+
+// String shows m for people, rounded the way its currency is, e.g. "$56.99" or "¥8620",
+// or "56.99 XXX" for a currency the app doesn't know
+func (m Money) String() string {
+	info, ok := currencies[m.Currency]
+	if !ok {
+		return strings.TrimSpace(m.Decimal() + " " + string(m.Currency))
+	}
+	m = m.round()
+	sign := ""
+	if m.Cents < 0 {
+		sign, m.Cents = "-", -m.Cents
+	}
+	amount := m.Decimal()
+	if info.Decimals == 0 {
+		amount = strconv.FormatInt(m.Cents/100, 10)
+	}
+	return sign + info.Symbol + amount
+}
+
+// parseMoney reads an amount like "56.99", "$56.99" or "56.99 USD" in currency cur. Digits
+// past the cents are rounded, half away from zero, without going through floating point.
+func parseMoney(s string, cur Currency) (Money, bool) {
+	s = strings.TrimSpace(s)
+	if code := strings.TrimSpace(strings.TrimSuffix(s, string(cur))); cur != "" && code != s {
+		s = code
+	}
+	neg := strings.HasPrefix(s, "-")
+	s = strings.TrimPrefix(s, "-")
+	if info, ok := currencies[cur]; ok && info.Symbol != "" {
+		s = strings.TrimPrefix(s, info.Symbol)
+	}
+	whole, frac, _ := strings.Cut(s, ".")
+	if (whole == "" && frac == "") || len(whole) > 15 || !allDigits(whole) || !allDigits(frac) {
+		return Money{}, false
+	}
+	cents := int64(0)
+	if whole != "" {
+		n, err := strconv.ParseInt(whole, 10, 64)
+		if err != nil {
+			return Money{}, false
+		}
+		cents = n * 100
+	}
+	frac += "00"
+	cents += int64(frac[0]-'0')*10 + int64(frac[1]-'0')
+	if len(frac) > 2 && frac[2] >= '5' {
+		cents++
+	}
+	if neg {
+		cents = -cents
+	}
+	return Money{Cents: cents, Currency: cur}, true
+}
+
+// allDigits reports whether s is only ASCII digits (an empty s is)
+func allDigits(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// Scan reads a DECIMAL column, which the driver hands over as text; the currency is a column of its own
+func (m *Money) Scan(src interface{}) error {
+	var s string
+	switch v := src.(type) {
+	case []byte:
+		s = string(v)
+	case string:
+		s = v
+	case int64:
+		m.Cents = v * 100
+		return nil
+	default:
+		return fmt.Errorf("Money.Scan: can't read %T", src)
+	}
+	parsed, ok := parseMoney(s, "")
+	if !ok {
+		return fmt.Errorf("Money.Scan: %q is not an amount", s)
+	}
+	m.Cents = parsed.Cents
+	return nil
+}
+
+// Value writes the amount as decimal text, which MySQL stores in a DECIMAL column exactly
+func (m Money) Value() (driver.Value, error) {
+	return m.Decimal(), nil
+}
+
+// moneyJSON is the JSON shape of Money; the amount is a string so no client turns it into a float
+type moneyJSON struct {
+	Amount   string   `json:"amount"`
+	Currency Currency `json:"currency"`
+}
+
+// MarshalJSON writes m as {"amount": "56.99", "currency": "USD"}
+func (m Money) MarshalJSON() ([]byte, error) {
+	return json.Marshal(moneyJSON{Amount: m.Decimal(), Currency: m.Currency})
+}
+
+// UnmarshalJSON reads {"amount": "56.99", "currency": "USD"}, or a bare 56.99 or "56.99",
+// which are in BASE_CURRENCY. The amount may be a number too; it is read from its digits.
+func (m *Money) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	amount, cur := string(data), appCfg.BaseCurrency
+	switch {
+	case bytes.HasPrefix(data, []byte("{")):
+		var in struct {
+			Amount   json.RawMessage `json:"amount"`
+			Currency Currency        `json:"currency"`
+		}
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&in); err != nil {
+			return err
+		}
+		amount = string(in.Amount)
+		if in.Currency != "" {
+			cur = Currency(strings.ToUpper(string(in.Currency)))
+		}
+	case string(data) == "null":
+		return nil
+	}
+	if unquoted, err := strconv.Unquote(amount); err == nil {
+		amount = unquoted
+	}
+	parsed, ok := parseMoney(amount, cur)
+	if !ok {
+		return fmt.Errorf("%s is not an amount of money", amount)
+	}
+	*m = parsed
+	return nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import "testing"
+
+func TestParseMoney(t *testing.T) {
+	for _, tc := range []struct {
+		in    string
+		cur   Currency
+		cents int64
+		ok    bool
+	}{
+		{"56.99", "USD", 5699, true},
+		{"$56.99", "USD", 5699, true},
+		{"56.99 USD", "USD", 5699, true},
+		{"56", "USD", 5600, true},
+		{"56.9", "USD", 5690, true},
+		{".5", "USD", 50, true},
+		{"1.005", "USD", 101, true},
+		{"1.00499", "USD", 100, true},
+		{"-1.005", "USD", -101, true},
+		{"-$2.50", "USD", -250, true},
+		{"-0.004", "USD", 0, true},
+		{"¥8620", "JPY", 862000, true},
+		{"CHF 10.05", "CHF", 1005, true},
+		{"12.34", "", 1234, true},
+		{"", "USD", 0, false},
+		{".", "USD", 0, false},
+		{"1,000", "USD", 0, false},
+		{"1e3", "USD", 0, false},
+		{"€5", "USD", 0, false},
+		{"1234567890123456", "USD", 0, false},
+	} {
+		m, ok := parseMoney(tc.in, tc.cur)
+		if ok != tc.ok || (ok && (m.Cents != tc.cents || m.Currency != tc.cur)) {
+			t.Errorf("parseMoney(%q, %q) = %+v, %v, want %d %s, %v", tc.in, tc.cur, m, ok, tc.cents, tc.cur, tc.ok)
+		}
+	}
+}
+
+func TestMoneyRound(t *testing.T) {
+	for _, tc := range []struct {
+		in   Money
+		want int64
+	}{
+		{Money{5699, "USD"}, 5699},
+		{Money{-5699, "USD"}, -5699},
+		{Money{1002, "CHF"}, 1000},
+		{Money{1003, "CHF"}, 1005},
+		{Money{1007, "CHF"}, 1005},
+		{Money{1008, "CHF"}, 1010},
+		{Money{-1003, "CHF"}, -1005},
+		{Money{-1002, "CHF"}, -1000},
+		{Money{862049, "JPY"}, 862000},
+		{Money{862050, "JPY"}, 862100},
+		{Money{-862050, "JPY"}, -862100},
+		{Money{-862049, "JPY"}, -862000},
+		{Money{1234, "XXX"}, 1234},
+	} {
+		if got := tc.in.round(); got.Cents != tc.want || got.Currency != tc.in.Currency {
+			t.Errorf("%+v.round() = %+v, want %d", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestMoneyString(t *testing.T) {
+	for _, tc := range []struct {
+		in      Money
+		decimal string
+		str     string
+	}{
+		{Money{5699, "USD"}, "56.99", "$56.99"},
+		{Money{-5699, "USD"}, "-56.99", "-$56.99"},
+		{Money{5, "EUR"}, "0.05", "€0.05"},
+		{Money{-5, "EUR"}, "-0.05", "-€0.05"},
+		{Money{0, "GBP"}, "0.00", "£0.00"},
+		{Money{1003, "CHF"}, "10.03", "CHF 10.05"},
+		{Money{-1003, "CHF"}, "-10.03", "-CHF 10.05"},
+		{Money{862049, "JPY"}, "8620.49", "¥8620"},
+		{Money{862050, "JPY"}, "8620.50", "¥8621"},
+		{Money{-862050, "JPY"}, "-8620.50", "-¥8621"},
+		{Money{5699, "XXX"}, "56.99", "56.99 XXX"},
+		{Money{5699, ""}, "56.99", "56.99"},
+	} {
+		if got := tc.in.Decimal(); got != tc.decimal {
+			t.Errorf("%+v.Decimal() = %q, want %q", tc.in, got, tc.decimal)
+		}
+		if got := tc.in.String(); got != tc.str {
+			t.Errorf("%+v.String() = %q, want %q", tc.in, got, tc.str)
+		}
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// limiterIdle is how long a client's bucket is kept after it has refilled
+const limiterIdle = 10 * time.Minute
+
+// bucket is one client's token bucket
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// limiter is an in-memory token bucket per client key. Each key can make burst requests
+// at once, refilled at perMinute a minute. A nil limiter allows everything.
+type limiter struct {
+	mu        sync.Mutex
+	rate      float64 // tokens per second
+	burst     float64
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+// newLimiter returns a limiter, or nil when perMinute is 0 (no limit)
+func newLimiter(perMinute, burst int) *limiter {
+	if perMinute <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &limiter{
+		rate:    float64(perMinute) / 60,
+		burst:   float64(burst),
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// allow takes a token from key's bucket. When it is empty it returns false and how long
+// until the next token.
+func (l *limiter) allow(key string, now time.Time) (bool, time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.sweep(now)
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	wait := time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	return false, wait
+}
+
+// sweep forgets clients that have been idle long enough for their bucket to be full again,
+// so the map does not grow forever. Called with l.mu held.
+func (l *limiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+	for key, b := range l.buckets {
+		if now.Sub(b.last) > limiterIdle {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// peek reports whether key's bucket has a token left, without taking it, and if not how
+// long until it has
+func (l *limiter) peek(key string, now time.Time) (bool, time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b, ok := l.buckets[key]
+	if !ok {
+		return true, 0
+	}
+	tokens := math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	if tokens >= 1 {
+		return true, 0
+	}
+	return false, time.Duration((1 - tokens) / l.rate * float64(time.Second))
+}
+
+// rateLimit answers 429 with Retry-After once a client runs out of requests. Reads and
+// writes have separate buckets. It runs before loadSession, so nothing is looked up for a
+// client that is over its limit: requests without credentials count against their IP
+// here, and so does an API token that turns out to be bad. While an IP's bucket is empty,
+// requests from it that carry credentials are turned away too. The rest count against
+// their API token or user in limitUsers, once loadSession has checked them.
+func rateLimit(reads, writes *limiter, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isStaticPath(r.URL.Path) || r.URL.Path == "/healthz" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		lim, kind := limiterFor(reads, writes, r)
+		key := "ip:" + clientIP(r, appCfg.TrustedProxies)
+		if !hasCredentials(r) {
+			if ok, wait := lim.allow(key, time.Now()); !ok {
+				tooManyRequests(w, r, key, kind, wait)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+		if ok, wait := lim.peek(key, time.Now()); !ok {
+			tooManyRequests(w, r, key, kind, wait)
+			return
+		}
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if rec.status == http.StatusUnauthorized && bearerToken(r) != "" {
+			// loadSession turned the token down
+			lim.allow(key, time.Now())
+		}
+	})
+}
+
+// limitUsers counts the requests that came with credentials against their API token or
+// user, or against their IP when the session had expired. It runs after loadSession;
+// everything else was counted by rateLimit.
+func limitUsers(reads, writes *limiter, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isStaticPath(r.URL.Path) || r.URL.Path == "/healthz" || !hasCredentials(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		lim, kind := limiterFor(reads, writes, r)
+		key := clientKey(r)
+		if ok, wait := lim.allow(key, time.Now()); !ok {
+			tooManyRequests(w, r, key, kind, wait)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// limiterFor picks the read or write limiter for a request's method
+func limiterFor(reads, writes *limiter, r *http.Request) (*limiter, string) {
+	if isSafeMethod(r.Method) {
+		return reads, "read"
+	}
+	return writes, "write"
+}
+
+// hasCredentials reports whether a request carries an API token or session cookie for
+// loadSession to look up
+func hasCredentials(r *http.Request) bool {
+	if bearerToken(r) != "" {
+		return true
+	}
+	c, err := r.Cookie(sessionCookie)
+	return err == nil && c.Value != ""
+}
+
+// tooManyRequests answers 429, telling the client when to try again
+func tooManyRequests(w http.ResponseWriter, r *http.Request, key, kind string, wait time.Duration) {
+	seconds := int(math.Ceil(wait.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", fmt.Sprint(seconds))
+	logFrom(r.Context()).WithFields(log.Fields{"func": "rateLimit", "client": key, "limit": kind, "retry_in": seconds}).Warn("rate limited")
+	renderError(w, r, &Error{Kind: ErrRateLimited, Op: "rateLimit",
+		Msg: fmt.Sprintf("Too many requests, please wait %d seconds and try again.", seconds)})
+}
+
+// clientKey names the bucket a request counts against
+func clientKey(r *http.Request) string {
+	if u := currentUser(r.Context()); u != nil {
+		if u.TokenID != 0 {
+			return fmt.Sprintf("token:%d", u.TokenID)
+		}
+		return fmt.Sprintf("user:%d", u.ID)
+	}
+	return "ip:" + clientIP(r, appCfg.TrustedProxies)
+}
+
+// clientIP returns the address of the client. When the connection comes from a trusted
+// proxy, X-Forwarded-For is read from the right, skipping trusted proxies, so a client
+// cannot pick its own address by sending the header itself.
+func clientIP(r *http.Request, trusted []*net.IPNet) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !ipTrusted(host, trusted) {
+		return host
+	}
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if net.ParseIP(hop) == nil {
+			break
+		}
+		host = hop
+		if !ipTrusted(hop, trusted) {
+			break
+		}
+	}
+	return host
+}
+
+// ipTrusted reports whether ip is in one of the trusted proxy networks
+func ipTrusted(ip string, trusted []*net.IPNet) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, n := range trusted {
+		if n.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
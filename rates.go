@@ -0,0 +1,415 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Exchange rate limits, matching the DECIMAL(18,8) rate column
+const (
+	maxRateDecimals = 8
+	maxRateDigits   = 10
+)
+
+// currencyCookie remembers the currency a visitor picked to see prices in
+const currencyCookie = "currency"
+
+// ExchangeRate is how many units of Currency one unit of the base currency buys, from
+// Effective (YYYY-MM-DD) until the next rate for the currency
+type ExchangeRate struct {
+	ID        int64    `json:"id"`
+	Currency  Currency `json:"currency"`
+	Rate      string   `json:"rate"`
+	Effective string   `json:"effective"`
+	Actor     string   `json:"actor"`
+}
+
+// rateTable holds the rate in effect for each currency on one day; the base currency is always 1
+type rateTable map[Currency]*big.Rat
+
+// rate returns the rate of c, false when c has none
+func (t rateTable) rate(c Currency) (*big.Rat, bool) {
+	if c == appCfg.BaseCurrency {
+		return big.NewRat(1, 1), true
+	}
+	r, ok := t[c]
+	return r, ok
+}
+
+// convert turns m into currency to, rounded the way to is. Money in a currency without
+// a rate can't be converted.
+func (t rateTable) convert(m Money, to Currency) (Money, error) {
+	if m.Currency == to {
+		return m, nil
+	}
+	from, ok := t.rate(m.Currency)
+	if !ok {
+		return Money{}, invalid("convert", "There is no exchange rate for %s.", m.Currency)
+	}
+	rate, ok := t.rate(to)
+	if !ok {
+		return Money{}, invalid("convert", "There is no exchange rate for %s.", to)
+	}
+	v := new(big.Rat).SetInt64(m.Cents)
+	v.Quo(v, from).Mul(v, rate)
+	return Money{Cents: roundRat(v, step(to)), Currency: to}, nil
+}
+
+// roundRat rounds v hundredths to a whole number of steps, half away from zero
+func roundRat(v *big.Rat, step int64) int64 {
+	q := new(big.Rat).Quo(v, new(big.Rat).SetInt64(step))
+	n, rem := new(big.Int).QuoRem(new(big.Int).Abs(q.Num()), q.Denom(), new(big.Int))
+	if rem.Lsh(rem, 1).Cmp(q.Denom()) >= 0 {
+		n.Add(n, big.NewInt(1))
+	}
+	if q.Sign() < 0 {
+		n.Neg(n)
+	}
+	return n.Int64() * step
+}
+
+// currencies lists the currencies prices can be shown in: the base currency first, then
+// every currency with a rate, by code
+func (t rateTable) currencies() []Currency {
+	list := []Currency{}
+	for c := range t {
+		list = append(list, c)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i] < list[j] })
+	return append([]Currency{appCfg.BaseCurrency}, list...)
+}
+
+// baseRange turns a price range in another currency into the range of base prices that
+// convert into it, so a search matches exactly the prices shown. A zero bound is open
+// and comes back as -1.
+func (t rateTable) baseRange(min, max Money) (lo, hi int64, err error) {
+	lo, hi = -1, -1
+	// smallest base price converting to at least limit (or more than it, when above)
+	first := func(limit Money, above bool) (int64, error) {
+		low, high := int64(0), int64(1)<<40
+		for low < high {
+			mid := low + (high-low)/2
+			m, err := t.convert(Money{Cents: mid, Currency: appCfg.BaseCurrency}, limit.Currency)
+			if err != nil {
+				return 0, err
+			}
+			if m.Cents > limit.Cents || (!above && m.Cents == limit.Cents) {
+				high = mid
+			} else {
+				low = mid + 1
+			}
+		}
+		return low, nil
+	}
+	if !min.IsZero() {
+		if lo, err = first(min, false); err != nil {
+			return 0, 0, err
+		}
+	}
+	if !max.IsZero() {
+		if hi, err = first(max, true); err != nil {
+			return 0, 0, err
+		}
+		hi--
+	}
+	return lo, hi, nil
+}
+
+// ratesOn loads the rates in effect on day (YYYY-MM-DD): the latest one from that day or before, per currency
+func ratesOn(ctx context.Context, day string) (rateTable, error) {
+	rows, err := readDB(ctx).QueryContext(ctx, `SELECT currency, rate FROM exchange_rates
+		WHERE effective_date <= ? ORDER BY currency, effective_date DESC;`, day)
+	if err != nil {
+		return nil, dbError("ratesOn", err)
+	}
+	defer rows.Close()
+	t := rateTable{}
+	for rows.Next() {
+		var c Currency
+		var rate string
+		if err := rows.Scan(&c, &rate); err != nil {
+			return nil, dbError("ratesOn", err)
+		}
+		if _, seen := t[c]; seen || c == appCfg.BaseCurrency {
+			continue
+		}
+		if _, known := currencies[c]; !known {
+			continue
+		}
+		r, ok := new(big.Rat).SetString(rate)
+		if !ok || r.Sign() <= 0 {
+			return nil, dbError("ratesOn", fmt.Errorf("rate %q for %s is not a positive number", rate, c))
+		}
+		t[c] = r
+	}
+	if err := rows.Err(); err != nil {
+		return nil, dbError("ratesOn", err)
+	}
+	return t, nil
+}
+
+// currentRates loads the rates in effect today
+func currentRates(ctx context.Context) (rateTable, error) {
+	return ratesOn(ctx, time.Now().UTC().Format(releaseDateLayout))
+}
+
+// allRates lists every rate, by currency and newest first
+func allRates(ctx context.Context) ([]ExchangeRate, error) {
+	rows, err := readDB(ctx).QueryContext(ctx, `SELECT id, currency, CAST(rate AS CHAR), CAST(effective_date AS CHAR), actor
+		FROM exchange_rates ORDER BY currency, effective_date DESC;`)
+	if err != nil {
+		return nil, dbError("allRates", err)
+	}
+	defer rows.Close()
+	rates := []ExchangeRate{}
+	for rows.Next() {
+		var r ExchangeRate
+		if err := rows.Scan(&r.ID, &r.Currency, &r.Rate, &r.Effective, &r.Actor); err != nil {
+			return nil, dbError("allRates", err)
+		}
+		rates = append(rates, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, dbError("allRates", err)
+	}
+	return rates, nil
+}
+
+// validateRate normalizes r and checks it, with a message per bad field. A blank
+// effective date is today.
+func validateRate(op string, r ExchangeRate) (ExchangeRate, error) {
+	r.Currency = Currency(strings.ToUpper(strings.TrimSpace(string(r.Currency))))
+	r.Rate = strings.TrimSpace(r.Rate)
+	r.Effective = strings.TrimSpace(r.Effective)
+	if r.Effective == "" {
+		r.Effective = time.Now().UTC().Format(releaseDateLayout)
+	}
+	fields := make(map[string]string)
+	if _, ok := currencies[r.Currency]; !ok {
+		fields["currency"] = fmt.Sprintf("%q is not a currency this app knows.", r.Currency)
+	} else if r.Currency == appCfg.BaseCurrency {
+		fields["currency"] = fmt.Sprintf("%s is the base currency, its rate is always 1.", r.Currency)
+	}
+	whole, frac, _ := strings.Cut(r.Rate, ".")
+	if rate, ok := new(big.Rat).SetString(r.Rate); !ok || whole == "" || !allDigits(whole) || !allDigits(frac) || rate.Sign() <= 0 {
+		fields["rate"] = fmt.Sprintf("%q is not a rate, use a number above 0 like 0.92.", r.Rate)
+	} else if len(strings.TrimLeft(whole, "0")) > maxRateDigits || len(frac) > maxRateDecimals {
+		fields["rate"] = fmt.Sprintf("Keep the rate to %d digits before the point and %d after it.", maxRateDigits, maxRateDecimals)
+	}
+	if _, err := time.Parse(releaseDateLayout, r.Effective); err != nil {
+		fields["effective"] = fmt.Sprintf("%q is not a date, use YYYY-MM-DD.", r.Effective)
+	}
+	if len(fields) > 0 {
+		return r, invalidFields(op, fields)
+	}
+	return r, nil
+}
+
+// setRate records the rate of a currency from a day on, replacing any rate already set for that day
+func setRate(ctx context.Context, r ExchangeRate) (ExchangeRate, error) {
+	r, err := validateRate("setRate", r)
+	if err != nil {
+		return r, err
+	}
+	userID, actor := actorFrom(ctx)
+	if _, err := db.ExecContext(ctx, `INSERT INTO exchange_rates (currency, rate, effective_date, user_id, actor) VALUES (?, ?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE rate = VALUES(rate), user_id = VALUES(user_id), actor = VALUES(actor);`,
+		r.Currency, r.Rate, r.Effective, userID, actor); err != nil {
+		return r, dbError("setRate", err)
+	}
+	r.Actor = actor
+	logFrom(ctx).WithFields(log.Fields{"func": "setRate", "currency": r.Currency, "rate": r.Rate, "effective": r.Effective}).Info("set exchange rate")
+	return r, nil
+}
+
+// deleteRate removes the rate of a currency set for one day
+func deleteRate(ctx context.Context, c Currency, effective string) error {
+	c = Currency(strings.ToUpper(strings.TrimSpace(string(c))))
+	result, err := db.ExecContext(ctx, "DELETE FROM exchange_rates WHERE currency = ? AND effective_date = ?;", c, strings.TrimSpace(effective))
+	if err != nil {
+		return dbError("deleteRate", err)
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return dbError("deleteRate", err)
+	} else if n == 0 {
+		return notFound("deleteRate", "There is no %s rate from %s.", c, effective)
+	}
+	logFrom(ctx).WithFields(log.Fields{"func": "deleteRate", "currency": c, "effective": effective}).Info("deleted exchange rate")
+	return nil
+}
+
+// requestedCurrency is the currency r asks for prices in: ?currency= (for the API), then the
+// currency cookie, then the base currency
+func requestedCurrency(r *http.Request) Currency {
+	c := r.URL.Query().Get("currency")
+	if c == "" {
+		if ck, err := r.Cookie(currencyCookie); err == nil {
+			c = ck.Value
+		}
+	}
+	cur := Currency(strings.ToUpper(strings.TrimSpace(c)))
+	if _, ok := currencies[cur]; !ok {
+		return appCfg.BaseCurrency
+	}
+	return cur
+}
+
+// displayCurrency is the currency prices are shown in for r: the one it asks for when that
+// has a rate today, the base currency otherwise
+func displayCurrency(r *http.Request) Currency {
+	cur := requestedCurrency(r)
+	if cur == appCfg.BaseCurrency {
+		return cur
+	}
+	rates, err := currentRates(r.Context())
+	if err != nil {
+		logFrom(r.Context()).WithError(err).Warn("showing prices in the base currency")
+		return appCfg.BaseCurrency
+	}
+	if _, ok := rates.rate(cur); !ok {
+		return appCfg.BaseCurrency
+	}
+	return cur
+}
+
+// attachDisplayPrices fills in each album's price in currency cur, at today's rates
+func attachDisplayPrices(ctx context.Context, albums []AlbumMap, cur Currency) error {
+	if cur == appCfg.BaseCurrency || len(albums) == 0 {
+		return nil
+	}
+	rates, err := currentRates(ctx)
+	if err != nil {
+		return err
+	}
+	for i := range albums {
+		p, err := rates.convert(albums[i].Price, cur)
+		if err != nil {
+			return err
+		}
+		albums[i].DisplayPrice = &p
+	}
+	return nil
+}
+
+// pagePrices shows the prices of one page in the visitor's currency, loading today's
+// rates the first time a price is shown. Without a rate prices stay in the base currency.
+type pagePrices struct {
+	r      *http.Request
+	rates  rateTable
+	loaded bool
+}
+
+// table returns the rates, empty when validating templates or when they can't be loaded
+func (p *pagePrices) table() rateTable {
+	if !p.loaded {
+		p.loaded, p.rates = true, rateTable{}
+		if p.r != nil {
+			rates, err := currentRates(p.r.Context())
+			if err != nil {
+				logFrom(p.r.Context()).WithError(err).Warn("showing prices in the base currency")
+			} else {
+				p.rates = rates
+			}
+		}
+	}
+	return p.rates
+}
+
+// currency is the currency the page shows prices in
+func (p *pagePrices) currency() Currency {
+	if p.r == nil {
+		return appCfg.BaseCurrency
+	}
+	cur := requestedCurrency(p.r)
+	if _, ok := p.table().rate(cur); !ok {
+		return appCfg.BaseCurrency
+	}
+	return cur
+}
+
+// format shows m in the page's currency
+func (p *pagePrices) format(m Money) string {
+	c, err := p.table().convert(m, p.currency())
+	if err != nil {
+		return m.String()
+	}
+	return c.String()
+}
+
+// currencyHandler - POST sets the currency prices are shown in and goes back to the page it came from
+func currencyHandler(w http.ResponseWriter, r *http.Request) {
+	back := "/"
+	if ref, err := url.Parse(r.Referer()); err == nil && ref.Host == r.Host {
+		back = localRedirect(ref.RequestURI())
+	}
+	if r.Method != http.MethodPost {
+		http.Redirect(w, r, back, http.StatusSeeOther)
+		return
+	}
+	cur := Currency(strings.ToUpper(strings.TrimSpace(r.FormValue("currency"))))
+	if _, ok := currencies[cur]; !ok {
+		renderError(w, r, invalid("currencyHandler", "%q is not a currency this app knows.", r.FormValue("currency")))
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     currencyCookie,
+		Value:    string(cur),
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   appCfg.CookieSecure,
+		SameSite: http.SameSiteLaxMode,
+		MaxAge:   365 * 24 * 60 * 60,
+	})
+	http.Redirect(w, r, back, http.StatusSeeOther)
+}
+
+// apiRatesPermissions says which permission each /api/rates method needs
+var apiRatesPermissions = map[string]Permission{
+	http.MethodGet:    PermAlbumRead,
+	http.MethodPost:   PermRatesManage,
+	http.MethodDelete: PermRatesManage,
+}
+
+// apiRatesHandler serves /api/rates: GET lists every rate, POST sets one from
+// {"currency", "rate", "effective"} and DELETE removes one named by ?currency= and ?effective=
+func apiRatesHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	switch r.Method {
+	case http.MethodGet:
+		rates, err := allRates(ctx)
+		if err != nil {
+			renderError(w, r, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, rates)
+	case http.MethodPost:
+		var in ExchangeRate
+		if err := decodeJSON(r, &in); err != nil {
+			renderError(w, r, err)
+			return
+		}
+		rate, err := setRate(ctx, ExchangeRate{Currency: in.Currency, Rate: in.Rate, Effective: in.Effective})
+		if err != nil {
+			renderError(w, r, err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, rate)
+	case http.MethodDelete:
+		q := r.URL.Query()
+		if err := deleteRate(ctx, Currency(q.Get("currency")), q.Get("effective")); err != nil {
+			renderError(w, r, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		methodNotAllowed(w, "GET, POST, DELETE")
+	}
+}
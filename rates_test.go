@@ -0,0 +1,124 @@
+package main
+
+import (
+	"math/big"
+	"testing"
+)
+
+func TestRoundRat(t *testing.T) {
+	for _, tc := range []struct {
+		v    string // hundredths
+		step int64
+		want int64
+	}{
+		{"124.4", 1, 124},
+		{"124.5", 1, 125},
+		{"-124.5", 1, -125},
+		{"-124.4", 1, -124},
+		{"1/2", 1, 1},
+		{"-1/2", 1, -1},
+		{"0", 1, 0},
+		{"1002.49", 5, 1000},
+		{"1002.5", 5, 1005},
+		{"-1002.5", 5, -1005},
+		{"-1002.49", 5, -1000},
+		{"8649.99", 100, 8600},
+		{"8650", 100, 8700},
+		{"-8650", 100, -8700},
+		{"-8649.99", 100, -8600},
+	} {
+		v, ok := new(big.Rat).SetString(tc.v)
+		if !ok {
+			t.Fatalf("bad rational %q", tc.v)
+		}
+		if got := roundRat(v, tc.step); got != tc.want {
+			t.Errorf("roundRat(%s, %d) = %d, want %d", tc.v, tc.step, got, tc.want)
+		}
+	}
+}
+
+// testRates is USD based, with a rate per rounding step
+func testRates(t *testing.T) rateTable {
+	t.Helper()
+	appCfg.BaseCurrency = "USD"
+	table := rateTable{}
+	for c, r := range map[Currency]string{"EUR": "0.9", "CHF": "0.88", "JPY": "150.5"} {
+		rate, ok := new(big.Rat).SetString(r)
+		if !ok {
+			t.Fatalf("bad rate %q", r)
+		}
+		table[c] = rate
+	}
+	return table
+}
+
+func TestConvert(t *testing.T) {
+	rates := testRates(t)
+	for _, tc := range []struct {
+		in   Money
+		to   Currency
+		want int64
+	}{
+		{Money{1000, "USD"}, "USD", 1000},
+		{Money{1000, "USD"}, "EUR", 900},
+		{Money{-1000, "USD"}, "EUR", -900},
+		{Money{1001, "USD"}, "CHF", 880},    // 880.88 hundredths, to 5 centimes
+		{Money{1004, "USD"}, "CHF", 885},    // 883.52
+		{Money{1000, "USD"}, "JPY", 150500}, // ¥1505
+		{Money{333, "USD"}, "JPY", 50100},   // 50116.5 hundredths, to whole yen
+		{Money{-333, "USD"}, "JPY", -50100},
+		{Money{900, "EUR"}, "JPY", 150500},
+		{Money{900, "EUR"}, "USD", 1000},
+	} {
+		got, err := rates.convert(tc.in, tc.to)
+		if err != nil || got.Cents != tc.want || got.Currency != tc.to {
+			t.Errorf("convert(%+v, %s) = %+v, %v, want %d", tc.in, tc.to, got, err, tc.want)
+		}
+	}
+	if _, err := rates.convert(Money{100, "USD"}, "GBP"); err == nil {
+		t.Error("convert to a currency without a rate did not fail")
+	}
+}
+
+func TestBaseRange(t *testing.T) {
+	rates := testRates(t)
+	for _, tc := range []struct {
+		name     string
+		min, max Money
+		lo, hi   int64
+	}{
+		{"open", Money{0, "EUR"}, Money{0, "EUR"}, -1, -1},
+		{"base currency", Money{1000, "USD"}, Money{2000, "USD"}, 1000, 2000},
+		{"exactly one converted price", Money{900, "EUR"}, Money{900, "EUR"}, 1000, 1000},
+		{"min only", Money{900, "EUR"}, Money{0, "EUR"}, 1000, -1},
+		{"max only", Money{0, "EUR"}, Money{900, "EUR"}, -1, 1000},
+		{"JPY whole yen", Money{150500, "JPY"}, Money{150500, "JPY"}, 1000, 1000},
+		{"CHF steps", Money{880, "CHF"}, Money{880, "CHF"}, 998, 1002},
+	} {
+		lo, hi, err := rates.baseRange(tc.min, tc.max)
+		if err != nil || lo != tc.lo || hi != tc.hi {
+			t.Errorf("%s: baseRange(%+v, %+v) = %d, %d, %v, want %d, %d", tc.name, tc.min, tc.max, lo, hi, err, tc.lo, tc.hi)
+			continue
+		}
+		// every base price inside converts into the range and the ones just outside don't
+		cur := tc.min.Currency
+		inRange := func(cents int64) bool {
+			m, err := rates.convert(Money{Cents: cents, Currency: "USD"}, cur)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return (tc.min.IsZero() || m.Cmp(tc.min) >= 0) && (tc.max.IsZero() || m.Cmp(tc.max) <= 0)
+		}
+		if lo > 0 && inRange(lo-1) {
+			t.Errorf("%s: %d is below the range but converts into it", tc.name, lo-1)
+		}
+		if hi >= 0 && inRange(hi+1) {
+			t.Errorf("%s: %d is above the range but converts into it", tc.name, hi+1)
+		}
+		for c := lo; lo >= 0 && hi >= 0 && c <= hi; c++ {
+			if !inRange(c) {
+				t.Errorf("%s: %d is in the range but converts outside it", tc.name, c)
+			}
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strings"
+)
+
+// pageTemplates lists every page template, checked by validateTemplates at startup
+var pageTemplates = []string{"search.html", "add.html", "delete.html", "dump.html", "test.html", "edit.html", "error.html", "login.html", "users.html", "tokens.html", "console.html", "album.html", "tags.html", "stock.html", "profile.html"}
+
+// validateTemplates parses every page template so a broken one stops the server at startup
+func validateTemplates() error {
+	for _, name := range pageTemplates {
+		if _, err := parseTemplate(nil, name); err != nil {
+			return fmt.Errorf("validateTemplates: %v", err)
+		}
+	}
+	return nil
+}
+
+// templateFuncs are the helpers every template can call; they answer for request r (nil when validating)
+func templateFuncs(r *http.Request) template.FuncMap {
+	prices := &pagePrices{r: r}
+	return template.FuncMap{
+		"user": func() *User {
+			if r == nil {
+				return nil
+			}
+			return currentUser(r.Context())
+		},
+		"csrfField": func() template.HTML {
+			if r == nil {
+				return ""
+			}
+			// the token is hex, so it needs no escaping
+			return template.HTML(fmt.Sprintf(`<input type="hidden" name="%s" value="%s">`, csrfField, csrfTokenFrom(r.Context())))
+		},
+		"minPrice":    priceLimit(minPrice).Decimal,
+		"maxPrice":    priceLimit(maxPrice).Decimal,
+		"priceSymbol": func() string { return currencies[appCfg.BaseCurrency].Symbol },
+		"price":       prices.format,
+		"currency":    prices.currency,
+		"thumbSize":   func() int { return appCfg.CoverThumbSize },
+		"currencies":  func() []Currency { return prices.table().currencies() },
+		"creditRoles": func() []CreditRole { return creditRoles },
+		"formats":     func() []AlbumFormat { return albumFormats },
+		"movements":   func() []MovementKind { return movementKinds },
+		"stars":       stars,
+		"ratings":     func() []int { return []int{5, 4, 3, 2, 1} },
+		"sorts":       func() []string { return albumSorts },
+		"duration":    formatDuration,
+		"lines":       func(s string) []string { return strings.Split(s, "\n") },
+		"can": func(p Permission) bool {
+			if r == nil {
+				return false
+			}
+			return can(r.Context(), p)
+		},
+	}
+}
+
+// parseTemplate parses a page template from the templates directory, along with the shared nav
+func parseTemplate(r *http.Request, name string) (*template.Template, error) {
+	return template.New(name).Funcs(templateFuncs(r)).ParseFiles("templates/"+name, "templates/nav.html")
+}
+
+// render executes the named page template with data. The page is buffered so a
+// template error becomes an error page instead of half a page.
+func render(w http.ResponseWriter, r *http.Request, name string, data interface{}) {
+	renderStatus(w, r, http.StatusOK, name, data)
+}
+
+// renderStatus is render with a status code other than 200
+func renderStatus(w http.ResponseWriter, r *http.Request, status int, name string, data interface{}) {
+	tmpl, err := parseTemplate(r, name)
+	if err != nil {
+		renderError(w, r, fmt.Errorf("render %s: %v", name, err))
+		return
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		renderError(w, r, fmt.Errorf("render %s: %v", name, err))
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	buf.WriteTo(w)
+}
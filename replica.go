@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	log "github.com/sirupsen/logrus"
+)
+
+// replica is one read replica and what the last check found
+type replica struct {
+	name    string
+	db      *sql.DB
+	healthy atomic.Bool
+}
+
+// replicaSet spreads reads over the healthy replicas
+type replicaSet struct {
+	list   []*replica
+	next   atomic.Uint32
+	maxLag time.Duration
+}
+
+// replicas is nil unless DB_REPLICAS is set; readDB falls back to the primary without it
+var replicas *replicaSet
+
+// primaryKey is the context key marking requests whose reads must see the primary
+type primaryKey struct{}
+
+// withPrimary returns a copy of ctx whose reads go to the primary
+func withPrimary(ctx context.Context) context.Context {
+	return context.WithValue(ctx, primaryKey{}, true)
+}
+
+// readDB returns the handle reads on ctx should use: a healthy replica, picked round
+// robin, or the primary when the request is pinned to it or no replica is usable
+func readDB(ctx context.Context) *sql.DB {
+	if pinned, _ := ctx.Value(primaryKey{}).(bool); pinned || replicas == nil {
+		return db
+	}
+	n := len(replicas.list)
+	start := int(replicas.next.Add(1))
+	for i := 0; i < n; i++ {
+		r := replicas.list[(start+i)%n]
+		if r.healthy.Load() {
+			return r.db
+		}
+	}
+	return db
+}
+
+// replicaConfig builds the driver config for one DB_REPLICAS entry: a bare host:port from
+// replicaAddrConfig, a full DSN as it is
+func replicaConfig(cfg Config, entry string) (*mysql.Config, error) {
+	if !strings.Contains(entry, "/") {
+		return mysqlConfig(replicaAddrConfig(cfg, entry))
+	}
+	my, err := mysql.ParseDSN(entry)
+	if err != nil {
+		return nil, fmt.Errorf("DB_REPLICAS: %v", err)
+	}
+	my.ParseTime = true
+	return my, nil
+}
+
+// replicaAddrConfig is the config of a bare host:port replica. It shares the primary's
+// credentials, database and TLS settings, but its certificate is verified against its own
+// host rather than DB_TLS_SERVER_NAME.
+func replicaAddrConfig(cfg Config, addr string) Config {
+	c := cfg
+	c.DBAddr = addr
+	c.DBTLSServerName = ""
+	return c
+}
+
+// openReplicas opens a pool per replica and checks each one once. Replicas that are
+// down are kept and retried by monitor; they just get no reads until they recover.
+func openReplicas(ctx context.Context, cfg Config) (*replicaSet, error) {
+	set := &replicaSet{maxLag: cfg.DBReplicaMaxLag}
+	for _, entry := range cfg.DBReplicas {
+		my, err := replicaConfig(cfg, entry)
+		if err != nil {
+			return nil, err
+		}
+		// host:port replicas share the primary's (rotating) credentials, full DSNs bring their own
+		conn := sql.OpenDB(newDBConnector(my, !strings.Contains(entry, "/")))
+		conn.SetMaxOpenConns(cfg.DBMaxOpenConns)
+		conn.SetMaxIdleConns(cfg.DBMaxIdleConns)
+		conn.SetConnMaxLifetime(cfg.DBConnMaxLifetime)
+		set.list = append(set.list, &replica{name: my.Addr, db: conn})
+	}
+	set.checkAll(ctx, cfg.DBHealthInterval)
+	return set, nil
+}
+
+// monitor re-checks every replica each interval until ctx is done
+func (s *replicaSet) monitor(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		s.checkAll(ctx, interval)
+	}
+}
+
+// checkAll checks the replicas in parallel, each with at most timeout
+func (s *replicaSet) checkAll(ctx context.Context, timeout time.Duration) {
+	var wg sync.WaitGroup
+	for _, r := range s.list {
+		wg.Add(1)
+		go func(r *replica) {
+			defer wg.Done()
+			checkCtx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+			s.check(checkCtx, r)
+		}(r)
+	}
+	wg.Wait()
+}
+
+// check marks r healthy when it answers and is no more than maxLag behind the primary
+func (s *replicaSet) check(ctx context.Context, r *replica) {
+	l := log.WithFields(log.Fields{"func": "replicaSet.check", "replica": r.name})
+	lag, err := replicaLag(ctx, r.db)
+	if err == nil && lag > s.maxLag {
+		err = fmt.Errorf("%v behind the primary, the limit is %v", lag, s.maxLag)
+	}
+	healthy := err == nil
+	if r.healthy.Swap(healthy) != healthy {
+		if healthy {
+			l.WithField("lag", lag.String()).Info("replica back in rotation")
+		} else {
+			l.WithError(err).Warn("replica taken out of rotation")
+		}
+	}
+}
+
+// replicaLag asks a replica how far behind its source it is. SHOW REPLICA STATUS is
+// MySQL 8.0.22+; older servers only know SHOW SLAVE STATUS.
+func replicaLag(ctx context.Context, conn *sql.DB) (time.Duration, error) {
+	status, err := showStatus(ctx, conn, "SHOW REPLICA STATUS;")
+	if err != nil {
+		var myErr *mysql.MySQLError
+		if !errors.As(err, &myErr) {
+			return 0, err
+		}
+		if status, err = showStatus(ctx, conn, "SHOW SLAVE STATUS;"); err != nil {
+			return 0, err
+		}
+	}
+	if status == nil {
+		return 0, fmt.Errorf("not configured as a replica")
+	}
+	behind, ok := status["Seconds_Behind_Source"]
+	if !ok {
+		behind, ok = status["Seconds_Behind_Master"]
+	}
+	if !ok || !behind.Valid {
+		// NULL: the replication threads are stopped
+		return 0, fmt.Errorf("replication is not running")
+	}
+	seconds, err := strconv.ParseInt(behind.String, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("unexpected lag %q", behind.String)
+	}
+	return time.Duration(seconds) * time.Second, nil
+}
+
+// showStatus runs a SHOW statement and returns its first row by column name, or nil if it has none
+func showStatus(ctx context.Context, conn *sql.DB, query string) (map[string]sql.NullString, error) {
+	rows, err := conn.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	cols, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	if !rows.Next() {
+		return nil, rows.Err()
+	}
+	values := make([]sql.NullString, len(cols))
+	dest := make([]interface{}, len(cols))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	if err := rows.Scan(dest...); err != nil {
+		return nil, err
+	}
+	status := make(map[string]sql.NullString, len(cols))
+	for i, col := range cols {
+		status[col] = values[i]
+	}
+	return status, nil
+}
+
+// recentWriters remembers when each client last wrote, so its next reads can be sent
+// to the primary and it sees its own change even if the replicas are a little behind
+type recentWriters struct {
+	mu     sync.Mutex
+	window time.Duration
+	last   map[string]time.Time
+}
+
+// newRecentWriters returns a tracker pinning clients for window after each write
+func newRecentWriters(window time.Duration) *recentWriters {
+	return &recentWriters{window: window, last: make(map[string]time.Time)}
+}
+
+// wrote records a write by key
+func (rw *recentWriters) wrote(key string, now time.Time) {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	rw.last[key] = now
+	// drop clients whose window is over so the map stays small
+	for k, t := range rw.last {
+		if now.Sub(t) > rw.window {
+			delete(rw.last, k)
+		}
+	}
+}
+
+// pinned reports whether key wrote within the window
+func (rw *recentWriters) pinned(key string, now time.Time) bool {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	t, ok := rw.last[key]
+	return ok && now.Sub(t) <= rw.window
+}
+
+// pinWrites sends every read of a write request, and the reads of a client that wrote
+// within the read-your-writes window, to the primary
+func pinWrites(writers *recentWriters, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if replicas == nil || isStaticPath(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		key := clientKey(r)
+		now := time.Now()
+		if !isSafeMethod(r.Method) {
+			writers.wrote(key, now)
+			r = r.WithContext(withPrimary(r.Context()))
+		} else if writers.pinned(key, now) {
+			r = r.WithContext(withPrimary(r.Context()))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReplicaTLSServerNames(t *testing.T) {
+	cert, err := selfSignedCert()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(ca, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg := Config{DBUser: "app", DBPass: "secret", DBName: "music", DBAddr: "primary.db:3306",
+		DBTLS: "true", DBTLSCA: ca, DBTLSServerName: "mysql.internal"}
+
+	primary, err := mysqlConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "custom-primary.db:3306"; primary.TLSConfig != want {
+		t.Errorf("primary: TLSConfig = %q, want %q", primary.TLSConfig, want)
+	}
+	if tlsCfg, err := mysqlTLSConfig(cfg); err != nil || tlsCfg.ServerName != "mysql.internal" {
+		t.Errorf("primary: mysqlTLSConfig = %v, %v, want ServerName %q", tlsCfg, err, "mysql.internal")
+	}
+
+	for _, tc := range []struct{ entry, host string }{
+		{"replica-1.db:3306", "replica-1.db"},
+		{"replica-2.db:3306", "replica-2.db"},
+	} {
+		my, err := replicaConfig(cfg, tc.entry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := "custom-" + tc.entry; my.TLSConfig != want {
+			t.Errorf("%s: TLSConfig = %q, want %q", tc.entry, my.TLSConfig, want)
+		}
+		tlsCfg, err := mysqlTLSConfig(replicaAddrConfig(cfg, tc.entry))
+		if err != nil || tlsCfg.ServerName != tc.host {
+			t.Errorf("%s: mysqlTLSConfig = %v, %v, want ServerName %q", tc.entry, tlsCfg, err, tc.host)
+		}
+	}
+
+	// the replicas registering their configs left the primary's name alone
+	again, err := mysqlConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.TLSConfig != primary.TLSConfig {
+		t.Errorf("primary again: TLSConfig = %q, want %q", again.TLSConfig, primary.TLSConfig)
+	}
+
+	// full DSN replicas bring their own TLS settings
+	my, err := replicaConfig(cfg, "ro:pass@tcp(replica-3.db:3306)/music?tls=skip-verify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if my.TLSConfig != "skip-verify" {
+		t.Errorf("DSN replica: TLSConfig = %q, want %q", my.TLSConfig, "skip-verify")
+	}
+}
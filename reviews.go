@@ -0,0 +1,557 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Review limits: ratings are whole stars and the text fits comfortably in the TEXT column
+const (
+	minRating    = 1
+	maxRating    = 5
+	maxReviewLen = 5000
+)
+
+// Review is one user's rating of an album, with optional text. Hidden reviews were
+// taken down by a moderator: only their author and moderators see them and they don't
+// count towards the album's rating. ModeratedBy is who last hid, showed or edited it for its author.
+type Review struct {
+	ID          int64     `json:"id"`
+	AlbumID     int64     `json:"album_id"`
+	UserID      int64     `json:"user_id"`
+	Username    string    `json:"username"`
+	Rating      int       `json:"rating"`
+	Text        string    `json:"text,omitempty"`
+	Hidden      bool      `json:"hidden"`
+	ModeratedBy string    `json:"moderated_by,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// RatingSummary is an album's average rating over its visible reviews, and how many there are
+type RatingSummary struct {
+	Average float64 `json:"average"`
+	Count   int     `json:"count"`
+}
+
+// Stars is the average rounded to whole stars
+func (s RatingSummary) Stars() int {
+	return int(math.Round(s.Average))
+}
+
+// stars draws a rating of n out of maxRating stars
+func stars(n int) string {
+	if n < 0 {
+		n = 0
+	}
+	if n > maxRating {
+		n = maxRating
+	}
+	return strings.Repeat("★", n) + strings.Repeat("☆", maxRating-n)
+}
+
+// albumSorts are the orders album lists can be put in besides the default: best rated
+// first, or most reviewed first
+var albumSorts = []string{"title", "rating", "reviews"}
+
+// validSort reports whether s is one of albumSorts
+func validSort(s string) bool {
+	for _, have := range albumSorts {
+		if have == s {
+			return true
+		}
+	}
+	return false
+}
+
+// reviewColumns selects a review, aliased r, with its author's name
+const reviewColumns = `r.id, r.album_id, r.user_id, u.username, r.rating, r.body, r.hidden, COALESCE(r.moderated_by, ''),
+	r.created_at, r.updated_at FROM reviews r JOIN users u ON u.id = r.user_id`
+
+// scanFields are the scan destinations for reviewColumns
+func (rv *Review) scanFields() []interface{} {
+	return []interface{}{&rv.ID, &rv.AlbumID, &rv.UserID, &rv.Username, &rv.Rating, &rv.Text, &rv.Hidden, &rv.ModeratedBy,
+		&rv.CreatedAt, &rv.UpdatedAt}
+}
+
+// ratingSummaries loads the ratings of the given albums, keyed by album id; albums
+// nobody has reviewed are left out
+func ratingSummaries(ctx context.Context, q queryer, ids []int64) (map[int64]RatingSummary, error) {
+	summaries := make(map[int64]RatingSummary, len(ids))
+	if len(ids) == 0 {
+		return summaries, nil
+	}
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	rows, err := q.QueryContext(ctx, `SELECT album_id, AVG(rating), COUNT(*) FROM reviews
+		WHERE hidden = FALSE AND album_id IN (?`+strings.Repeat(", ?", len(ids)-1)+`) GROUP BY album_id;`, args...)
+	if err != nil {
+		return nil, dbError("ratingSummaries", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int64
+		var s RatingSummary
+		if err := rows.Scan(&id, &s.Average, &s.Count); err != nil {
+			return nil, dbError("ratingSummaries", err)
+		}
+		s.Average = math.Round(s.Average*100) / 100
+		summaries[id] = s
+	}
+	if err := rows.Err(); err != nil {
+		return nil, dbError("ratingSummaries", err)
+	}
+	return summaries, nil
+}
+
+// attachRatings fills in the rating of each album
+func attachRatings(ctx context.Context, albums []AlbumMap) error {
+	ids := make([]int64, len(albums))
+	for i, a := range albums {
+		ids[i] = a.ID
+	}
+	summaries, err := ratingSummaries(ctx, readDB(ctx), ids)
+	if err != nil {
+		return err
+	}
+	for i := range albums {
+		albums[i].Rating = summaries[albums[i].ID]
+	}
+	return nil
+}
+
+// sortAlbums puts albums with their ratings attached in the order by names, the way
+// albumsByFilter orders them; "" leaves them as they are
+func sortAlbums(albums []AlbumMap, by string) {
+	less := map[string]func(a, b AlbumMap) bool{
+		"title": func(a, b AlbumMap) bool { return a.Title < b.Title },
+		"rating": func(a, b AlbumMap) bool {
+			if (a.Rating.Count == 0) != (b.Rating.Count == 0) {
+				return b.Rating.Count == 0
+			}
+			if a.Rating.Average != b.Rating.Average {
+				return a.Rating.Average > b.Rating.Average
+			}
+			return a.Rating.Count > b.Rating.Count
+		},
+		"reviews": func(a, b AlbumMap) bool {
+			if a.Rating.Count != b.Rating.Count {
+				return a.Rating.Count > b.Rating.Count
+			}
+			return a.Rating.Average > b.Rating.Average
+		},
+	}[by]
+	if less == nil {
+		return
+	}
+	sort.SliceStable(albums, func(i, j int) bool { return less(albums[i], albums[j]) })
+}
+
+// ratingOrder is the ORDER BY for albumsByFilter's sort, with the join it needs to see ratings
+func ratingOrder(by string) (join, order string) {
+	const ratings = ` LEFT JOIN (SELECT album_id, AVG(rating) AS average, COUNT(*) AS count FROM reviews
+		WHERE hidden = FALSE GROUP BY album_id) rs ON rs.album_id = a.id`
+	switch by {
+	case "rating":
+		return ratings, " ORDER BY rs.average IS NULL, rs.average DESC, rs.count DESC, a.title, a.id"
+	case "reviews":
+		return ratings, " ORDER BY COALESCE(rs.count, 0) DESC, rs.average DESC, a.title, a.id"
+	}
+	return "", " ORDER BY a.title, a.id"
+}
+
+// moderator reports whether ctx may hide, edit and delete anyone's reviews: a user with
+// reviews:moderate, or the CLI
+func moderator(ctx context.Context) bool {
+	if u := currentUser(ctx); u != nil {
+		return u.Can(PermReviewsModerate)
+	}
+	_, cli := ctx.Value(actorKey{}).(string)
+	return cli
+}
+
+// albumReviews lists an album's reviews, most recently changed first. Hidden ones are
+// only listed for moderators and their authors.
+func albumReviews(ctx context.Context, albumID int64) ([]Review, error) {
+	var userID int64
+	if u := currentUser(ctx); u != nil {
+		userID = u.ID
+	}
+	rows, err := readDB(ctx).QueryContext(ctx, "SELECT "+reviewColumns+`
+		WHERE r.album_id = ? AND (r.hidden = FALSE OR ? OR r.user_id = ?) ORDER BY r.updated_at DESC, r.id DESC;`,
+		albumID, moderator(ctx), userID)
+	if err != nil {
+		return nil, dbError("albumReviews", err)
+	}
+	defer rows.Close()
+	reviews := []Review{}
+	for rows.Next() {
+		var rv Review
+		if err := rows.Scan(rv.scanFields()...); err != nil {
+			return nil, dbError("albumReviews", err)
+		}
+		reviews = append(reviews, rv)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, dbError("albumReviews", err)
+	}
+	return reviews, nil
+}
+
+// reviewByID returns one review; a hidden one only to a moderator or its author
+func reviewByID(ctx context.Context, id int64) (Review, error) {
+	var rv Review
+	err := readDB(ctx).QueryRowContext(ctx, "SELECT "+reviewColumns+" WHERE r.id = ?;", id).Scan(rv.scanFields()...)
+	if err == sql.ErrNoRows || (err == nil && rv.Hidden && !moderator(ctx) && !ownReview(ctx, rv)) {
+		return Review{}, notFound("reviewByID", "There is no review with id %d.", id)
+	}
+	if err != nil {
+		return Review{}, dbError("reviewByID", err)
+	}
+	return rv, nil
+}
+
+// ownReview reports whether rv was written by the user on ctx
+func ownReview(ctx context.Context, rv Review) bool {
+	u := currentUser(ctx)
+	return u != nil && u.ID == rv.UserID
+}
+
+// validateReview normalizes rv's text (keeping line breaks) and checks the rating and length
+func validateReview(op string, rv Review) (Review, error) {
+	rv.Text = normalizeNotes(rv.Text)
+	fields := make(map[string]string)
+	if rv.Rating < minRating || rv.Rating > maxRating {
+		fields["rating"] = fmt.Sprintf("Give %d to %d stars.", minRating, maxRating)
+	}
+	if n := utf8.RuneCountInString(rv.Text); n > maxReviewLen {
+		fields["text"] = fmt.Sprintf("Keep the review to %d characters (this is %d).", maxReviewLen, n)
+	}
+	if len(fields) > 0 {
+		return rv, invalidFields(op, fields)
+	}
+	return rv, nil
+}
+
+// saveReview writes a review by the user on ctx. Without an id it is their review of
+// rv.AlbumID, added or replaced (a user has one review per album); with one it edits that
+// review, which has to be theirs unless they moderate. A hidden review stays hidden.
+func saveReview(ctx context.Context, rv Review) (Review, error) {
+	u := currentUser(ctx)
+	if u == nil {
+		return rv, &Error{Kind: ErrUnauthenticated, Op: "saveReview", Msg: "Log in to review albums."}
+	}
+	rv, err := validateReview("saveReview", rv)
+	if err != nil {
+		return rv, err
+	}
+	l := logFrom(ctx).WithFields(log.Fields{"func": "saveReview", "rating": rv.Rating})
+
+	if rv.ID != 0 {
+		old, err := reviewByID(withPrimary(ctx), rv.ID)
+		if err != nil {
+			return rv, err
+		}
+		moderatedBy := old.ModeratedBy
+		if old.UserID != u.ID {
+			if !moderator(ctx) {
+				return rv, &Error{Kind: ErrForbidden, Op: "saveReview", Msg: "You can only change your own reviews."}
+			}
+			moderatedBy = u.Username
+		}
+		if _, err := db.ExecContext(ctx, "UPDATE reviews SET rating = ?, body = ?, moderated_by = NULLIF(?, '') WHERE id = ?;",
+			rv.Rating, rv.Text, moderatedBy, rv.ID); err != nil {
+			return rv, dbError("saveReview", err)
+		}
+		l.WithFields(log.Fields{"review_id": rv.ID, "album_id": old.AlbumID}).Info("edited review")
+		return reviewByID(withPrimary(ctx), rv.ID)
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return rv, dbError("saveReview", err)
+	}
+	defer tx.Rollback()
+	var exists int
+	if err := tx.QueryRowContext(ctx, "SELECT 1 FROM album WHERE id = ? FOR UPDATE;", rv.AlbumID).Scan(&exists); err == sql.ErrNoRows {
+		return rv, notFound("saveReview", "There is no album with id %d.", rv.AlbumID)
+	} else if err != nil {
+		return rv, dbError("saveReview", err)
+	}
+	if _, err := tx.ExecContext(ctx, `INSERT INTO reviews (album_id, user_id, rating, body) VALUES (?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE rating = VALUES(rating), body = VALUES(body);`, rv.AlbumID, u.ID, rv.Rating, rv.Text); err != nil {
+		return rv, dbError("saveReview", err)
+	}
+	if err := tx.QueryRowContext(ctx, "SELECT "+reviewColumns+" WHERE r.album_id = ? AND r.user_id = ?;", rv.AlbumID, u.ID).
+		Scan(rv.scanFields()...); err != nil {
+		return rv, dbError("saveReview", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return rv, dbError("saveReview", err)
+	}
+	l.WithFields(log.Fields{"review_id": rv.ID, "album_id": rv.AlbumID}).Info("saved review")
+	return rv, nil
+}
+
+// setReviewHidden hides a review from everyone but its author and moderators, or shows it again
+func setReviewHidden(ctx context.Context, id int64, hidden bool) (Review, error) {
+	if !moderator(ctx) {
+		return Review{}, &Error{Kind: ErrForbidden, Op: "setReviewHidden", Msg: "Only moderators can hide reviews."}
+	}
+	_, actor := actorFrom(ctx)
+	result, err := db.ExecContext(ctx, "UPDATE reviews SET hidden = ?, moderated_by = ? WHERE id = ?;", hidden, actor, id)
+	if err != nil {
+		return Review{}, dbError("setReviewHidden", err)
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return Review{}, dbError("setReviewHidden", err)
+	} else if n == 0 {
+		// nothing changed is also 0 rows, so look before calling it missing
+		if _, err := reviewByID(withPrimary(ctx), id); err != nil {
+			return Review{}, err
+		}
+	}
+	logFrom(ctx).WithFields(log.Fields{"func": "setReviewHidden", "review_id": id, "hidden": hidden}).Info("moderated review")
+	return reviewByID(withPrimary(ctx), id)
+}
+
+// deleteReview removes a review; users may delete their own, moderators anyone's
+func deleteReview(ctx context.Context, id int64) (Review, error) {
+	rv, err := reviewByID(withPrimary(ctx), id)
+	if err != nil {
+		return rv, err
+	}
+	if !ownReview(ctx, rv) && !moderator(ctx) {
+		return rv, &Error{Kind: ErrForbidden, Op: "deleteReview", Msg: "You can only delete your own reviews."}
+	}
+	if _, err := db.ExecContext(ctx, "DELETE FROM reviews WHERE id = ?;", id); err != nil {
+		return rv, dbError("deleteReview", err)
+	}
+	logFrom(ctx).WithFields(log.Fields{"func": "deleteReview", "review_id": id, "album_id": rv.AlbumID}).Info("deleted review")
+	return rv, nil
+}
+
+// ReviewForm is the review form as the user filled it in, with any error per field
+type ReviewForm struct {
+	ID     int64
+	Rating string
+	Text   string
+	Errors map[string]string
+}
+
+// reviewHandler - POST from the album page: save_review adds or edits a review, delete_review
+// deletes one and hide_review and show_review moderate one. The album page comes back with the outcome.
+func reviewHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if r.Method != http.MethodPost {
+		http.Redirect(w, r, "/album?id="+url.QueryEscape(r.FormValue("id")), http.StatusSeeOther)
+		return
+	}
+	albumID, err := strconv.ParseInt(r.FormValue("id"), 10, 64)
+	if err != nil {
+		renderError(w, r, notFound("reviewHandler", "There is no album %q.", r.FormValue("id")))
+		return
+	}
+	action := r.FormValue("action")
+	l := logFrom(ctx).WithFields(log.Fields{"func": "reviewHandler", "album_id": albumID, "action": action})
+	page := albumPage{}
+
+	// edits, deletes and moderation name a review, which has to be on this album
+	var rv Review
+	var reviewID int64
+	if s := r.FormValue("review_id"); s != "" {
+		if reviewID, err = strconv.ParseInt(s, 10, 64); err != nil {
+			err = notFound("reviewHandler", "There is no review %q.", s)
+		} else if rv, err = reviewByID(ctx, reviewID); err == nil && rv.AlbumID != albumID {
+			err = notFound("reviewHandler", "Album %d has no review %d.", albumID, reviewID)
+		}
+	} else if action != "save_review" {
+		err = notFound("reviewHandler", "Pick a review.")
+	}
+	if err == nil {
+		switch action {
+		case "save_review":
+			page.ReviewForm = ReviewForm{ID: reviewID, Rating: r.FormValue("rating"), Text: r.FormValue("text")}
+			rating, convErr := strconv.Atoi(page.ReviewForm.Rating)
+			if convErr != nil {
+				err = invalidFields("reviewHandler", map[string]string{"rating": fmt.Sprintf("Give %d to %d stars.", minRating, maxRating)})
+			} else if rv, err = saveReview(ctx, Review{ID: reviewID, AlbumID: albumID, Rating: rating, Text: page.ReviewForm.Text}); err == nil {
+				page.Message = fmt.Sprintf("Saved %s's review, %d of %d stars.", rv.Username, rv.Rating, maxRating)
+				page.ReviewForm = ReviewForm{}
+			}
+		case "delete_review":
+			if rv, err = deleteReview(ctx, reviewID); err == nil {
+				page.Message = fmt.Sprintf("Deleted %s's review.", rv.Username)
+			}
+		case "hide_review", "show_review":
+			if rv, err = setReviewHidden(ctx, reviewID, action == "hide_review"); err == nil {
+				page.Message = fmt.Sprintf("%s's review is shown again.", rv.Username)
+				if rv.Hidden {
+					page.Message = fmt.Sprintf("Hid %s's review.", rv.Username)
+				}
+			}
+		default:
+			err = invalid("reviewHandler", "Unknown action %q.", action)
+		}
+	}
+	if status, _ := errorStatus(err); err != nil && status >= http.StatusInternalServerError {
+		renderError(w, r, err)
+		return
+	}
+	page.Success = err == nil
+	if err != nil {
+		page.Message = errorMessage(err)
+		if action == "save_review" && page.ReviewForm.ID == 0 {
+			page.ReviewForm.Errors = fieldErrors(err)
+		} else if fields := fieldErrors(err); len(fields) > 0 {
+			page.Message = fieldMessages(fields)
+		}
+		l.WithError(err).Warn("review change rejected")
+	} else {
+		l.WithField("review_id", rv.ID).Info("changed review")
+	}
+	renderAlbumPage(w, r, albumID, page)
+}
+
+// apiAlbumReviewsPermissions: anyone who can read albums can read reviews, writing one needs reviews:write
+var apiAlbumReviewsPermissions = map[string]Permission{
+	http.MethodGet:  PermAlbumRead,
+	http.MethodPost: PermReviewsWrite,
+}
+
+// apiAlbumReviewsHandler serves /api/albums/{id}/reviews: GET lists the album's reviews,
+// POST adds or replaces the caller's own from {"rating": 4, "text": "..."}
+func apiAlbumReviewsHandler(w http.ResponseWriter, r *http.Request, albumID int64) {
+	ctx := r.Context()
+	switch r.Method {
+	case http.MethodGet:
+		// the album must exist, an empty list means nobody has reviewed it yet
+		if _, err := albumByID(ctx, albumID); err != nil {
+			renderError(w, r, err)
+			return
+		}
+		reviews, err := albumReviews(ctx, albumID)
+		if err != nil {
+			renderError(w, r, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, reviews)
+	case http.MethodPost:
+		var in reviewInput
+		if err := decodeJSON(r, &in); err != nil {
+			renderError(w, r, err)
+			return
+		}
+		rv, err := saveReview(ctx, in.apply(Review{AlbumID: albumID}))
+		if err != nil {
+			renderError(w, r, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, rv)
+	default:
+		methodNotAllowed(w, "GET, POST")
+	}
+}
+
+// reviewInput is the JSON body that writes a review; only moderators may set hidden.
+// Fields left out are nil, so an edit can change one of them on its own.
+type reviewInput struct {
+	Rating *int    `json:"rating"`
+	Text   *string `json:"text"`
+	Hidden *bool   `json:"hidden"`
+}
+
+// apply copies the rating and text that were sent onto rv
+func (in reviewInput) apply(rv Review) Review {
+	if in.Rating != nil {
+		rv.Rating = *in.Rating
+	}
+	if in.Text != nil {
+		rv.Text = *in.Text
+	}
+	return rv
+}
+
+// apiReviewPermissions: changing a review needs reviews:write, whose it is is checked by saveReview and deleteReview
+var apiReviewPermissions = map[string]Permission{
+	http.MethodGet:    PermAlbumRead,
+	http.MethodPut:    PermReviewsWrite,
+	http.MethodDelete: PermReviewsWrite,
+}
+
+// apiReviewHandler serves /api/reviews/{id}: GET, PUT (rating and text, and hidden for
+// moderators; a body with only hidden leaves the review as its author wrote it) and DELETE
+func apiReviewHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	id, err := strconv.ParseInt(strings.TrimPrefix(r.URL.Path, "/api/reviews/"), 10, 64)
+	if err != nil || id <= 0 {
+		renderError(w, r, notFound("apiReviewHandler", "There is no review at %s.", r.URL.Path))
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		rv, err := reviewByID(ctx, id)
+		if err != nil {
+			renderError(w, r, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, rv)
+	case http.MethodPut:
+		var in reviewInput
+		if err := decodeJSON(r, &in); err != nil {
+			renderError(w, r, err)
+			return
+		}
+		if in.Hidden != nil && !moderator(ctx) {
+			renderError(w, r, &Error{Kind: ErrForbidden, Op: "apiReviewHandler", Msg: "Only moderators can hide reviews."})
+			return
+		}
+		if in.Rating == nil && in.Text == nil && in.Hidden == nil {
+			renderError(w, r, invalid("apiReviewHandler", "Send a rating, text or hidden."))
+			return
+		}
+		var rv Review
+		edit := in.Rating != nil || in.Text != nil
+		if edit {
+			// what was left out stays as it is
+			old, err := reviewByID(withPrimary(ctx), id)
+			if err != nil {
+				renderError(w, r, err)
+				return
+			}
+			if rv, err = saveReview(ctx, in.apply(Review{ID: id, Rating: old.Rating, Text: old.Text})); err != nil {
+				renderError(w, r, err)
+				return
+			}
+		}
+		if in.Hidden != nil && (!edit || *in.Hidden != rv.Hidden) {
+			rv, err = setReviewHidden(ctx, id, *in.Hidden)
+		}
+		if err != nil {
+			renderError(w, r, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, rv)
+	case http.MethodDelete:
+		if _, err := deleteReview(ctx, id); err != nil {
+			renderError(w, r, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		methodNotAllowed(w, "GET, PUT, DELETE")
+	}
+}
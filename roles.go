@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+)
+
+// Role is what a user account is allowed to do
+type Role string
+
+const (
+	RoleViewer Role = "viewer" // search, dump and review albums and keep album lists
+	RoleEditor Role = "editor" // viewer + add and edit albums
+	RoleAdmin  Role = "admin"  // editor + delete albums, moderate reviews, manage users and exchange rates and use the SQL console
+)
+
+// roles lists the roles from least to most privileged
+var roles = []Role{RoleViewer, RoleEditor, RoleAdmin}
+
+// Permission is a single action that can be allowed or denied
+type Permission string
+
+const (
+	PermAlbumRead       Permission = "album:read"
+	PermAlbumAdd        Permission = "album:add"
+	PermAlbumEdit       Permission = "album:edit"
+	PermAlbumDelete     Permission = "album:delete"
+	PermUsersManage     Permission = "users:manage"
+	PermTokensOwn       Permission = "tokens:own"       // create and revoke your own API tokens
+	PermSQLConsole      Permission = "sql:console"      // run read-only SQL at /console
+	PermRatesManage     Permission = "rates:manage"     // set and delete exchange rates
+	PermReviewsWrite    Permission = "reviews:write"    // rate and review albums, and edit and delete your own reviews
+	PermReviewsModerate Permission = "reviews:moderate" // hide, edit and delete anyone's reviews
+	PermListsOwn        Permission = "lists:own"        // keep your own favorites, wishlist and album lists
+)
+
+// rolePermissions maps each role to what it may do
+var rolePermissions = map[Role][]Permission{
+	RoleViewer: {PermAlbumRead, PermTokensOwn, PermReviewsWrite, PermListsOwn},
+	RoleEditor: {PermAlbumRead, PermTokensOwn, PermReviewsWrite, PermListsOwn, PermAlbumAdd, PermAlbumEdit},
+	RoleAdmin: {PermAlbumRead, PermTokensOwn, PermReviewsWrite, PermListsOwn, PermAlbumAdd, PermAlbumEdit, PermAlbumDelete, PermUsersManage, PermSQLConsole,
+		PermRatesManage, PermReviewsModerate},
+}
+
+// Scope limits what an API token can do, on top of its owner's role
+type Scope string
+
+const (
+	ScopeRead  Scope = "read"
+	ScopeWrite Scope = "write"
+	ScopeAdmin Scope = "admin"
+)
+
+// scopes lists the token scopes from narrowest to widest
+var scopes = []Scope{ScopeRead, ScopeWrite, ScopeAdmin}
+
+// scopePermissions maps each scope to what a token may do. No scope includes
+// tokens:own, so a token cannot mint more tokens.
+var scopePermissions = map[Scope][]Permission{
+	ScopeRead:  {PermAlbumRead},
+	ScopeWrite: {PermAlbumRead, PermAlbumAdd, PermAlbumEdit, PermReviewsWrite, PermListsOwn},
+	ScopeAdmin: {PermAlbumRead, PermAlbumAdd, PermAlbumEdit, PermReviewsWrite, PermListsOwn, PermAlbumDelete, PermUsersManage, PermSQLConsole, PermRatesManage,
+		PermReviewsModerate},
+}
+
+// anonymousPermissions is what visitors who are not logged in may do
+var anonymousPermissions = []Permission{PermAlbumRead}
+
+// validRole reports whether r is one of the known roles
+func validRole(r Role) bool {
+	_, ok := rolePermissions[r]
+	return ok
+}
+
+// validScope reports whether s is one of the known token scopes
+func validScope(s Scope) bool {
+	_, ok := scopePermissions[s]
+	return ok
+}
+
+// Can reports whether the user may do p; a nil user is an anonymous visitor.
+// Users authenticated by an API token are limited to the token's scope as well.
+func (u *User) Can(p Permission) bool {
+	if u == nil {
+		return hasPermission(anonymousPermissions, p)
+	}
+	if u.Scope != "" && !hasPermission(scopePermissions[u.Scope], p) {
+		return false
+	}
+	return hasPermission(rolePermissions[u.Role], p)
+}
+
+// hasPermission reports whether p is in perms
+func hasPermission(perms []Permission, p Permission) bool {
+	for _, have := range perms {
+		if have == p {
+			return true
+		}
+	}
+	return false
+}
+
+// can reports whether the user on ctx may do p
+func can(ctx context.Context, p Permission) bool {
+	return currentUser(ctx).Can(p)
+}
+
+// requirePermission only lets requests through when the user may do p. Anonymous
+// visitors are sent to log in (401 for the API), logged in users without p get a 403.
+func requirePermission(p Permission, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if can(r.Context(), p) {
+			next(w, r)
+			return
+		}
+		if currentUser(r.Context()) != nil {
+			renderError(w, r, &Error{Kind: ErrForbidden, Op: "requirePermission", Msg: "Your account is not allowed to do that."})
+			return
+		}
+		if wantsJSON(r) {
+			renderError(w, r, &Error{Kind: ErrUnauthenticated, Op: "requirePermission", Msg: "Log in to do that."})
+			return
+		}
+		http.Redirect(w, r, "/login?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusSeeOther)
+	}
+}
+
+// requireMethodPermission is requirePermission with the permission picked by HTTP method.
+// Methods not in perms go straight to next, which answers 405.
+func requireMethodPermission(perms map[string]Permission, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		p, ok := perms[r.Method]
+		if !ok {
+			next(w, r)
+			return
+		}
+		requirePermission(p, next)(w, r)
+	}
+}
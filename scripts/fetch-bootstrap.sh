@@ -0,0 +1,19 @@
+#!/bin/sh
+# Downloads the Bootstrap release the templates are written against into static/bootstrap,
+# so pages are served from this server under the Content-Security-Policy instead of a CDN.
+# Run from the repository root, then commit static/bootstrap.
+set -eu
+
+VERSION=5.3.0
+DEST=static/bootstrap
+TMP=$(mktemp -d)
+trap 'rm -rf "$TMP"' EXIT
+
+curl -fsSL "https://registry.npmjs.org/bootstrap/-/bootstrap-$VERSION.tgz" -o "$TMP/bootstrap.tgz"
+tar -xzf "$TMP/bootstrap.tgz" -C "$TMP"
+
+mkdir -p "$DEST/css" "$DEST/js"
+cp "$TMP/package/dist/css/bootstrap.min.css" "$TMP/package/dist/css/bootstrap.min.css.map" "$DEST/css/"
+cp "$TMP/package/dist/js/bootstrap.bundle.min.js" "$TMP/package/dist/js/bootstrap.bundle.min.js.map" "$DEST/js/"
+cp "$TMP/package/LICENSE" "$DEST/"
+echo "Bootstrap $VERSION is in $DEST"
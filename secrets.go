@@ -0,0 +1,351 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"database/sql/driver"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	log "github.com/sirupsen/logrus"
+)
+
+// SecretProvider looks up named secrets such as DBPASS. Lookups happen at startup and
+// again every SECRETS_REFRESH_INTERVAL, so a provider should return the current value
+// each time. A secrets manager can be plugged in with registerSecretProvider.
+type SecretProvider interface {
+	Name() string
+	Lookup(ctx context.Context, name string) (value string, ok bool, err error)
+}
+
+// extraSecretProviders are asked after the environment and the secrets file
+var extraSecretProviders []SecretProvider
+
+// registerSecretProvider adds a provider; call it before run
+func registerSecretProvider(p SecretProvider) {
+	extraSecretProviders = append(extraSecretProviders, p)
+}
+
+// envSecrets reads NAME_FILE (a Docker or Kubernetes secret mount) or else NAME from the environment
+type envSecrets struct{}
+
+func (envSecrets) Name() string { return "env" }
+
+func (envSecrets) Lookup(ctx context.Context, name string) (string, bool, error) {
+	if path := envString(name+"_FILE", ""); path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return "", false, fmt.Errorf("%s_FILE: %v", name, err)
+		}
+		return strings.TrimRight(string(b), "\r\n"), true, nil
+	}
+	v, ok := os.LookupEnv(name)
+	return v, ok && v != "", nil
+}
+
+// secretsFileHeader starts an encrypted secrets file; the rest is base64 of nonce + AES-256-GCM ciphertext
+const secretsFileHeader = "data-access-secrets v1\n"
+
+// fileSecrets reads an encrypted JSON object of name -> value, re-reading the file on every lookup
+type fileSecrets struct {
+	path string
+	key  []byte
+}
+
+func (f fileSecrets) Name() string { return "file" }
+
+func (f fileSecrets) Lookup(ctx context.Context, name string) (string, bool, error) {
+	values, err := f.read()
+	if err != nil {
+		return "", false, err
+	}
+	v, ok := values[name]
+	return v, ok, nil
+}
+
+// read decrypts the whole file; a missing file is empty
+func (f fileSecrets) read() (map[string]string, error) {
+	b, err := os.ReadFile(f.path)
+	if os.IsNotExist(err) {
+		return map[string]string{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("secrets file: %v", err)
+	}
+	if !strings.HasPrefix(string(b), secretsFileHeader) {
+		return nil, fmt.Errorf("secrets file %s: not a data-access secrets file", f.path)
+	}
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(b[len(secretsFileHeader):])))
+	if err != nil {
+		return nil, fmt.Errorf("secrets file %s: %v", f.path, err)
+	}
+	gcm, err := newGCM(f.key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, fmt.Errorf("secrets file %s: too short", f.path)
+	}
+	plain, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], []byte(secretsFileHeader))
+	if err != nil {
+		return nil, fmt.Errorf("secrets file %s: wrong SECRETS_KEY or the file was changed", f.path)
+	}
+	values := make(map[string]string)
+	if err := json.Unmarshal(plain, &values); err != nil {
+		return nil, fmt.Errorf("secrets file %s: %v", f.path, err)
+	}
+	return values, nil
+}
+
+// write encrypts values into the file, replacing it atomically
+func (f fileSecrets) write(values map[string]string) error {
+	plain, err := json.Marshal(values)
+	if err != nil {
+		return err
+	}
+	gcm, err := newGCM(f.key)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return err
+	}
+	sealed := gcm.Seal(nonce, nonce, plain, []byte(secretsFileHeader))
+	tmp := f.path + ".tmp"
+	data := secretsFileHeader + base64.StdEncoding.EncodeToString(sealed) + "\n"
+	if err := os.WriteFile(tmp, []byte(data), 0600); err != nil {
+		return fmt.Errorf("secrets file: %v", err)
+	}
+	return os.Rename(tmp, f.path)
+}
+
+// newGCM returns AES-256-GCM for a 32 byte key
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("SECRETS_KEY: %v", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// secretsFile returns the encrypted secrets file named by SECRETS_FILE, with its key from
+// SECRETS_KEY or SECRETS_KEY_FILE (64 hex characters, see "secrets keygen")
+func secretsFile(cfg Config) (*fileSecrets, error) {
+	if cfg.SecretsFile == "" {
+		return nil, nil
+	}
+	hexKey, ok, err := envSecrets{}.Lookup(context.Background(), "SECRETS_KEY")
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("SECRETS_FILE is set but SECRETS_KEY (or SECRETS_KEY_FILE) is not")
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(hexKey))
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("SECRETS_KEY must be 64 hex characters (32 bytes)")
+	}
+	return &fileSecrets{path: cfg.SecretsFile, key: key}, nil
+}
+
+// secretProviders lists the providers in the order they are asked
+func secretProviders(cfg Config) ([]SecretProvider, error) {
+	providers := []SecretProvider{envSecrets{}}
+	f, err := secretsFile(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if f != nil {
+		providers = append(providers, *f)
+	}
+	return append(providers, extraSecretProviders...), nil
+}
+
+// lookupSecret asks each provider in turn for name, returning def if none has it
+func lookupSecret(ctx context.Context, providers []SecretProvider, name, def string) (string, error) {
+	for _, p := range providers {
+		v, ok, err := p.Lookup(ctx, name)
+		if err != nil {
+			return "", fmt.Errorf("secret %s from %s: %v", name, p.Name(), err)
+		}
+		if ok {
+			return v, nil
+		}
+	}
+	return def, nil
+}
+
+// dbCredentialsFrom looks up the database user and password
+func dbCredentialsFrom(ctx context.Context, providers []SecretProvider) (*credentials, error) {
+	user, err := lookupSecret(ctx, providers, "DBUSER", "")
+	if err != nil {
+		return nil, err
+	}
+	pass, err := lookupSecret(ctx, providers, "DBPASS", "")
+	if err != nil {
+		return nil, err
+	}
+	return &credentials{user: user, pass: pass}, nil
+}
+
+// credentials is a database user and password
+type credentials struct {
+	user string
+	pass string
+}
+
+// dbCredentials are the current database credentials; new connections pick them up
+var dbCredentials atomic.Pointer[credentials]
+
+// watchSecrets re-reads the database credentials every interval until ctx is done.
+// Open connections keep working; new ones log in with the new password.
+func watchSecrets(ctx context.Context, cfg Config, interval time.Duration) {
+	l := log.WithField("func", "watchSecrets")
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		providers, err := secretProviders(cfg)
+		if err == nil {
+			var creds *credentials
+			if creds, err = dbCredentialsFrom(ctx, providers); err == nil {
+				if old := dbCredentials.Load(); old == nil || *old != *creds {
+					dbCredentials.Store(creds)
+					l.WithField("db_user", creds.user).Info("database credentials changed")
+				}
+				continue
+			}
+		}
+		l.WithError(err).Warn("could not re-read secrets, keeping the current credentials")
+	}
+}
+
+// dbConnector opens MySQL connections with the current dbCredentials, so rotated
+// passwords are used without reopening the pool. Replicas with their own DSN keep theirs.
+type dbConnector struct {
+	base   *mysql.Config
+	rotate bool
+
+	mu    sync.Mutex
+	creds *credentials
+	conn  driver.Connector
+}
+
+// newDBConnector returns a connector for my; with rotate it follows dbCredentials
+func newDBConnector(my *mysql.Config, rotate bool) *dbConnector {
+	return &dbConnector{base: my, rotate: rotate}
+}
+
+func (c *dbConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.connector()
+	if err != nil {
+		return nil, err
+	}
+	return conn.Connect(ctx)
+}
+
+func (c *dbConnector) Driver() driver.Driver { return mysql.MySQLDriver{} }
+
+// connector returns the driver connector for the current credentials, building a new one when they change
+func (c *dbConnector) connector() (driver.Connector, error) {
+	var creds *credentials
+	if c.rotate {
+		creds = dbCredentials.Load()
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn != nil && creds == c.creds {
+		return c.conn, nil
+	}
+	my := c.base.Clone()
+	if creds != nil {
+		my.User, my.Passwd = creds.user, creds.pass
+	}
+	conn, err := mysql.NewConnector(my)
+	if err != nil {
+		return nil, err
+	}
+	c.conn, c.creds = conn, creds
+	return conn, nil
+}
+
+// secretsKeygen prints a new random SECRETS_KEY
+func secretsKeygen() error {
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return err
+	}
+	fmt.Println(hex.EncodeToString(key))
+	return nil
+}
+
+// secretsCmd manages the encrypted secrets file: keygen, set NAME (value on stdin), list, delete NAME
+func secretsCmd(ctx context.Context, cfg Config, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("secrets: expected keygen, set, list or delete")
+	}
+	sub, args := args[0], args[1:]
+	if sub == "keygen" {
+		return secretsKeygen()
+	}
+	f, err := secretsFile(cfg)
+	if err != nil {
+		return err
+	}
+	if f == nil {
+		return fmt.Errorf("secrets %s: set SECRETS_FILE and SECRETS_KEY first", sub)
+	}
+	values, err := f.read()
+	if err != nil {
+		return err
+	}
+	switch sub {
+	case "list":
+		names := make([]string, 0, len(values))
+		for name := range values {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Println(name)
+		}
+		return nil
+	case "set", "delete":
+		if len(args) != 1 {
+			return fmt.Errorf("secrets %s: expected a name", sub)
+		}
+		if sub == "set" {
+			fmt.Fprintf(os.Stderr, "%s: ", args[0])
+			value, err := readLine()
+			if err != nil {
+				return err
+			}
+			values[args[0]] = value
+		} else {
+			delete(values, args[0])
+		}
+		if err := f.write(values); err != nil {
+			return err
+		}
+		fmt.Printf("saved %s\n", f.path)
+		return nil
+	}
+	return fmt.Errorf("secrets: unknown subcommand %q", sub)
+}
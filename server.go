@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// serve runs the web server until it fails. With TLS on, the app is served over
+// HTTPS (HTTP/2 enabled) and the plain HTTP listener only redirects to it.
+func serve(cfg Config, handler http.Handler) error {
+	l := log.WithField("func", "serve")
+	srv := &http.Server{
+		Addr:              cfg.HTTPAddr,
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+		IdleTimeout:       2 * time.Minute,
+	}
+	if !cfg.TLSEnabled() {
+		l.WithField("addr", cfg.HTTPAddr).Info("serving http")
+		return srv.ListenAndServe()
+	}
+
+	tlsCfg, err := serverTLSConfig(cfg)
+	if err != nil {
+		return err
+	}
+	srv.Addr = cfg.HTTPSAddr
+	srv.TLSConfig = tlsCfg
+
+	if cfg.HTTPAddr != "" {
+		redirect := &http.Server{
+			Addr:              cfg.HTTPAddr,
+			Handler:           redirectToHTTPS(cfg.HTTPSAddr),
+			ReadHeaderTimeout: 10 * time.Second,
+		}
+		go func() {
+			l.WithField("addr", cfg.HTTPAddr).Info("redirecting http to https")
+			if err := redirect.ListenAndServe(); err != nil {
+				l.WithError(err).Error("http redirect listener stopped")
+			}
+		}()
+	}
+	if cfg.TLSDevCert && cfg.TLSCertFile == "" {
+		l.Warn("serving a self-signed development certificate")
+	}
+	l.WithField("addr", cfg.HTTPSAddr).Info("serving https")
+	return srv.ListenAndServeTLS("", "")
+}
+
+// redirectToHTTPS sends every request to the same host and path on the HTTPS port
+func redirectToHTTPS(httpsAddr string) http.Handler {
+	_, port, _ := net.SplitHostPort(httpsAddr)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
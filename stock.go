@@ -0,0 +1,403 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Stock limits: one movement can't move more than maxStockMove copies, and the note
+// fits the stock_movements column
+const (
+	maxStockMove    = 100000
+	maxStockNoteLen = 255
+)
+
+// MovementKind is why an album's stock went up or down
+type MovementKind string
+
+const (
+	MovementReceived MovementKind = "received"
+	MovementSold     MovementKind = "sold"
+	MovementReturned MovementKind = "returned"
+	MovementAdjusted MovementKind = "adjusted"
+)
+
+// movementKinds lists the kinds in the order the forms offer them
+var movementKinds = []MovementKind{MovementReceived, MovementSold, MovementReturned, MovementAdjusted}
+
+// validMovementKind reports whether k is one of the kinds
+func validMovementKind(k MovementKind) bool {
+	for _, have := range movementKinds {
+		if have == k {
+			return true
+		}
+	}
+	return false
+}
+
+// StockLevel is how many copies of an album are in stock. Threshold is the one that
+// applies, the album's own (Custom) or LOW_STOCK_THRESHOLD. Albums nobody has counted
+// yet are not Tracked and never low.
+type StockLevel struct {
+	Quantity  int  `json:"quantity"`
+	Threshold int  `json:"threshold"`
+	Custom    bool `json:"custom_threshold"`
+	Tracked   bool `json:"tracked"`
+	Low       bool `json:"low"`
+}
+
+// stockLevel works out the level of a stock row; a NULL quantity means there is no row
+func stockLevel(quantity, threshold sql.NullInt64) StockLevel {
+	s := StockLevel{Quantity: int(quantity.Int64), Threshold: appCfg.LowStockThreshold, Tracked: quantity.Valid}
+	if threshold.Valid {
+		s.Threshold, s.Custom = int(threshold.Int64), true
+	}
+	s.Low = s.Tracked && s.Quantity <= s.Threshold
+	return s
+}
+
+// StockMovement is one entry of an album's stock ledger. Quantity is signed: sales take
+// copies away, adjustments go either way. Balance is the stock after the movement.
+type StockMovement struct {
+	ID        int64        `json:"id"`
+	AlbumID   int64        `json:"album_id"`
+	Kind      MovementKind `json:"kind"`
+	Quantity  int          `json:"quantity"`
+	Balance   int          `json:"balance"`
+	Note      string       `json:"note,omitempty"`
+	Actor     string       `json:"actor"`
+	CreatedAt time.Time    `json:"created_at"`
+}
+
+// LowStockAlbum is a line of the low-stock report
+type LowStockAlbum struct {
+	ID     int64      `json:"id"`
+	Title  string     `json:"title"`
+	Artist string     `json:"artist"`
+	Stock  StockLevel `json:"stock"`
+}
+
+// stockLevels loads the stock of the given albums, keyed by album id. Every id gets
+// an entry, untracked when the album has no stock row.
+func stockLevels(ctx context.Context, q queryer, ids []int64) (map[int64]StockLevel, error) {
+	levels := make(map[int64]StockLevel, len(ids))
+	for _, id := range ids {
+		levels[id] = stockLevel(sql.NullInt64{}, sql.NullInt64{})
+	}
+	if len(ids) == 0 {
+		return levels, nil
+	}
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	rows, err := q.QueryContext(ctx, `SELECT album_id, quantity, threshold FROM stock
+		WHERE album_id IN (?`+strings.Repeat(", ?", len(ids)-1)+`);`, args...)
+	if err != nil {
+		return nil, dbError("stockLevels", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int64
+		var quantity, threshold sql.NullInt64
+		if err := rows.Scan(&id, &quantity, &threshold); err != nil {
+			return nil, dbError("stockLevels", err)
+		}
+		levels[id] = stockLevel(quantity, threshold)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, dbError("stockLevels", err)
+	}
+	return levels, nil
+}
+
+// attachStock fills in the stock level of each album
+func attachStock(ctx context.Context, albums []AlbumMap) error {
+	ids := make([]int64, len(albums))
+	for i, a := range albums {
+		ids[i] = a.ID
+	}
+	levels, err := stockLevels(ctx, readDB(ctx), ids)
+	if err != nil {
+		return err
+	}
+	for i := range albums {
+		albums[i].Stock = levels[albums[i].ID]
+	}
+	return nil
+}
+
+// stockMovements returns an album's latest movements, newest first
+func stockMovements(ctx context.Context, albumID int64, limit int) ([]StockMovement, error) {
+	rows, err := readDB(ctx).QueryContext(ctx, `SELECT id, album_id, kind, quantity, balance, note, actor, created_at
+		FROM stock_movements WHERE album_id = ? ORDER BY id DESC LIMIT ?;`, albumID, limit)
+	if err != nil {
+		return nil, dbError("stockMovements", err)
+	}
+	defer rows.Close()
+	movements := []StockMovement{}
+	for rows.Next() {
+		var m StockMovement
+		if err := rows.Scan(&m.ID, &m.AlbumID, &m.Kind, &m.Quantity, &m.Balance, &m.Note, &m.Actor, &m.CreatedAt); err != nil {
+			return nil, dbError("stockMovements", err)
+		}
+		movements = append(movements, m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, dbError("stockMovements", err)
+	}
+	return movements, nil
+}
+
+// validateMovement normalizes m and checks it. Received, sold and returned quantities
+// are counted up from 1; an adjustment is the signed correction and can't be 0.
+func validateMovement(op string, m StockMovement) (StockMovement, error) {
+	m.Kind = MovementKind(strings.ToLower(strings.TrimSpace(string(m.Kind))))
+	m.Note = normalizeText(m.Note)
+	fields := make(map[string]string)
+	if !validMovementKind(m.Kind) {
+		fields["kind"] = fmt.Sprintf("%q is not a kind of movement, use one of %v.", m.Kind, movementKinds)
+	}
+	switch {
+	case m.Kind == MovementAdjusted && m.Quantity == 0:
+		fields["quantity"] = "Enter how many copies to add (or, negative, to take away)."
+	case m.Kind != MovementAdjusted && m.Quantity < 1:
+		fields["quantity"] = "Enter how many copies, at least 1."
+	case m.Quantity > maxStockMove || m.Quantity < -maxStockMove:
+		fields["quantity"] = fmt.Sprintf("Move at most %d copies at a time.", maxStockMove)
+	}
+	if n := utf8.RuneCountInString(m.Note); n > maxStockNoteLen {
+		fields["note"] = fmt.Sprintf("Keep the note to %d characters (this is %d).", maxStockNoteLen, n)
+	}
+	if len(fields) > 0 {
+		return m, invalidFields(op, fields)
+	}
+	if m.Kind == MovementSold {
+		m.Quantity = -m.Quantity
+	}
+	return m, nil
+}
+
+// recordMovement adds a movement to an album's ledger and updates its stock in one
+// transaction, starting the count at 0 the first time. Stock can't go below 0.
+func recordMovement(ctx context.Context, m StockMovement) (StockMovement, error) {
+	m, err := validateMovement("recordMovement", m)
+	if err != nil {
+		return StockMovement{}, err
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return StockMovement{}, dbError("recordMovement", err)
+	}
+	defer tx.Rollback()
+
+	var exists int
+	if err := tx.QueryRowContext(ctx, "SELECT 1 FROM album WHERE id = ? FOR UPDATE;", m.AlbumID).Scan(&exists); err == sql.ErrNoRows {
+		return StockMovement{}, notFound("recordMovement", "There is no album with id %d.", m.AlbumID)
+	} else if err != nil {
+		return StockMovement{}, dbError("recordMovement", err)
+	}
+	if _, err := tx.ExecContext(ctx, "INSERT IGNORE INTO stock (album_id) VALUES (?);", m.AlbumID); err != nil {
+		return StockMovement{}, dbError("recordMovement", err)
+	}
+	var quantity int
+	if err := tx.QueryRowContext(ctx, "SELECT quantity FROM stock WHERE album_id = ? FOR UPDATE;", m.AlbumID).Scan(&quantity); err != nil {
+		return StockMovement{}, dbError("recordMovement", err)
+	}
+	m.Balance = quantity + m.Quantity
+	if m.Balance < 0 {
+		return StockMovement{}, invalidFields("recordMovement", map[string]string{
+			"quantity": fmt.Sprintf("There are only %d in stock, %d can't go.", quantity, -m.Quantity)})
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE stock SET quantity = ? WHERE album_id = ?;", m.Balance, m.AlbumID); err != nil {
+		return StockMovement{}, dbError("recordMovement", err)
+	}
+	userID, actor := actorFrom(ctx)
+	result, err := tx.ExecContext(ctx, `INSERT INTO stock_movements (album_id, kind, quantity, balance, note, user_id, actor)
+		VALUES (?, ?, ?, ?, ?, ?, ?);`, m.AlbumID, m.Kind, m.Quantity, m.Balance, m.Note, userID, actor)
+	if err != nil {
+		return StockMovement{}, dbError("recordMovement", err)
+	}
+	if m.ID, err = result.LastInsertId(); err != nil {
+		return StockMovement{}, dbError("recordMovement", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return StockMovement{}, dbError("recordMovement", err)
+	}
+	m.Actor, m.CreatedAt = actor, time.Now()
+	logFrom(ctx).WithFields(log.Fields{"func": "recordMovement", "album_id": m.AlbumID, "kind": m.Kind,
+		"quantity": m.Quantity, "balance": m.Balance}).Info("recorded stock movement")
+	return m, nil
+}
+
+// setStockThreshold gives an album its own low-stock threshold, or puts it back on
+// LOW_STOCK_THRESHOLD when threshold is NULL
+func setStockThreshold(ctx context.Context, albumID int64, threshold sql.NullInt64) error {
+	if threshold.Valid && (threshold.Int64 < 0 || threshold.Int64 > maxStockMove) {
+		return invalidFields("setStockThreshold", map[string]string{
+			"threshold": fmt.Sprintf("The threshold must be between 0 and %d.", maxStockMove)})
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return dbError("setStockThreshold", err)
+	}
+	defer tx.Rollback()
+
+	var exists int
+	if err := tx.QueryRowContext(ctx, "SELECT 1 FROM album WHERE id = ? FOR UPDATE;", albumID).Scan(&exists); err == sql.ErrNoRows {
+		return notFound("setStockThreshold", "There is no album with id %d.", albumID)
+	} else if err != nil {
+		return dbError("setStockThreshold", err)
+	}
+	if _, err := tx.ExecContext(ctx, `INSERT INTO stock (album_id, threshold) VALUES (?, ?)
+		ON DUPLICATE KEY UPDATE threshold = VALUES(threshold);`, albumID, threshold); err != nil {
+		return dbError("setStockThreshold", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return dbError("setStockThreshold", err)
+	}
+	logFrom(ctx).WithFields(log.Fields{"func": "setStockThreshold", "album_id": albumID, "threshold": threshold.Int64,
+		"default": !threshold.Valid}).Info("set stock threshold")
+	return nil
+}
+
+// lowStock returns the counted albums at or below their threshold, emptiest first
+func lowStock(ctx context.Context) ([]LowStockAlbum, error) {
+	rows, err := readDB(ctx).QueryContext(ctx, `SELECT a.id, a.title, a.artist, s.quantity, s.threshold
+		FROM stock s JOIN album a ON a.id = s.album_id
+		WHERE s.quantity <= COALESCE(s.threshold, ?) ORDER BY s.quantity, a.title, a.id;`, appCfg.LowStockThreshold)
+	if err != nil {
+		return nil, dbError("lowStock", err)
+	}
+	defer rows.Close()
+	albums := []LowStockAlbum{}
+	for rows.Next() {
+		var a LowStockAlbum
+		var quantity, threshold sql.NullInt64
+		if err := rows.Scan(&a.ID, &a.Title, &a.Artist, &quantity, &threshold); err != nil {
+			return nil, dbError("lowStock", err)
+		}
+		a.Stock = stockLevel(quantity, threshold)
+		albums = append(albums, a)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, dbError("lowStock", err)
+	}
+	return albums, nil
+}
+
+// parseThreshold reads a threshold form value or CLI argument; blank or "-" is the default
+func parseThreshold(op, value string) (sql.NullInt64, error) {
+	value = strings.TrimSpace(value)
+	if value == "" || value == "-" {
+		return sql.NullInt64{}, nil
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return sql.NullInt64{}, invalidFields(op, map[string]string{"threshold": fmt.Sprintf("%q is not a number.", value)})
+	}
+	return sql.NullInt64{Int64: n, Valid: true}, nil
+}
+
+// stockPage is the data for stock.html
+type stockPage struct {
+	Albums  []LowStockAlbum
+	Default int
+}
+
+// stockHandler shows the low-stock report
+func stockHandler(w http.ResponseWriter, r *http.Request) {
+	albums, err := lowStock(r.Context())
+	if err != nil {
+		renderError(w, r, err)
+		return
+	}
+	render(w, r, "stock.html", stockPage{Albums: albums, Default: appCfg.LowStockThreshold})
+}
+
+// apiLowStockHandler serves GET /api/stock/low: the low-stock report
+func apiLowStockHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, "GET")
+		return
+	}
+	albums, err := lowStock(r.Context())
+	if err != nil {
+		renderError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, albums)
+}
+
+// albumStock is the JSON shape of /api/albums/{id}/stock
+type albumStock struct {
+	AlbumID   int64           `json:"album_id"`
+	Stock     StockLevel      `json:"stock"`
+	Movements []StockMovement `json:"movements"`
+}
+
+// apiAlbumStockHandler serves /api/albums/{id}/stock: GET shows the stock and latest movements,
+// POST records a movement and PUT sets the album's threshold (null for the default)
+func apiAlbumStockHandler(w http.ResponseWriter, r *http.Request, albumID int64) {
+	ctx := r.Context()
+	switch r.Method {
+	case http.MethodGet:
+		// the album must exist, an untracked stock means nobody has counted it yet
+		alb, err := albumByID(ctx, albumID)
+		if err != nil {
+			renderError(w, r, err)
+			return
+		}
+		movements, err := stockMovements(ctx, albumID, 50)
+		if err != nil {
+			renderError(w, r, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, albumStock{AlbumID: albumID, Stock: alb.Stock, Movements: movements})
+	case http.MethodPost:
+		var in StockMovement
+		if err := decodeJSON(r, &in); err != nil {
+			renderError(w, r, err)
+			return
+		}
+		m, err := recordMovement(ctx, StockMovement{AlbumID: albumID, Kind: in.Kind, Quantity: in.Quantity, Note: in.Note})
+		if err != nil {
+			renderError(w, r, err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, m)
+	case http.MethodPut:
+		var in struct {
+			Threshold *int64 `json:"threshold"`
+		}
+		if err := decodeJSON(r, &in); err != nil {
+			renderError(w, r, err)
+			return
+		}
+		var threshold sql.NullInt64
+		if in.Threshold != nil {
+			threshold = sql.NullInt64{Int64: *in.Threshold, Valid: true}
+		}
+		if err := setStockThreshold(ctx, albumID, threshold); err != nil {
+			renderError(w, r, err)
+			return
+		}
+		ctx = withPrimary(ctx)
+		levels, err := stockLevels(ctx, readDB(ctx), []int64{albumID})
+		if err != nil {
+			renderError(w, r, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, levels[albumID])
+	default:
+		methodNotAllowed(w, "GET, POST, PUT")
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	log "github.com/sirupsen/logrus"
+)
+
+// mysqlTLSName prefixes the names our custom TLS configs are registered under with the
+// mysql driver. The driver's registry is global, so each address gets its own entry.
+const mysqlTLSName = "custom"
+
+// certReloader serves a certificate from disk and picks up a rotated cert/key pair
+// without a restart. The files are checked at most once per interval.
+type certReloader struct {
+	certFile, keyFile string
+	interval          time.Duration
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+	checked time.Time
+}
+
+// newCertReloader loads the initial certificate, failing if it cannot be read
+func newCertReloader(certFile, keyFile string, interval time.Duration) (*certReloader, error) {
+	cr := &certReloader{certFile: certFile, keyFile: keyFile, interval: interval}
+	if err := cr.reload(); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+// reload reads the cert/key pair from disk
+func (cr *certReloader) reload() error {
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return fmt.Errorf("load certificate: %v", err)
+	}
+	cr.cert = &cert
+	cr.modTime = cr.latestModTime()
+	return nil
+}
+
+// latestModTime returns the newer modification time of the cert and key files
+func (cr *certReloader) latestModTime() time.Time {
+	var latest time.Time
+	for _, f := range []string{cr.certFile, cr.keyFile} {
+		if fi, err := os.Stat(f); err == nil && fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest
+}
+
+// GetCertificate is the tls.Config hook. When the files changed it reloads them,
+// keeping the old certificate if the new pair is broken (e.g. half written).
+func (cr *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	if time.Since(cr.checked) >= cr.interval {
+		cr.checked = time.Now()
+		if mod := cr.latestModTime(); mod.After(cr.modTime) {
+			l := log.WithFields(log.Fields{"func": "GetCertificate", "cert_file": cr.certFile})
+			if err := cr.reload(); err != nil {
+				l.WithError(err).Error("keeping the old certificate")
+			} else {
+				l.Info("reloaded certificate")
+			}
+		}
+	}
+	return cr.cert, nil
+}
+
+// serverTLSConfig builds the HTTPS config: HTTP/2 first, TLS 1.2 minimum, and either
+// the reloadable certificate files or a generated self-signed certificate
+func serverTLSConfig(cfg Config) (*tls.Config, error) {
+	tlsCfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		NextProtos: []string{"h2", "http/1.1"},
+	}
+	if cfg.TLSCertFile != "" {
+		cr, err := newCertReloader(cfg.TLSCertFile, cfg.TLSKeyFile, cfg.TLSReloadInterval)
+		if err != nil {
+			return nil, err
+		}
+		tlsCfg.GetCertificate = cr.GetCertificate
+		return tlsCfg, nil
+	}
+	cert, err := selfSignedCert()
+	if err != nil {
+		return nil, err
+	}
+	tlsCfg.Certificates = []tls.Certificate{cert}
+	return tlsCfg, nil
+}
+
+// selfSignedCert generates a short lived certificate for localhost, for development only
+func selfSignedCert() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("selfSignedCert: %v", err)
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("selfSignedCert: %v", err)
+	}
+	tmpl := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"Music Lib App (development)"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(30 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &tmpl, &tmpl, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("selfSignedCert: %v", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// configureMySQLTLS sets up TLS on the driver config from DB_TLS*. DB_TLS empty leaves TLS
+// off. A CA or client certificate (only allowed with DB_TLS=true) registers the config
+// mysqlTLSConfig builds under a name of its own for cfg.DBAddr; otherwise DB_TLS is passed
+// through as one of the driver's built in modes.
+func configureMySQLTLS(cfg Config, my *mysql.Config) error {
+	if !dbTLSEnabled(cfg) {
+		return nil
+	}
+	if cfg.DBTLSCA == "" && cfg.DBTLSCert == "" {
+		my.TLSConfig = cfg.DBTLS
+		return nil
+	}
+	tlsCfg, err := mysqlTLSConfig(cfg)
+	if err != nil {
+		return err
+	}
+	name := mysqlTLSName + "-" + cfg.DBAddr
+	if err := mysql.RegisterTLSConfig(name, tlsCfg); err != nil {
+		return fmt.Errorf("configureMySQLTLS: %v", err)
+	}
+	my.TLSConfig = name
+	return nil
+}
+
+// mysqlTLSConfig builds the verifying TLS config for the MySQL server at cfg.DBAddr, from
+// DB_TLS_CA, DB_TLS_CERT/DB_TLS_KEY and DB_TLS_SERVER_NAME (the host of cfg.DBAddr when unset)
+func mysqlTLSConfig(cfg Config) (*tls.Config, error) {
+	tlsCfg := &tls.Config{MinVersion: tls.VersionTLS12, ServerName: cfg.DBTLSServerName}
+	if tlsCfg.ServerName == "" {
+		host, _, err := net.SplitHostPort(cfg.DBAddr)
+		if err != nil {
+			host = cfg.DBAddr
+		}
+		tlsCfg.ServerName = host
+	}
+	if cfg.DBTLSCA != "" {
+		pem, err := os.ReadFile(cfg.DBTLSCA)
+		if err != nil {
+			return nil, fmt.Errorf("mysqlTLSConfig: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("mysqlTLSConfig: no certificates found in %s", cfg.DBTLSCA)
+		}
+		tlsCfg.RootCAs = pool
+	}
+	if cfg.DBTLSCert != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.DBTLSCert, cfg.DBTLSKey)
+		if err != nil {
+			return nil, fmt.Errorf("mysqlTLSConfig: %v", err)
+		}
+		tlsCfg.Certificates = []tls.Certificate{cert}
+	}
+	return tlsCfg, nil
+}
+
+// dbTLSEnabled reports whether DB_TLS asks for TLS to MySQL at all; loadConfig has
+// already turned every way of saying off into ""
+func dbTLSEnabled(cfg Config) bool {
+	return cfg.DBTLS != ""
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// tokenPrefix starts every API token so they are easy to spot in logs and secret scanners
+const tokenPrefix = "dat_"
+
+// maxTokenDays is the longest expiry a token can be given
+const maxTokenDays = 3650
+
+// APIToken is a personal access token. The token itself is only known when it is created.
+type APIToken struct {
+	ID         int64
+	UserID     int64
+	Username   string
+	Name       string
+	Prefix     string
+	Scope      Scope
+	CreatedAt  time.Time
+	ExpiresAt  sql.NullTime
+	LastUsedAt sql.NullTime
+}
+
+// Expired reports whether the token can no longer be used
+func (t APIToken) Expired() bool {
+	return t.ExpiresAt.Valid && !t.ExpiresAt.Time.After(time.Now())
+}
+
+// createToken issues a token for user with the given scope, expiring after days (0 never expires).
+// It returns the token, which is shown once and only stored hashed.
+func createToken(ctx context.Context, userID int64, name string, scope Scope, days int) (string, APIToken, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || len(name) > 64 {
+		return "", APIToken{}, invalid("createToken", "A token name must be 1 to 64 characters.")
+	}
+	if !validScope(scope) {
+		return "", APIToken{}, invalid("createToken", "%q is not a scope, use one of %v.", scope, scopes)
+	}
+	if days < 0 || days > maxTokenDays {
+		return "", APIToken{}, invalid("createToken", "A token must expire within %d days (0 for never).", maxTokenDays)
+	}
+	secret, err := randomToken(32)
+	if err != nil {
+		return "", APIToken{}, err
+	}
+	token := tokenPrefix + secret
+	t := APIToken{UserID: userID, Name: name, Prefix: token[:12], Scope: scope}
+
+	expires := sql.NullInt64{Int64: int64(days), Valid: days > 0}
+	result, err := db.ExecContext(ctx, `INSERT INTO api_tokens (user_id, name, token_hash, prefix, scope, expires_at)
+		VALUES (?, ?, ?, ?, ?, IF(? IS NULL, NULL, NOW() + INTERVAL ? DAY));`,
+		userID, name, hashToken(token), t.Prefix, scope, expires, expires)
+	if err != nil {
+		return "", APIToken{}, dbError("createToken", err)
+	}
+	if t.ID, err = result.LastInsertId(); err != nil {
+		return "", APIToken{}, dbError("createToken", err)
+	}
+	logFrom(ctx).WithFields(log.Fields{"func": "createToken", "token_id": t.ID, "user_id": userID, "scope": scope}).Info("created API token")
+	return token, t, nil
+}
+
+// userTokens lists a user's tokens, newest first; userID 0 lists everyone's
+func userTokens(ctx context.Context, userID int64) ([]APIToken, error) {
+	var tokens []APIToken
+	rows, err := db.QueryContext(ctx, `SELECT t.id, t.user_id, u.username, t.name, t.prefix, t.scope, t.created_at, t.expires_at, t.last_used_at
+		FROM api_tokens t JOIN users u ON u.id = t.user_id
+		WHERE ? = 0 OR t.user_id = ? ORDER BY t.created_at DESC, t.id DESC;`, userID, userID)
+	if err != nil {
+		return nil, dbError("userTokens", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var t APIToken
+		if err := rows.Scan(&t.ID, &t.UserID, &t.Username, &t.Name, &t.Prefix, &t.Scope, &t.CreatedAt, &t.ExpiresAt, &t.LastUsedAt); err != nil {
+			return nil, dbError("userTokens", err)
+		}
+		tokens = append(tokens, t)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, dbError("userTokens", err)
+	}
+	return tokens, nil
+}
+
+// revokeToken deletes a token. With a userID other than 0 only that user's token is revoked.
+func revokeToken(ctx context.Context, userID, id int64) error {
+	result, err := db.ExecContext(ctx, "DELETE FROM api_tokens WHERE id = ? AND (? = 0 OR user_id = ?);", id, userID, userID)
+	if err != nil {
+		return dbError("revokeToken", err)
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return dbError("revokeToken", err)
+	} else if n == 0 {
+		return notFound("revokeToken", "There is no token %d.", id)
+	}
+	logFrom(ctx).WithFields(log.Fields{"func": "revokeToken", "token_id": id}).Info("revoked API token")
+	return nil
+}
+
+// tokenUser returns the owner of a live token, limited to the token's scope, or nil when
+// the token is unknown or expired. It also records when the token was last used.
+func tokenUser(ctx context.Context, token string) (*User, error) {
+	var u User
+	err := db.QueryRowContext(ctx, `SELECT t.id, u.id, u.username, u.role, t.scope FROM api_tokens t JOIN users u ON u.id = t.user_id
+		WHERE t.token_hash = ? AND (t.expires_at IS NULL OR t.expires_at > NOW());`, hashToken(token)).Scan(&u.TokenID, &u.ID, &u.Username, &u.Role, &u.Scope)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, dbError("tokenUser", err)
+	}
+	// once a minute is plenty, and saves a write on every call
+	_, err = db.ExecContext(ctx, `UPDATE api_tokens SET last_used_at = NOW()
+		WHERE id = ? AND (last_used_at IS NULL OR last_used_at < NOW() - INTERVAL 1 MINUTE);`, u.TokenID)
+	if err != nil {
+		return nil, dbError("tokenUser", err)
+	}
+	return &u, nil
+}
+
+// bearerToken returns the token from an "Authorization: Bearer" header, or ""
+func bearerToken(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if len(auth) < 7 || !strings.EqualFold(auth[:7], "bearer ") {
+		return ""
+	}
+	return strings.TrimSpace(auth[7:])
+}
+
+// tokensPage is the data for tokens.html
+type tokensPage struct {
+	Tokens   []APIToken
+	Scopes   []Scope
+	NewToken string
+	Success  bool
+	Message  string
+}
+
+// tokensHandler lets a logged in user create, list and revoke their own API tokens
+func tokensHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	u := currentUser(ctx)
+	l := logFrom(ctx).WithField("func", "tokensHandler")
+	page := tokensPage{Scopes: scopes}
+
+	if r.Method == http.MethodPost {
+		var err error
+		switch r.FormValue("action") {
+		case "create":
+			var days int
+			if days, err = strconv.Atoi(r.FormValue("days")); err != nil {
+				err = invalid("tokensHandler", "%q is not a number of days.", r.FormValue("days"))
+				break
+			}
+			var t APIToken
+			page.NewToken, t, err = createToken(ctx, u.ID, r.FormValue("name"), Scope(r.FormValue("scope")), days)
+			page.Message = "Created " + t.Name + ". Copy the token now, it will not be shown again."
+		case "revoke":
+			var id int64
+			if id, err = strconv.ParseInt(r.FormValue("id"), 10, 64); err != nil {
+				err = invalid("tokensHandler", "%q is not a token id.", r.FormValue("id"))
+				break
+			}
+			err = revokeToken(ctx, u.ID, id)
+			page.Message = "Revoked the token."
+		default:
+			err = invalid("tokensHandler", "Unknown action %q.", r.FormValue("action"))
+		}
+		if status, _ := errorStatus(err); err != nil && status >= http.StatusInternalServerError {
+			renderError(w, r, err)
+			return
+		}
+		page.Success = err == nil
+		if err != nil {
+			page.Message = errorMessage(err)
+			l.WithError(err).Warn("token change rejected")
+		}
+	}
+
+	tokens, err := userTokens(ctx, u.ID)
+	if err != nil {
+		renderError(w, r, err)
+		return
+	}
+	page.Tokens = tokens
+	render(w, r, "tokens.html", page)
+}
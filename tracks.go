@@ -0,0 +1,355 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Track field limits; discs and numbers fit the SMALLINT columns with room to spare
+const (
+	maxTrackTitleLen = 255
+	maxDisc          = 99
+	maxTrackNumber   = 999
+	maxTrackDuration = 24 * 60 * 60
+)
+
+// Track is one track of an album. Artist is empty when the track is by the album's artists.
+type Track struct {
+	ID       int64  `json:"id"`
+	AlbumID  int64  `json:"album_id"`
+	Disc     int    `json:"disc"`
+	Number   int    `json:"number"`
+	Title    string `json:"title"`
+	Duration int    `json:"duration"` // seconds, 0 when unknown
+	Artist   string `json:"artist,omitempty"`
+}
+
+// TrackStats is how many tracks an album has and how long they run together
+type TrackStats struct {
+	Count   int
+	Seconds int
+}
+
+// statsOf adds up a track listing
+func statsOf(tracks []Track) TrackStats {
+	stats := TrackStats{Count: len(tracks)}
+	for _, t := range tracks {
+		stats.Seconds += t.Duration
+	}
+	return stats
+}
+
+// formatDuration shows seconds as m:ss, or h:mm:ss from an hour up
+func formatDuration(seconds int) string {
+	if seconds >= 3600 {
+		return fmt.Sprintf("%d:%02d:%02d", seconds/3600, seconds/60%60, seconds%60)
+	}
+	return fmt.Sprintf("%d:%02d", seconds/60, seconds%60)
+}
+
+// parseDuration reads a track length as seconds ("225"), m:ss ("3:45") or h:mm:ss; blank is unknown (0)
+func parseDuration(s string) (int, bool) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, true
+	}
+	total := 0
+	parts := strings.Split(s, ":")
+	if len(parts) > 3 {
+		return 0, false
+	}
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 || (i > 0 && (n > 59 || len(p) != 2)) {
+			return 0, false
+		}
+		total = total*60 + n
+	}
+	return total, true
+}
+
+// validateTrack normalizes t and checks every field, returning an ErrValidation error with a message per bad field.
+// Disc 0 is disc 1; number 0 is left for saveTrack to fill in.
+func validateTrack(op string, t Track) (Track, error) {
+	t.Title = normalizeText(t.Title)
+	t.Artist = normalizeText(t.Artist)
+	if t.Disc == 0 {
+		t.Disc = 1
+	}
+	fields := make(map[string]string)
+	checkText(fields, "title", "a title", t.Title, maxTrackTitleLen)
+	if t.Artist != "" {
+		checkText(fields, "artist", "an artist", t.Artist, maxArtistLen)
+	}
+	if t.Disc < 1 || t.Disc > maxDisc {
+		fields["disc"] = fmt.Sprintf("The disc must be between 1 and %d.", maxDisc)
+	}
+	if t.Number < 0 || t.Number > maxTrackNumber {
+		fields["number"] = fmt.Sprintf("The track number must be between 1 and %d.", maxTrackNumber)
+	}
+	if t.Duration < 0 || t.Duration > maxTrackDuration {
+		fields["duration"] = "A track can run for at most 24 hours."
+	}
+	if len(fields) > 0 {
+		return t, invalidFields(op, fields)
+	}
+	return t, nil
+}
+
+// trackColumns selects a track and the name of its own artist, if it has one
+const trackColumns = `SELECT t.id, t.album_id, t.disc, t.number, t.title, COALESCE(t.duration, 0), COALESCE(ar.name, '')
+	FROM tracks t LEFT JOIN artists ar ON ar.id = t.artist_id`
+
+// scanTracks reads rows selected with trackColumns
+func scanTracks(op string, rows *sql.Rows) ([]Track, error) {
+	defer rows.Close()
+	tracks := []Track{}
+	for rows.Next() {
+		var t Track
+		if err := rows.Scan(&t.ID, &t.AlbumID, &t.Disc, &t.Number, &t.Title, &t.Duration, &t.Artist); err != nil {
+			return nil, dbError(op, err)
+		}
+		tracks = append(tracks, t)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, dbError(op, err)
+	}
+	return tracks, nil
+}
+
+// albumTracks lists an album's tracks in running order
+func albumTracks(ctx context.Context, q queryer, albumID int64) ([]Track, error) {
+	rows, err := q.QueryContext(ctx, trackColumns+" WHERE t.album_id = ? ORDER BY t.disc, t.number;", albumID)
+	if err != nil {
+		return nil, dbError("albumTracks", err)
+	}
+	return scanTracks("albumTracks", rows)
+}
+
+// trackByID returns one track
+func trackByID(ctx context.Context, id int64) (Track, error) {
+	rows, err := readDB(ctx).QueryContext(ctx, trackColumns+" WHERE t.id = ?;", id)
+	if err != nil {
+		return Track{}, dbError("trackByID", err)
+	}
+	tracks, err := scanTracks("trackByID", rows)
+	if err != nil {
+		return Track{}, err
+	}
+	if len(tracks) == 0 {
+		return Track{}, notFound("trackByID", "There is no track with id %d.", id)
+	}
+	return tracks[0], nil
+}
+
+// trackStats counts the tracks and running time of the given albums, keyed by album id
+func trackStats(ctx context.Context, ids []int64) (map[int64]TrackStats, error) {
+	stats := make(map[int64]TrackStats, len(ids))
+	if len(ids) == 0 {
+		return stats, nil
+	}
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	rows, err := readDB(ctx).QueryContext(ctx, `SELECT album_id, COUNT(*), COALESCE(SUM(duration), 0) FROM tracks
+		WHERE album_id IN (?`+strings.Repeat(", ?", len(ids)-1)+`) GROUP BY album_id;`, args...)
+	if err != nil {
+		return nil, dbError("trackStats", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int64
+		var s TrackStats
+		if err := rows.Scan(&id, &s.Count, &s.Seconds); err != nil {
+			return nil, dbError("trackStats", err)
+		}
+		stats[id] = s
+	}
+	if err := rows.Err(); err != nil {
+		return nil, dbError("trackStats", err)
+	}
+	return stats, nil
+}
+
+// attachTrackStats fills in the track count and running time of each album
+func attachTrackStats(ctx context.Context, albums []AlbumMap) error {
+	ids := make([]int64, len(albums))
+	for i, a := range albums {
+		ids[i] = a.ID
+	}
+	stats, err := trackStats(ctx, ids)
+	if err != nil {
+		return err
+	}
+	for i := range albums {
+		s := stats[albums[i].ID]
+		albums[i].TrackCount, albums[i].RunningTime = s.Count, s.Seconds
+	}
+	return nil
+}
+
+// saveTrack adds t (ID 0) or replaces it, inside one transaction that also records the album change.
+// A track number of 0 takes the next free number on its disc.
+func saveTrack(ctx context.Context, t Track) (Track, error) {
+	op := "addTrack"
+	if t.ID != 0 {
+		op = "updateTrack"
+	}
+	t, err := validateTrack(op, t)
+	if err != nil {
+		return Track{}, err
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return Track{}, dbError(op, err)
+	}
+	defer tx.Rollback()
+
+	if t.ID != 0 {
+		// a track stays on its album
+		if err := tx.QueryRowContext(ctx, "SELECT album_id FROM tracks WHERE id = ? FOR UPDATE;", t.ID).Scan(&t.AlbumID); err == sql.ErrNoRows {
+			return Track{}, notFound(op, "There is no track with id %d.", t.ID)
+		} else if err != nil {
+			return Track{}, dbError(op, err)
+		}
+	} else {
+		var exists int
+		if err := tx.QueryRowContext(ctx, "SELECT 1 FROM album WHERE id = ? FOR UPDATE;", t.AlbumID).Scan(&exists); err == sql.ErrNoRows {
+			return Track{}, notFound(op, "There is no album with id %d.", t.AlbumID)
+		} else if err != nil {
+			return Track{}, dbError(op, err)
+		}
+	}
+	if t.Number == 0 {
+		if err := tx.QueryRowContext(ctx, "SELECT COALESCE(MAX(number), 0) + 1 FROM tracks WHERE album_id = ? AND disc = ?;",
+			t.AlbumID, t.Disc).Scan(&t.Number); err != nil {
+			return Track{}, dbError(op, err)
+		}
+	}
+
+	var artistID sql.NullInt64
+	if t.Artist != "" {
+		credits, err := resolveArtists(ctx, tx, []Credit{{Name: t.Artist, Role: CreditPrimary}})
+		if err != nil {
+			return Track{}, err
+		}
+		artistID = sql.NullInt64{Int64: credits[0].ArtistID, Valid: true}
+		t.Artist = credits[0].Name
+	}
+	duration := sql.NullInt64{Int64: int64(t.Duration), Valid: t.Duration > 0}
+
+	if t.ID == 0 {
+		var result sql.Result
+		result, err = tx.ExecContext(ctx, "INSERT INTO tracks (album_id, disc, number, title, duration, artist_id) VALUES (?, ?, ?, ?, ?, ?);",
+			t.AlbumID, t.Disc, t.Number, t.Title, duration, artistID)
+		if err == nil {
+			t.ID, err = result.LastInsertId()
+		}
+	} else {
+		_, err = tx.ExecContext(ctx, "UPDATE tracks SET disc = ?, number = ?, title = ?, duration = ?, artist_id = ? WHERE id = ?;",
+			t.Disc, t.Number, t.Title, duration, artistID, t.ID)
+	}
+	if err != nil {
+		if errors.Is(dbError(op, err), ErrConflict) {
+			return Track{}, invalidFields(op, map[string]string{"number": fmt.Sprintf("Disc %d already has a track %d.", t.Disc, t.Number)})
+		}
+		return Track{}, dbError(op, err)
+	}
+	if err := recordChange(ctx, tx, t.AlbumID, "update"); err != nil {
+		return Track{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return Track{}, dbError(op, err)
+	}
+	logFrom(ctx).WithFields(log.Fields{"func": op, "album_id": t.AlbumID, "track_id": t.ID}).Debug("saved track")
+	return t, nil
+}
+
+// deleteTrack removes a track, returning the album it was on
+func deleteTrack(ctx context.Context, id int64) (int64, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, dbError("deleteTrack", err)
+	}
+	defer tx.Rollback()
+
+	var albumID int64
+	if err := tx.QueryRowContext(ctx, "SELECT album_id FROM tracks WHERE id = ? FOR UPDATE;", id).Scan(&albumID); err == sql.ErrNoRows {
+		return 0, notFound("deleteTrack", "There is no track with id %d.", id)
+	} else if err != nil {
+		return 0, dbError("deleteTrack", err)
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM tracks WHERE id = ?;", id); err != nil {
+		return 0, dbError("deleteTrack", err)
+	}
+	if err := recordChange(ctx, tx, albumID, "update"); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, dbError("deleteTrack", err)
+	}
+	logFrom(ctx).WithFields(log.Fields{"func": "deleteTrack", "album_id": albumID, "track_id": id}).Debug("deleted track")
+	return albumID, nil
+}
+
+// albumsByTrack finds albums with a track whose title contains title
+func albumsByTrack(ctx context.Context, title string) ([]AlbumMap, error) {
+	albums := []AlbumMap{}
+	pattern := "%" + strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(title) + "%"
+	rows, err := readDB(ctx).QueryContext(ctx, `SELECT `+albumColumns+` FROM album a
+		WHERE a.id IN (SELECT album_id FROM tracks WHERE title LIKE ?) ORDER BY a.title, a.id;`, pattern)
+	if err != nil {
+		return nil, dbError("albumsByTrack", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var alb AlbumMap
+		if err := rows.Scan(alb.scanFields()...); err != nil {
+			return nil, dbError("albumsByTrack", err)
+		}
+		albums = append(albums, alb)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, dbError("albumsByTrack", err)
+	}
+	logFrom(ctx).WithFields(log.Fields{"func": "albumsByTrack", "title": title, "count": len(albums)}).Debug("fetched albums by track")
+	return albums, nil
+}
+
+// trackFromForm reads the disc, number, title, duration and artist fields of a posted track form
+func trackFromForm(r *http.Request) (Track, error) {
+	t := Track{Title: r.FormValue("title"), Artist: r.FormValue("artist")}
+	fields := make(map[string]string)
+	for _, f := range []struct {
+		name string
+		dest *int
+	}{{"disc", &t.Disc}, {"number", &t.Number}} {
+		v := strings.TrimSpace(r.FormValue(f.name))
+		if v == "" {
+			continue
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			fields[f.name] = fmt.Sprintf("%q is not a number.", v)
+			continue
+		}
+		*f.dest = n
+	}
+	d, ok := parseDuration(r.FormValue("duration"))
+	if !ok {
+		fields["duration"] = fmt.Sprintf("%q is not a length, use m:ss.", r.FormValue("duration"))
+	}
+	t.Duration = d
+	if len(fields) > 0 {
+		return t, invalidFields("trackFromForm", fields)
+	}
+	return t, nil
+}
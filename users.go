@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// usersPage is the data for users.html
+type usersPage struct {
+	Users   []User
+	Roles   []Role
+	Success bool
+	Message string
+}
+
+// usersHandler lets admins list accounts, create them, change their role and delete them
+func usersHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	l := logFrom(ctx).WithField("func", "usersHandler")
+	page := usersPage{Roles: roles}
+
+	if r.Method == http.MethodPost {
+		username := r.FormValue("username")
+		role := Role(r.FormValue("role"))
+		l = l.WithFields(log.Fields{"username": username, "action": r.FormValue("action")})
+
+		var err error
+		switch r.FormValue("action") {
+		case "create":
+			_, err = createUser(ctx, username, r.FormValue("password"), role)
+			page.Message = fmt.Sprintf("Created %s as %s.", username, role)
+		case "role":
+			if username == currentUser(ctx).Username && role != RoleAdmin {
+				err = invalid("usersHandler", "You cannot take admin away from your own account.")
+				break
+			}
+			err = setRole(ctx, username, role)
+			page.Message = fmt.Sprintf("%s is now %s.", username, role)
+		case "delete":
+			if username == currentUser(ctx).Username {
+				err = invalid("usersHandler", "You cannot delete your own account.")
+				break
+			}
+			err = deleteUser(ctx, username)
+			page.Message = fmt.Sprintf("Deleted %s.", username)
+		default:
+			err = invalid("usersHandler", "Unknown action %q.", r.FormValue("action"))
+		}
+		if status, _ := errorStatus(err); err != nil && status >= http.StatusInternalServerError {
+			renderError(w, r, err)
+			return
+		}
+		page.Success = err == nil
+		if err != nil {
+			page.Message = errorMessage(err)
+			l.WithError(err).Warn("user change rejected")
+		} else {
+			l.Info("user changed")
+		}
+	}
+
+	users, err := allUsers(ctx)
+	if err != nil {
+		renderError(w, r, err)
+		return
+	}
+	page.Users = users
+	render(w, r, "users.html", page)
+}
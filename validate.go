@@ -0,0 +1,214 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// Album field limits. The lengths match the album table columns; the price range is
+// what the add and edit forms allow, in hundredths of the base currency (DECIMAL(5,2) tops out at 999.99).
+const (
+	maxTitleLen  = 128
+	maxArtistLen = 255
+	minPrice     = 100
+	maxPrice     = 99999
+)
+
+// priceLimit is minPrice or maxPrice as money in the base currency
+func priceLimit(cents int64) Money {
+	return Money{Cents: cents, Currency: appCfg.BaseCurrency}
+}
+
+// normalizeText cleans up free text before it is stored: Unicode NFC (so "é" typed two
+// ways is the same string), control characters dropped, runs of whitespace collapsed to
+// one space and the ends trimmed
+func normalizeText(s string) string {
+	s = norm.NFC.String(strings.ToValidUTF8(s, ""))
+	s = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) && !unicode.IsSpace(r) {
+			return -1
+		}
+		return r
+	}, s)
+	return strings.Join(strings.Fields(s), " ")
+}
+
+// normalizeAlbum returns alb with its text, credits, release details, genres and tags
+// normalized, the display credit rebuilt from them and its price rounded the way its currency is
+// (a price without a currency is in the base currency)
+func normalizeAlbum(alb Album) Album {
+	alb = normalizeDetails(alb)
+	alb.Title = normalizeText(alb.Title)
+	alb.Credits = normalizeCredits(alb.Artist, alb.Credits)
+	alb.Artist = creditLine(alb.Credits)
+	if alb.Price.Currency == "" {
+		alb.Price.Currency = appCfg.BaseCurrency
+	}
+	alb.Price = alb.Price.round()
+	alb.Genres = normalizeNames(alb.Genres)
+	alb.Tags = normalizeNames(alb.Tags)
+	return alb
+}
+
+// validateAlbum normalizes alb and checks every field, returning the cleaned album or an
+// ErrValidation error with a message per bad field. Every album write goes through it.
+func validateAlbum(op string, alb Album) (Album, error) {
+	alb = normalizeAlbum(alb)
+	fields := make(map[string]string)
+	checkText(fields, "title", "a title", alb.Title, maxTitleLen)
+	checkCredits(fields, alb.Credits)
+	if fields["artist"] == "" && utf8.RuneCountInString(alb.Artist) > maxArtistLen {
+		fields["artist"] = fmt.Sprintf("Together the names are too long to show, keep them to %d characters.", maxArtistLen)
+	}
+	switch {
+	case alb.Price.Currency != appCfg.BaseCurrency:
+		fields["price"] = fmt.Sprintf("Prices are in %s, not %s.", appCfg.BaseCurrency, alb.Price.Currency)
+	case alb.Price.Cmp(priceLimit(minPrice)) < 0 || alb.Price.Cmp(priceLimit(maxPrice)) > 0:
+		fields["price"] = fmt.Sprintf("The price must be between %s and %s.", priceLimit(minPrice), priceLimit(maxPrice))
+	}
+	checkDetails(fields, alb)
+	checkGenresAndTags(fields, alb.Genres, alb.Tags)
+	if len(fields) > 0 {
+		return alb, invalidFields(op, fields)
+	}
+	return alb, nil
+}
+
+// checkText records a message in fields when a required text value is empty or too long
+func checkText(fields map[string]string, field, what, value string, max int) {
+	switch n := utf8.RuneCountInString(value); {
+	case n == 0:
+		fields[field] = fmt.Sprintf("Enter %s.", what)
+	case n > max:
+		fields[field] = fmt.Sprintf("Keep it to %d characters (this is %d).", max, n)
+	}
+}
+
+// invalidFields returns an ErrValidation error carrying per-field messages
+func invalidFields(op string, fields map[string]string) error {
+	return &Error{Kind: ErrValidation, Op: op, Msg: "Please correct the highlighted fields.", Fields: fields}
+}
+
+// blankCredits is how many empty artist rows the add and edit forms offer for more credits
+const blankCredits = 2
+
+// AlbumForm is what the add and edit templates show: the values as the user typed them
+// and any error per field. Genres holds the names of the selected genres. Cover is the
+// album's cover so far; an uploaded image that passed its checks waits in upload.
+type AlbumForm struct {
+	Title         string
+	Credits       []CreditForm
+	Price         string
+	Released      string
+	Label         string
+	Format        string
+	CatalogNumber string
+	Notes         string
+	Genres        map[string]bool
+	Tags          string
+	Cover         Cover
+	RemoveCover   bool
+	Errors        map[string]string
+
+	upload *coverImage
+}
+
+// CreditForm is one artist row of the add and edit forms
+type CreditForm struct {
+	Name string
+	Role string
+}
+
+// formFromAlbum fills the form from a stored album
+func formFromAlbum(alb Album) AlbumForm {
+	form := AlbumForm{Title: alb.Title, Price: alb.Price.Decimal(), Released: alb.Released, Label: alb.Label,
+		Format: string(alb.Format), CatalogNumber: alb.CatalogNumber, Notes: alb.Notes,
+		Genres: make(map[string]bool), Tags: strings.Join(alb.Tags, ", "), Cover: alb.Cover}
+	for _, c := range alb.Credits {
+		form.Credits = append(form.Credits, CreditForm{Name: c.Name, Role: string(c.Role)})
+	}
+	for _, g := range alb.Genres {
+		form.Genres[g] = true
+	}
+	form.padCredits()
+	return form
+}
+
+// padCredits adds the blank artist rows; a new album starts with one primary artist row
+func (f *AlbumForm) padCredits() {
+	for i := 0; i < blankCredits || len(f.Credits) == 0; i++ {
+		role := CreditFeatured
+		if len(f.Credits) == 0 {
+			role = CreditPrimary
+		}
+		f.Credits = append(f.Credits, CreditForm{Role: string(role)})
+	}
+}
+
+// albumFromForm reads and validates the title, artist, price, release detail, genre, tags and cover fields of a posted form.
+// Each artist row is an "artist" field with an "artist_role" next to it; a missing role is primary.
+// Every selected genre is a "genre" field and the tags are one comma separated field. The cover is
+// an optional "cover" file, or a "remove_cover" checkbox on the edit form.
+// The returned form keeps what was typed, with the errors filled in when it is not valid.
+func albumFromForm(op string, r *http.Request) (Album, AlbumForm, error) {
+	form := AlbumForm{Title: r.FormValue("title"), Price: strings.TrimSpace(r.FormValue("price")), Released: r.FormValue("released"),
+		Label: r.FormValue("label"), Format: r.FormValue("format"), CatalogNumber: r.FormValue("catalog_number"), Notes: r.FormValue("notes"),
+		Genres: make(map[string]bool), Tags: r.FormValue("tags"), RemoveCover: r.FormValue("remove_cover") != ""}
+	alb := Album{Title: form.Title, Released: form.Released, Label: form.Label, Format: AlbumFormat(form.Format),
+		CatalogNumber: form.CatalogNumber, Notes: form.Notes, Genres: []string{}, Tags: splitTags(form.Tags)}
+	r.ParseForm()
+	for _, g := range r.PostForm["genre"] {
+		form.Genres[g] = true
+		alb.Genres = append(alb.Genres, g)
+	}
+	roles := r.PostForm["artist_role"]
+	for i, name := range r.PostForm["artist"] {
+		role := ""
+		if i < len(roles) {
+			role = roles[i]
+		}
+		if strings.TrimSpace(name) == "" {
+			continue
+		}
+		form.Credits = append(form.Credits, CreditForm{Name: name, Role: role})
+		alb.Credits = append(alb.Credits, Credit{Name: name, Role: CreditRole(role)})
+	}
+	form.padCredits()
+
+	priceErr := ""
+	if form.Price == "" {
+		priceErr = "Enter a price."
+	} else if p, ok := parseMoney(form.Price, appCfg.BaseCurrency); !ok {
+		priceErr = fmt.Sprintf("%q is not a price.", form.Price)
+	} else {
+		alb.Price = p
+	}
+
+	upload, coverErr := coverFromRequest(op, r)
+	if coverErr != nil && fieldErrors(coverErr) == nil {
+		return alb, form, coverErr
+	}
+	form.upload = upload
+
+	alb, err := validateAlbum(op, alb)
+	if priceErr != "" || coverErr != nil {
+		fields := fieldErrors(err)
+		if fields == nil {
+			fields = make(map[string]string)
+		}
+		if priceErr != "" {
+			fields["price"] = priceErr
+		}
+		for name, msg := range fieldErrors(coverErr) {
+			fields[name] = msg
+		}
+		err = invalidFields(op, fields)
+	}
+	form.Errors = fieldErrors(err)
+	return alb, form, err
+}